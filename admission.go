@@ -0,0 +1,48 @@
+package raft
+
+import "errors"
+
+// 未提交的日志数已经达到 Config.MaxPendingProposals
+var ErrTooManyPending = errors.New("raft: too many proposals waiting to be committed")
+
+// leader 已追加但还没有提交的日志数，不是 leader 时返回 0
+// 调用者可以据此自行实现背压，例如在接近 Config.MaxPendingProposals 时放慢提交
+func (cm *ConsensusModule) PendingProposals() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Leader {
+		return 0
+	}
+	return cm.pendingCount()
+}
+
+// 未提交的日志数，需在持有锁的情况下调用
+func (cm *ConsensusModule) pendingCount() int {
+	return cm.logEnd() - 1 - cm.commitIndex
+}
+
+// 准入控制，追加提案之前调用，需在持有锁的情况下调用
+// 未提交的日志数达到 Config.MaxPendingProposals 时返回 ErrTooManyPending；
+// 设置了 Config.BlockOnPendingLimit 时改为释放锁等待 commitIndex 推进，期间不再是 leader 时返回 ErrNotLeader，
+// 节点停止时返回 ErrStopped。不是 leader 时直接返回 nil，由之后的追加处理
+func (cm *ConsensusModule) admitProposal() error {
+	max := cm.config.MaxPendingProposals
+	if max <= 0 || cm.state != Leader {
+		return nil
+	}
+	for cm.pendingCount() >= max {
+		if !cm.config.BlockOnPendingLimit {
+			cm.logf(LogProposal, LevelDebug, "... rejecting proposal: %d entries pending, limit is %d", cm.pendingCount(), max)
+			return ErrTooManyPending
+		}
+		cm.admitCond.Wait()
+		switch cm.state {
+		case Dead:
+			return ErrStopped
+		case Leader:
+		default:
+			return ErrNotLeader
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package raft
+
+import (
+	"fmt"
+)
+
+// 客户端读取 commitChan 不及时时的处理策略
+type ApplyBackpressurePolicy int
+
+const (
+	// 默认策略，commitLoop 阻塞直到客户端读取，之后的提交也随之停顿
+	ApplyBlock ApplyBackpressurePolicy = iota
+	// 在 commitLoop 与 commitChan 之间缓冲最多 Config.ApplyBufferSize 条，缓冲满了再阻塞
+	ApplyBuffer
+	// 客户端没有及时读取时直接丢弃并告警。客户端的状态机会缺少被丢弃的日志，
+	// 只适用于可以容忍丢失的场景（例如只关心最新状态的缓存），默认不开启
+	ApplyDrop
+)
+
+func (p ApplyBackpressurePolicy) String() string {
+	switch p {
+	case ApplyBlock:
+		return "Block"
+	case ApplyBuffer:
+		return "Buffer"
+	case ApplyDrop:
+		return "Drop"
+	default:
+		return "unknown"
+	}
+}
+
+// 交给客户端的一项，send 为 false 时只推进 deliveredIndex（Raft 内部的日志项、见证者）
+type applyItem struct {
+	entry CommitEntry
+	send  bool
+}
+
+// 按 Config.ApplyBackpressurePolicy 把 entry 交给客户端，在 commitLoop 中调用，不能持有锁
+func (cm *ConsensusModule) deliver(entry CommitEntry, send bool) {
+	switch cm.config.ApplyBackpressurePolicy {
+	case ApplyBuffer:
+		item := applyItem{entry: entry, send: send}
+		select {
+		case cm.applyBuf <- item:
+		default:
+			// 缓冲已满，记录一次后阻塞等待客户端读取
+			cm.mu.Lock()
+			cm.applyBufferFull++
+			cm.mu.Unlock()
+			cm.applyBuf <- item
+		}
+		cm.mu.Lock()
+		cm.applyBufferMaxLen = intMax(cm.applyBufferMaxLen, len(cm.applyBuf))
+		cm.mu.Unlock()
+		return
+	case ApplyDrop:
+		if send {
+			select {
+			case cm.commitChan <- entry:
+			default:
+				cm.logf(LogApply, LevelWarn, "commitChan is full, dropping commit at index %d", entry.Index)
+				cm.mu.Lock()
+				cm.droppedCommits++
+				cm.mu.Unlock()
+			}
+		}
+	default:
+		if send {
+			cm.commitChan <- entry
+		}
+	}
+	cm.mu.Lock()
+	cm.setDeliveredIndex(entry.Index)
+	cm.mu.Unlock()
+}
+
+// ApplyBuffer 策略下把缓冲中的提交转发给 commitChan，applyBuf 关闭且转发完之后关闭 applyDone
+func (cm *ConsensusModule) forwardApplies() {
+	for item := range cm.applyBuf {
+		if item.send {
+			cm.commitChan <- item.entry
+		}
+		cm.mu.Lock()
+		cm.setDeliveredIndex(item.entry.Index)
+		cm.mu.Unlock()
+	}
+	close(cm.applyDone)
+}
+
+// 告诉 Raft 客户端的状态机已经应用到 index（例如状态机自己持久化了应用进度），
+// commitLoop 之后只交付 index 之后的日志，避免重启后重复应用不幂等的命令；index 不小于恢复的快照时快照也不再交付。
+// 需要在关闭 ready 之前、还没有交付任何提交时调用，index 不能超过本地日志的末尾
+func (cm *ConsensusModule) SetLastApplied(index int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return ErrStopped
+	}
+	if cm.applyStarted {
+		return fmt.Errorf("raft: SetLastApplied(%d) after commits were delivered", index)
+	}
+	if index >= cm.logEnd() {
+		return fmt.Errorf("raft: last applied index %d is beyond the log end %d", index, cm.logEnd()-1)
+	}
+	if index <= cm.lastApplied {
+		return nil // 快照已经覆盖了 index，仍然交付快照
+	}
+	// 客户端应用过的日志一定已经提交
+	cm.lastApplied = index
+	cm.snapshotPending = false
+	if cm.commitIndex < index {
+		cm.commitIndex = index
+		cm.notifyCommitWatchers()
+	}
+	cm.setDeliveredIndex(index)
+	cm.logf(LogApply, LevelDebug, "client has applied up to index %d", index)
+	return nil
+}
@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// 获取用于备份的快照，leader 与 follower 都可以调用
+// 调用 SnapshotProvider 获取客户端已应用到某个日志序号的状态机快照，期间不持有锁，不影响 Submit 与复制，
+// 也不压缩日志。返回快照对应的日志序号与备份数据，备份数据中还包括该日志的任期，
+// 可以用 RestoreFromBackup 写入新节点的 storage，让新成员从快照开始追赶，而不必复制全部日志
+func (cm *ConsensusModule) SnapshotForBackup() (int, []byte, error) {
+	provider := cm.config.SnapshotProvider
+	if provider == nil {
+		return -1, nil, errNoSnapshotProvider
+	}
+	cm.mu.Lock()
+	if cm.state == Dead {
+		cm.mu.Unlock()
+		return -1, nil, ErrStopped
+	}
+	cm.mu.Unlock()
+
+	// 调用客户端时不持有锁
+	data, index, err := provider()
+	if err != nil {
+		return -1, nil, fmt.Errorf("raft: SnapshotProvider: %w", err)
+	}
+	cm.mu.Lock()
+	var term int
+	switch {
+	case index < 0 || index > cm.lastApplied:
+		err = fmt.Errorf("raft: snapshot index %d is not within the applied log (last applied %d)", index, cm.lastApplied)
+	case index == cm.snapshotIndex:
+		term = cm.snapshotTerm
+	case index < cm.logBase:
+		err = ErrCompacted
+	default:
+		term = cm.termAt(index)
+	}
+	cm.mu.Unlock()
+	if err != nil {
+		return -1, nil, err
+	}
+
+	var backup bytes.Buffer
+	if err := gob.NewEncoder(&backup).Encode(persistedSnapshot{Index: index, Term: term, Data: data}); err != nil {
+		return -1, nil, err
+	}
+	return index, backup.Bytes(), nil
+}
+
+// 把 SnapshotForBackup 得到的备份写入新节点的 storage，之后用它新建共识模块
+// 节点以快照的任期启动、没有投票，快照之后的日志由 leader 复制；
+// 启动后快照像重启时一样先交给客户端（见 CommitEntry.Snapshot）。storage 中已经有状态时返回 ErrBootstrapped
+func RestoreFromBackup(storage Storage, backup []byte) error {
+	if storage.HasData() {
+		return ErrBootstrapped
+	}
+	var snapshot persistedSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(backup)).Decode(&snapshot); err != nil {
+		return fmt.Errorf("raft: decoding backup: %w", err)
+	}
+	if snapshot.Index < 0 || snapshot.Term < 0 {
+		return fmt.Errorf("raft: backup has invalid index %d and term %d", snapshot.Index, snapshot.Term)
+	}
+
+	// 借用持久化的编码，保证与共识模块自己写入的格式一致
+	cm := &ConsensusModule{
+		storage:       storage,
+		config:        DefaultConfig(),
+		currentTerm:   snapshot.Term,
+		votedFor:      -1,
+		logBase:       snapshot.Index,
+		logBaseTerm:   snapshot.Term,
+		snapshot:      snapshot.Data,
+		snapshotIndex: snapshot.Index,
+		snapshotTerm:  snapshot.Term,
+	}
+	cm.termDirty, cm.voteDirty, cm.logDirty, cm.snapshotDirty = true, true, true, true
+	batch, err := cm.encodeState()
+	if err != nil {
+		return err
+	}
+	return storage.SetBatch(batch)
+}
@@ -0,0 +1,156 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// 时钟
+// 共识模块的所有计时都通过 Clock 完成，测试时可以替换为 FakeClock 手动推进时间
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// 与 time.Timer 语义一致
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// 与 time.Ticker 语义一致
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// 真实时钟，即 time 包
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// 手动推进的时钟，供测试使用
+// 只有调用 Advance 时，时间才会前进，到期的 Timer 与 Ticker 才会触发
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Unix(0, 0)}
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *FakeClock) NewTimer(d time.Duration) Timer {
+	return fc.newWaiter(d, 0)
+}
+
+func (fc *FakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{fc.newWaiter(d, d)}
+}
+
+// 推进时间，并触发所有到期的 Timer 与 Ticker
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+	active := fc.waiters[:0]
+	for _, w := range fc.waiters {
+		if !w.active {
+			continue
+		}
+		if !w.when.After(fc.now) {
+			// 与 time 包一致，channel 只有一个缓冲，接收方来不及处理时丢弃
+			select {
+			case w.c <- fc.now:
+			default:
+			}
+			if w.period > 0 {
+				for !w.when.After(fc.now) {
+					w.when = w.when.Add(w.period)
+				}
+			} else {
+				w.active = false
+				continue
+			}
+		}
+		active = append(active, w)
+	}
+	fc.waiters = active
+}
+
+func (fc *FakeClock) newWaiter(d, period time.Duration) *fakeTimer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	w := &fakeTimer{
+		clock:  fc,
+		c:      make(chan time.Time, 1),
+		when:   fc.now.Add(d),
+		period: period,
+		active: true,
+	}
+	fc.waiters = append(fc.waiters, w)
+	return w
+}
+
+// FakeClock 的 Timer 与 Ticker，period 为 0 时是 Timer
+type fakeTimer struct {
+	clock  *FakeClock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+func (w *fakeTimer) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeTimer) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	wasActive := w.active
+	w.active = false
+	return wasActive
+}
+
+func (w *fakeTimer) Reset(d time.Duration) bool {
+	fc := w.clock
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	wasActive := w.active
+	w.when = fc.now.Add(d)
+	if !wasActive {
+		w.active = true
+		fc.waiters = append(fc.waiters, w)
+	}
+	return wasActive
+}
+
+type fakeTicker struct{ w *fakeTimer }
+
+func (t fakeTicker) C() <-chan time.Time { return t.w.C() }
+func (t fakeTicker) Stop()               { t.w.Stop() }
@@ -0,0 +1,67 @@
+// Package clustertest spins up in-process Raft clusters for tests.
+//
+// Nodes talk over an in-memory network (raft.MemNetwork) and keep their state
+// in in-memory storage, so no ports are opened; all nodes are connected when
+// the Harness is created. Commands submitted through the harness should be
+// unique and comparable with ==, such as distinct ints, so that
+// CheckCommitted can find them in the commit sequence.
+package clustertest
+
+import (
+	"testing"
+
+	raft "github.com/PedroGao/praft"
+)
+
+// Harness is a cluster of n connected Raft nodes. It wraps raft.Harness, which
+// the raft package uses for its own tests.
+type Harness struct {
+	h *raft.Harness
+}
+
+// NewHarness creates a new Harness with n nodes connected to each other.
+func NewHarness(t *testing.T, n int) *Harness {
+	return NewHarnessWithConfig(t, n, nil)
+}
+
+// NewHarnessWithConfig is like NewHarness, but creates all nodes with the
+// given config.
+func NewHarnessWithConfig(t *testing.T, n int, config *raft.Config) *Harness {
+	return &Harness{h: raft.NewMemHarness(t, n, config)}
+}
+
+// Shutdown stops all the nodes and waits for them to stop delivering commits.
+func (h *Harness) Shutdown() {
+	h.h.Shutdown()
+}
+
+// DisconnectPeer disconnects a node from all other nodes in the cluster.
+func (h *Harness) DisconnectPeer(id int) {
+	h.h.DisconnectPeer(id)
+}
+
+// ReconnectPeer connects a node to all other connected nodes in the cluster.
+// Nodes that are still disconnected stay that way.
+func (h *Harness) ReconnectPeer(id int) {
+	h.h.ReconnectPeer(id)
+}
+
+// CheckSingleLeader checks that exactly one connected node thinks it's the
+// leader and returns its id and term. It retries for a while if no leader is
+// identified yet.
+func (h *Harness) CheckSingleLeader() (int, int) {
+	return h.h.CheckSingleLeader()
+}
+
+// SubmitToLeader submits cmd to the current leader and returns the leader's
+// id. It fails the test if the leader rejects the command.
+func (h *Harness) SubmitToLeader(cmd interface{}) int {
+	return h.h.SubmitToLeader(cmd)
+}
+
+// CheckCommitted waits until every connected node has committed cmd, then
+// verifies that they all committed it at the same index after the same
+// commands. It returns that index.
+func (h *Harness) CheckCommitted(cmd interface{}) int {
+	return h.h.WaitCommitted(cmd)
+}
@@ -0,0 +1,24 @@
+package clustertest
+
+import "testing"
+
+func TestHarness(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId := h.SubmitToLeader(1)
+	h.CheckCommitted(1)
+
+	// A majority keeps committing while a follower is away, and the follower
+	// catches up once it's back.
+	otherId := (leaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	h.SubmitToLeader(2)
+	h.CheckCommitted(2)
+
+	h.ReconnectPeer(otherId)
+	h.SubmitToLeader(3)
+	if index := h.CheckCommitted(3); index != 2 {
+		t.Errorf("cmd 3 committed at index %d, want 2", index)
+	}
+}
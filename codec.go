@@ -0,0 +1,30 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// 命令编解码器
+// Codec 负责将客户端提交的 Command 序列化为字节，持久化与（未来的）网络传输都通过它完成，
+// 客户端可以替换为 protobuf/JSON 等实现，以自行控制 schema 演进
+type Codec interface {
+	Encode(command interface{}) ([]byte, error)
+	Decode(data []byte, command *interface{}) error
+}
+
+// 默认的 gob 编解码器，与之前的行为保持一致，Command 的具体类型需要通过 gob.Register 注册
+type GobCodec struct{}
+
+func (GobCodec) Encode(command interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	// 编码接口指针，这样 gob 会带上具体类型信息
+	if err := gob.NewEncoder(&buf).Encode(&command); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, command *interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(command)
+}
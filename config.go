@@ -0,0 +1,268 @@
+package raft
+
+import (
+	"crypto/tls"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 共识模块配置
+// 所有字段都有默认值，传入 nil 即使用 DefaultConfig
+type Config struct {
+	Codec Codec // 命令编解码器，默认为 gob
+
+	// 见证者（仲裁）节点，用于 2+1 部署中的打破平局
+	// 见证者参与选举投票和提交多数派的计算，但只保存日志的序号与任期，不保存 Command，
+	// 也不会向 commitChan 提交任何数据，且永远不会发起选举成为 Leader。
+	// 注意持久性的折衷：见证者计入多数派，但它并没有日志内容，因此已提交的日志实际上
+	// 只保存在多数派中的完整节点上，若这些完整节点同时丢失数据，日志将无法恢复
+	Witness bool
+
+	// RPC 传输层的 TLS 配置，nil 表示明文传输
+	// 同一份配置既用于监听也用于拨号 peer，要启用双向认证，需同时设置 Certificates、
+	// RootCAs、ClientCAs，并将 ClientAuth 设为 tls.RequireAndVerifyClientCert
+	TLSConfig *tls.Config
+
+	Clock Clock // 时钟，默认为真实时间，测试时可使用 FakeClock
+
+	// 选举超时与重试退避抖动的种子来源，默认以节点 id 和当前时间播种，测试时可传入固定种子以复现
+	// 每个共识模块创建时从中取一个种子，与节点 id 一起派生自己的随机源，之后不再使用它，
+	// 因此同一份配置可以交给多个共识模块（例如 NewHarnessWithConfig、Server.AddGroup）；按相同顺序创建时结果可复现
+	Rand *rand.Rand
+
+	Tracer Tracer // 追踪器，默认不追踪
+
+	ElectionStrategy ElectionStrategy // 选举策略，默认为标准 Raft，见 ElectionStrategy
+
+	// 学习者节点的 id，集群中所有节点需配置相同
+	// 学习者接收日志复制，但不参与投票，也不计入提交多数派，永远不会发起选举
+	Learners []int
+
+	// 学习者落后 leader 的 commitIndex 不超过该条数时，才认为已经追上，可以提供读服务
+	LearnerCatchUpThreshold int
+
+	// 稳定领导权模式，同时开启 PreVote 与 CheckQuorum
+	// PreVote：发起选举前先询问多数派是否会投票，避免被隔离的节点重新加入时抬高任期打断 leader；
+	// CheckQuorum：leader 在一个最长选举超时内没有收到多数派的回复时主动退位，
+	// 因此 leader 自己也会拒绝其它节点的投票请求（领导权转移发起的选举除外）
+	StableLeadership bool
+
+	// 集群通过 Bootstrap 引导，所有节点需配置相同
+	// 日志为空的节点不会发起选举，直到收到 leader 复制的日志（最早的一条就是引导时的配置日志项），
+	// 以免还没有配置的新节点抢先当选，覆盖掉尚未提交的引导配置
+	RequireBootstrap bool
+
+	// 选举优先级，key 为节点 id，没有配置的节点优先级为 0，集群中所有节点需配置相同
+	// 每有一个优先级更高的投票节点，选举超时就增加一个随机范围，让优先级高的节点先发起选举；
+	// 优先级相同时仍由随机超时决定。优先级只影响发起选举的时机，不影响投票，
+	// 因此优先级高的节点不可用或日志落后时，优先级低的节点仍然可以当选
+	Priorities map[int]int
+
+	// leader 有日志等待提交、commitIndex 却超过 CommitStallTimeout 没有推进时打印告警，
+	// 并在另外的 goroutine 中调用 OnCommitStalled，每次停滞只报告一次。通常说明已经失去多数派，
+	// 需要恢复节点或者调整成员。CommitStallTimeout 为 0 时不检测
+	CommitStallTimeout time.Duration
+	OnCommitStalled    func(s CommitStall)
+
+	// 配置日志项被应用时，对与之前配置相比的每个成员变更（见 MembershipEvent）调用一次，
+	// 外部系统（服务发现、DNS 等）可以据此与已提交的集群配置保持同步。在 commitLoop 中按顺序调用，不应阻塞太久
+	OnMembershipChange func(e MembershipEvent)
+
+	// 每轮选举结束时在另外的 goroutine 中调用，见 ElectionResult；统计 ElectionTimedOut 可以发现选票被瓜分，据此调整选举超时
+	OnElection func(r ElectionResult)
+
+	// 不是 leader 时把 Submit 转发给已知的 leader，返回 leader 的结果，客户端无需知道谁是 leader
+	// 转发最多经过两跳，等待 leader 回复超过 ForwardTimeout 时返回 false，不大于 0 时使用默认值
+	ForwardSubmit  bool
+	ForwardTimeout time.Duration
+
+	// 探测 peer 是否可达，与心跳相互独立，只用于健康状况，不影响选举与提交，见 PeerReachability
+	// 每隔 PingInterval 向每个 peer 发送 Ping，超过 PingTimeout（默认等于 PingInterval）没有回复算作失败；
+	// 连续失败 PingSuspectAfter 次（默认 1）为 PeerSuspect，PingUnreachableAfter 次（默认 3）为 PeerUnreachable，
+	// 成功一次即恢复为 PeerReachable。领导权转移时不选择不可达的 peer。PingInterval 为 0 时不探测
+	PingInterval         time.Duration
+	PingTimeout          time.Duration
+	PingSuspectAfter     int
+	PingUnreachableAfter int
+
+	// 所属的 Raft 组（multi-raft），写入发出的每个 RPC，接收方的 Server 据此交给对应的共识模块，
+	// 同一个组的所有节点需配置相同。见 Server.AddGroup
+	GroupID int
+
+	// 包装 Server 的传输层，id 为当前节点 id，可用于在真实传输之前插入 FaultTransport
+	WrapTransport func(id int, t Transport) Transport
+
+	SnapshotChunkSize int // 发送快照时每个分块的最大字节数
+
+	MaxAppendEntries int // 每个 AppendEntries 最多携带的日志条数，0 表示不限制
+
+	// 忽略任期比当前任期大 MaxTermGap 以上的请求与回复，0 表示不限制（默认）
+	// 用于半可信的网络，避免出错或恶意的节点发来极大的任期，迫使整个集群跟着跳到这个任期。
+	// 被隔离的节点反复发起选举也会抬高任期，超过限制后要等集群的任期追上才能重新加入，建议同时开启 StableLeadership
+	MaxTermGap int
+
+	// 日志分歧检测，所有节点需配置相同
+	// leader 在 AppendEntries 中带上 follower 已匹配日志的校验和，follower 与自己的日志比较，
+	// 不一致时打印警告、计入 Metrics.LogDivergences 并在另外的 goroutine 中调用 OnLogDivergence。
+	// 校验和基于 Codec 编码后的 Command，因此编码必须是确定的；开启后每条日志项额外编码一次
+	DetectLogDivergence bool
+	OnLogDivergence     func(d LogDivergence)
+
+	// 客户端读取 commitChan 不及时时的处理策略，默认 ApplyBlock，见 ApplyBackpressurePolicy
+	// ApplyBuffer 策略的缓冲条数为 ApplyBufferSize，不大于 0 时使用默认值
+	ApplyBackpressurePolicy ApplyBackpressurePolicy
+	ApplyBufferSize         int
+
+	// 追加客户端命令之前调用，返回错误时拒绝这次提交，command 不会进入日志，可用于校验或配额限制
+	// 在 Submit 等方法获取锁之前调用，因此可以耗时，但可能与其它提交并发调用；nil 表示不检查
+	PreAppendHook func(command interface{}) error
+
+	// 客户端命令经 Codec 编码后的最大字节数，超过时 Submit 等方法拒绝提交（返回 false 或 ErrTooLarge），
+	// 以免单个超大的命令拖慢每一次持久化与 AppendEntries；0 表示不限制
+	MaxCommandBytes int
+
+	// 灵活多数派（Flexible Paxos）
+	// 提交日志所需的节点数 ReplicationQuorumSize 与赢得选举所需的票数 ElectionQuorumSize 可以分开配置，
+	// 只计算参与投票的节点（包括自己），0 表示多数派。两者之和必须大于投票节点数，保证新 leader
+	// 一定拥有所有已提交的日志；Raft 的任期不区分候选人，选举多数派之间也必须相交，
+	// 因此 ElectionQuorumSize 不能小于多数派。例如 5 个节点时，ReplicationQuorumSize 为 4、
+	// ElectionQuorumSize 为 3，或 ReplicationQuorumSize 为 2、ElectionQuorumSize 为 4
+	ReplicationQuorumSize int
+	ElectionQuorumSize    int
+
+	// 向连续失败的 peer 重试 AppendEntries 的退避：连续失败几次之后，等待时间从 RetryBackoffBase 开始
+	// 每次加倍，最长 RetryBackoffMax，并加入随机抖动，不大于 0 时使用默认值。等待期间恢复的 peer
+	// 收不到心跳，可能先超时发起选举，因此默认的 RetryBackoffMax 小于最短的选举超时；
+	// 开启 StableLeadership 之后恢复的 peer 不会打断 leader，可以调大 RetryBackoffMax 以减少发往宕机 peer 的请求
+	RetryBackoffBase time.Duration
+	RetryBackoffMax  time.Duration
+
+	// 持久化失败时的重试次数与第一次重试前的等待时间，之后每次等待时间加倍，按 Clock 计时。
+	// 重试期间持有锁，因此总的等待时间不超过 25ms，达到之后不再重试。
+	// PersistRetries 为 0 时使用默认值，负数表示不重试。仍然失败时节点进入降级状态，
+	// 并在另外的 goroutine 中调用 OnPersistError
+	PersistRetries      int
+	PersistRetryBackoff time.Duration
+	OnPersistError      func(err error)
+
+	// 批量持久化（group commit）的间隔。0（默认）表示每次 Submit 都同步持久化；
+	// 大于 0 时 leader 追加的日志先只写入内存，每个间隔统一持久化一次，Submit 等方法在所在批次持久化之后才返回，
+	// 以少许延迟换取大量并发写入时更高的吞吐。日志在持久化之前已经开始复制，leader 自己的一票在持久化之后才计入提交；
+	// 持久化失败时 Submit 返回 false，但已经复制给 follower 的日志仍可能被提交
+	PersistBatchInterval time.Duration
+
+	// 按子系统（LogElection、LogReplication、LogPersistence、LogRPC、LogProposal、LogApply、LogMembership）
+	// 设置日志的级别，低于该级别的日志不输出，例如只打开复制的详细日志而让选举保持安静；
+	// 没有配置的子系统输出所有级别。LevelWarn 的警告不受 DebugCM 控制，设为 LevelOff 才会关闭
+	LogLevels map[string]Level
+
+	// 自动快照
+	// 已应用但还未压缩的日志超过 SnapshotThreshold 条时，调用 SnapshotProvider 获取状态机快照
+	// 及其对应的日志序号，然后压缩日志，并保留快照之前的 SnapshotEntriesRetained 条日志，
+	// 以便稍慢的 follower 不需要安装快照。SnapshotThreshold 为 0 或没有 SnapshotProvider 时不自动快照
+	SnapshotThreshold       int
+	SnapshotEntriesRetained int
+	SnapshotProvider        func() ([]byte, int, error)
+
+	// 日志切片的初始容量，写入量大时预先分配可以减少追加日志时的扩容与复制；
+	// 压缩日志或安装快照后新建的切片也至少有这么大的容量。0 表示按需增长
+	InitialLogCapacity int
+
+	// 准入控制：leader 未提交的日志数（lastLogIndex - commitIndex）达到 MaxPendingProposals 时，
+	// Submit 等方法拒绝新的提案（返回 false 或 ErrTooManyPending），以免复制跟不上时未提交的日志占满 leader 的内存；
+	// BlockOnPendingLimit 为 true 时改为阻塞等待 commitIndex 推进。0 表示不限制，当前的数量见 PendingProposals
+	MaxPendingProposals int
+	BlockOnPendingLimit bool
+}
+
+// 默认配置
+func DefaultConfig() *Config {
+	return &Config{
+		Codec:  GobCodec{},
+		Clock:  realClock{},
+		Tracer: noopTracer{},
+
+		ElectionStrategy: StandardElection{},
+
+		SnapshotChunkSize: 1 << 20,
+
+		ApplyBufferSize: 1024,
+
+		ForwardTimeout: 500 * time.Millisecond,
+
+		PingSuspectAfter:     1,
+		PingUnreachableAfter: 3,
+
+		RetryBackoffBase: 50 * time.Millisecond,
+		RetryBackoffMax:  100 * time.Millisecond,
+
+		PersistRetries:      3,
+		PersistRetryBackoff: 10 * time.Millisecond,
+	}
+}
+
+// 补全未设置的字段
+func (c *Config) withDefaults() *Config {
+	d := DefaultConfig()
+	if c == nil {
+		return d
+	}
+	cc := *c
+	if cc.Codec == nil {
+		cc.Codec = d.Codec
+	}
+	if cc.Clock == nil {
+		cc.Clock = d.Clock
+	}
+	if cc.Tracer == nil {
+		cc.Tracer = d.Tracer
+	}
+	if cc.ElectionStrategy == nil {
+		cc.ElectionStrategy = d.ElectionStrategy
+	}
+	if cc.ApplyBufferSize <= 0 {
+		cc.ApplyBufferSize = d.ApplyBufferSize
+	}
+	if cc.ForwardTimeout <= 0 {
+		cc.ForwardTimeout = d.ForwardTimeout
+	}
+	if cc.PingTimeout <= 0 {
+		cc.PingTimeout = cc.PingInterval
+	}
+	if cc.PingSuspectAfter <= 0 {
+		cc.PingSuspectAfter = d.PingSuspectAfter
+	}
+	if cc.PingUnreachableAfter <= 0 {
+		cc.PingUnreachableAfter = d.PingUnreachableAfter
+	}
+	if cc.SnapshotChunkSize <= 0 {
+		cc.SnapshotChunkSize = d.SnapshotChunkSize
+	}
+	if cc.RetryBackoffBase <= 0 {
+		cc.RetryBackoffBase = d.RetryBackoffBase
+	}
+	if cc.RetryBackoffMax <= 0 {
+		cc.RetryBackoffMax = d.RetryBackoffMax
+	}
+	if cc.PersistRetries == 0 {
+		cc.PersistRetries = d.PersistRetries
+	}
+	if cc.PersistRetryBackoff <= 0 {
+		cc.PersistRetryBackoff = d.PersistRetryBackoff
+	}
+	return &cc
+}
+
+// 保护从 Config.Rand 取种子，同一个 Rand 可能被并发创建的多个共识模块共享
+var configRandMu sync.Mutex
+
+// 共识模块随机源的种子：设置了 Rand 时从中取一个，否则使用当前时间
+func (c *Config) randSeed() int64 {
+	if c.Rand == nil {
+		return c.Clock.Now().UnixNano()
+	}
+	configRandMu.Lock()
+	defer configRandMu.Unlock()
+	return c.Rand.Int63()
+}
@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// 检测到的日志分歧：follower 已与 leader 匹配的日志与 leader 的内容不同，
+// 通常说明存储损坏或实现有缺陷，见 Config.DetectLogDivergence
+type LogDivergence struct {
+	LeaderId   int    // 发来校验和的 leader
+	From       int    // 校验范围的起点，不包括 From 本身
+	To         int    // 校验范围的终点，包括 To
+	LeaderHash uint64 // leader 的校验和
+	LocalHash  uint64 // 本节点的校验和
+}
+
+// 单条日志项的哈希，包括序号、任期、类型以及用 Codec 编码后的 Command
+func (cm *ConsensusModule) entryHash(index int, entry LogEntry) uint64 {
+	h := fnv.New64a()
+	var buf [24]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(index))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(entry.Term))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(entry.Type))
+	h.Write(buf[:])
+	if entry.Command != nil {
+		if data, err := cm.commandCodec(entry.Type).Encode(entry.Command); err == nil {
+			h.Write(data)
+		}
+	}
+	return h.Sum64()
+}
+
+// (from, to] 范围内日志的校验和，范围不在日志中时第二个返回值为 false，需在持有锁的情况下调用
+// 校验和是每条日志项哈希之和，各节点压缩点不同也可以比较同一范围；
+// logHashes[i] 为 cm.log[:i+1] 的哈希之和，追加日志时在这里按需补齐，
+// 截断或压缩日志时由调用者清空（resetLogHashes）
+func (cm *ConsensusModule) rangeHash(from, to int) (uint64, bool) {
+	if from < cm.logBase || to >= cm.logEnd() || from > to {
+		return 0, false
+	}
+	for i := len(cm.logHashes); i < cm.logPos(to)+1; i++ {
+		var prev uint64
+		if i > 0 {
+			prev = cm.logHashes[i-1]
+		}
+		cm.logHashes = append(cm.logHashes, prev+cm.entryHash(cm.logBase+1+i, cm.log[i]))
+	}
+	sum := func(index int) uint64 {
+		if index == cm.logBase {
+			return 0
+		}
+		return cm.logHashes[cm.logPos(index)]
+	}
+	return sum(to) - sum(from), true
+}
+
+// 日志被截断或压缩后清空校验和，需在持有锁的情况下调用
+func (cm *ConsensusModule) resetLogHashes() {
+	cm.logHashes = nil
+}
+
+// 截断日志时丢弃 pos 及之后的校验和，需在持有锁的情况下调用
+func (cm *ConsensusModule) truncateLogHashes(pos int) {
+	if pos < len(cm.logHashes) {
+		cm.logHashes = cm.logHashes[:pos]
+	}
+}
+
+// leader 为发往 peer 的 AppendEntries 填上已匹配日志的校验和，需在持有锁的情况下调用
+func (cm *ConsensusModule) addDivergenceCheck(peerId int, args *AppendEntriesArgs) {
+	if !cm.config.DetectLogDivergence {
+		return
+	}
+	from, to := cm.logBase, cm.matchIndex[peerId]
+	if hash, ok := cm.rangeHash(from, to); ok && from < to {
+		args.CheckFrom, args.CheckTo, args.CheckHash = from, to, hash
+	}
+}
+
+// follower 校验 leader 发来的校验和，需在持有锁的情况下调用
+// 只用于诊断，不影响对请求的处理；本节点已经压缩了这部分日志或是见证者（没有 Command）时跳过
+func (cm *ConsensusModule) verifyDivergenceCheck(args AppendEntriesArgs) {
+	if !cm.config.DetectLogDivergence || cm.config.Witness || args.CheckFrom >= args.CheckTo {
+		return
+	}
+	hash, ok := cm.rangeHash(args.CheckFrom, args.CheckTo)
+	if !ok || hash == args.CheckHash {
+		return
+	}
+	d := LogDivergence{LeaderId: args.LeaderId, From: args.CheckFrom, To: args.CheckTo, LeaderHash: args.CheckHash, LocalHash: hash}
+	cm.logDivergences++
+	cm.logf(LogReplication, LevelWarn, "log diverges from leader %d in (%d, %d]: leader hash %x, local hash %x", d.LeaderId, d.From, d.To, d.LeaderHash, d.LocalHash)
+	if cb := cm.config.OnLogDivergence; cb != nil {
+		go cb(d)
+	}
+}
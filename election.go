@@ -0,0 +1,78 @@
+package raft
+
+// 一轮选举的结果，见 Config.OnElection
+type ElectionOutcome int
+
+const (
+	ElectionWon            ElectionOutcome = iota // 获得足够的投票，成为 leader
+	ElectionLostHigherTerm                        // 收到更高任期的回复，退回 Follower
+	ElectionTimedOut                              // 选举超时仍未分出结果（例如选票被瓜分），随后发起下一轮选举
+)
+
+func (o ElectionOutcome) String() string {
+	switch o {
+	case ElectionWon:
+		return "Won"
+	case ElectionLostHigherTerm:
+		return "LostHigherTerm"
+	case ElectionTimedOut:
+		return "TimedOut"
+	default:
+		return "unknown"
+	}
+}
+
+// 选举结果事件
+type ElectionResult struct {
+	Term    int             // 这一轮选举的任期
+	Outcome ElectionOutcome // 结果
+	Votes   int             // 赢得选举时获得的票数（包括自己），其它结果为 0
+}
+
+// 报告一轮选举的结果，需在持有锁的情况下调用，回调在另外的 goroutine 中执行
+func (cm *ConsensusModule) reportElection(r ElectionResult) {
+	cm.logf(LogElection, LevelInfo, "election in term %d: %v (votes=%d)", r.Term, r.Outcome, r.Votes)
+	if cb := cm.config.OnElection; cb != nil {
+		go cb(r)
+	}
+}
+
+// 拒绝投票的原因，只用于调试日志与 Metrics.VoteRejections，不在 RPC 中传输
+type VoteRejection int
+
+const (
+	VoteRejectedStaleTerm     VoteRejection = iota // 请求者的任期小于当前任期（预投票时不大于当前任期）
+	VoteRejectedAlreadyVoted                       // 当前任期已经投给了其它节点
+	VoteRejectedStaleLog                           // 请求者的日志不如自己的新
+	VoteRejectedLeaderLease                        // 仍在 leader 的租约内，见 inLeaderLease
+	VoteRejectedTermGap                            // 请求者的任期跳跃过大，见 Config.MaxTermGap
+	VoteRejectedPersistFailed                      // 无法持久化任期与投票，包括已经降级的节点
+	VoteRejectedStrategy                           // 被 Config.ElectionStrategy 拒绝
+)
+
+func (r VoteRejection) String() string {
+	switch r {
+	case VoteRejectedStaleTerm:
+		return "StaleTerm"
+	case VoteRejectedAlreadyVoted:
+		return "AlreadyVoted"
+	case VoteRejectedStaleLog:
+		return "StaleLog"
+	case VoteRejectedLeaderLease:
+		return "LeaderLease"
+	case VoteRejectedTermGap:
+		return "TermGap"
+	case VoteRejectedPersistFailed:
+		return "PersistFailed"
+	case VoteRejectedStrategy:
+		return "Strategy"
+	default:
+		return "unknown"
+	}
+}
+
+// 记录一次拒绝投票及其原因，需在持有锁的情况下调用
+func (cm *ConsensusModule) rejectVote(args RequestVoteArgs, reason VoteRejection) {
+	cm.voteRejections[reason]++
+	cm.logf(LogElection, LevelDebug, "... rejecting vote for %d in term %d (pre-vote=%v): %v", args.CandidateId, args.Term, args.PreVote, reason)
+}
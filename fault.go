@@ -0,0 +1,141 @@
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var errFaultDropped = errors.New("raft: RPC dropped by fault injection")
+
+// 故障注入传输层，供测试使用
+// 一个 FaultTransport 描述整个集群的故障规则，通过 Wrap 包装每个节点的真实传输层，
+// 运行时可以随时修改规则，模拟网络分区、延迟、丢包、重复与乱序
+type FaultTransport struct {
+	mu        sync.Mutex
+	partition map[int]int // 节点 id -> 分区编号，不同分区的节点之间无法通信
+	links     map[[2]int]faultLink
+	rand      *rand.Rand // 丢弃、乱序与重复的随机源，受 mu 保护
+}
+
+// 一条单向链路上的故障规则
+type faultLink struct {
+	latency   time.Duration // 固定延迟
+	reorder   time.Duration // 额外的随机延迟上限，使并发的 RPC 乱序到达
+	drop      float64       // 丢弃概率
+	duplicate float64       // 重复发送概率
+}
+
+// 以当前时间播种随机源，需要复现时使用 NewFaultTransportWithSeed
+func NewFaultTransport() *FaultTransport {
+	return NewFaultTransportWithSeed(time.Now().UnixNano())
+}
+
+// 以 seed 播种丢弃、乱序与重复的随机源，同样的规则与 RPC 顺序下做出同样的故障决定，便于复现问题
+func NewFaultTransportWithSeed(seed int64) *FaultTransport {
+	return &FaultTransport{
+		partition: make(map[int]int),
+		links:     make(map[[2]int]faultLink),
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// 包装节点 id 的传输层，签名与 Config.WrapTransport 一致
+func (ft *FaultTransport) Wrap(id int, t Transport) Transport {
+	return &faultPeerTransport{ft: ft, from: id, inner: t}
+}
+
+// 将集群划分为若干分区，不同分区之间的 RPC 全部失败，未列出的节点不受影响
+func (ft *FaultTransport) Partition(groups ...[]int) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.partition = make(map[int]int)
+	for i, group := range groups {
+		for _, id := range group {
+			ft.partition[id] = i
+		}
+	}
+}
+
+// 清除分区以及所有链路上的故障规则
+func (ft *FaultTransport) Heal() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.partition = make(map[int]int)
+	ft.links = make(map[[2]int]faultLink)
+}
+
+// 设置 from 到 to 的固定延迟
+func (ft *FaultTransport) SetLatency(from, to int, d time.Duration) {
+	ft.updateLink(from, to, func(l *faultLink) { l.latency = d })
+}
+
+// 设置 from 到 to 的随机额外延迟上限，使 RPC 乱序
+func (ft *FaultTransport) SetReorder(from, to int, max time.Duration) {
+	ft.updateLink(from, to, func(l *faultLink) { l.reorder = max })
+}
+
+// 设置 from 到 to 的丢弃概率
+func (ft *FaultTransport) DropRate(from, to int, p float64) {
+	ft.updateLink(from, to, func(l *faultLink) { l.drop = p })
+}
+
+// 设置 from 到 to 的重复发送概率
+func (ft *FaultTransport) DuplicateRate(from, to int, p float64) {
+	ft.updateLink(from, to, func(l *faultLink) { l.duplicate = p })
+}
+
+func (ft *FaultTransport) updateLink(from, to int, update func(l *faultLink)) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	l := ft.links[[2]int{from, to}]
+	update(&l)
+	ft.links[[2]int{from, to}] = l
+}
+
+// 按 from 到 to 的规则决定一次 RPC 的命运：是否丢弃（包括被分区隔开）、延迟多久、是否重复发送
+func (ft *FaultTransport) decide(from, to int) (drop bool, delay time.Duration, duplicate bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	fromGroup, fromOk := ft.partition[from]
+	toGroup, toOk := ft.partition[to]
+	l := ft.links[[2]int{from, to}]
+	if (fromOk && toOk && fromGroup != toGroup) || (l.drop > 0 && ft.rand.Float64() < l.drop) {
+		return true, 0, false
+	}
+	delay = l.latency
+	if l.reorder > 0 {
+		delay += time.Duration(ft.rand.Int63n(int64(l.reorder)))
+	}
+	return false, delay, l.duplicate > 0 && ft.rand.Float64() < l.duplicate
+}
+
+// 单个节点的故障注入传输层
+type faultPeerTransport struct {
+	ft    *FaultTransport
+	from  int
+	inner Transport
+}
+
+func (t *faultPeerTransport) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+	drop, delay, duplicate := t.ft.decide(t.from, id)
+	if drop {
+		return errFaultDropped
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	err := t.inner.Call(id, serviceMethod, args, reply)
+	if duplicate {
+		// 重复的请求同样送达对端，但它的回复被丢弃
+		dup := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+		t.inner.Call(id, serviceMethod, args, dup)
+	}
+	return err
+}
+
+func (t *faultPeerTransport) PeerConnStatus(id int) PeerConn {
+	return t.inner.PeerConnStatus(id)
+}
@@ -0,0 +1,50 @@
+package raft
+
+// 转发的 Submit 最多经过的跳数，leader 频繁更替时避免在节点之间来回转发
+const maxForwardHops = 2
+
+type ForwardSubmitArgs struct {
+	Command interface{} // 客户端命令
+	Hops    int         // 已经转发的次数
+	GroupID int         // 所属的 Raft 组，见 Config.GroupID
+}
+
+type ForwardSubmitReply struct {
+	Ok bool // leader 是否已追加，与 Submit 的返回值含义相同
+}
+
+// 处理 follower 转发的 Submit，见 Config.ForwardSubmit
+// Config.PreAppendHook 只在最初收到 Submit 的节点上调用，这里不再调用
+func (cm *ConsensusModule) ForwardSubmit(args ForwardSubmitArgs, reply *ForwardSubmitReply) error {
+	cm.mu.Lock()
+	if cm.state == Dead {
+		cm.mu.Unlock()
+		return nil
+	}
+	cm.logf(LogProposal, LevelDebug, "ForwardSubmit: %+v", args)
+	cm.mu.Unlock()
+	reply.Ok = cm.submit(args.Command, args.Hops)
+	return nil
+}
+
+// 把 command 转发给 leader 并返回它的结果，不能在持有锁的情况下调用
+// 等待超过 Config.ForwardTimeout 时返回 false，此时 command 仍可能已被追加
+func (cm *ConsensusModule) forwardSubmit(leaderId int, command interface{}, hops int) bool {
+	cm.logf(LogProposal, LevelDebug, "forwarding %v to leader %d (hops=%d)", command, leaderId, hops)
+	args := ForwardSubmitArgs{Command: command, Hops: hops + 1, GroupID: cm.config.GroupID}
+	done := make(chan bool, 1)
+	go func() {
+		var reply ForwardSubmitReply
+		err := cm.server.Call(leaderId, "ConsensusModule.ForwardSubmit", args, &reply)
+		done <- err == nil && reply.Ok
+	}()
+	timer := cm.config.Clock.NewTimer(cm.config.ForwardTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-done:
+		return ok
+	case <-timer.C():
+		cm.logf(LogProposal, LevelDebug, "forwarding %v to leader %d timed out", command, leaderId)
+		return false
+	}
+}
@@ -0,0 +1,60 @@
+package raft
+
+import "time"
+
+// 一批等待持久化的追加，见 Config.PersistBatchInterval
+type persistBatch struct {
+	done chan struct{} // 持久化完成（或失败）时关闭
+	err  error         // 持久化的结果，done 关闭之后才能读取
+}
+
+// 批量持久化的间隔，0 表示每次追加都同步持久化，见 Config.PersistBatchInterval
+func (cm *ConsensusModule) PersistBatchInterval() time.Duration {
+	return cm.config.PersistBatchInterval
+}
+
+// 把刚追加的日志加入当前批次，返回该批次，需在持有锁的情况下调用
+// 没有批次时新建一个，并在 Config.PersistBatchInterval 之后持久化
+func (cm *ConsensusModule) joinPersistBatch() *persistBatch {
+	if b := cm.persistBatch; b != nil {
+		return b
+	}
+	b := &persistBatch{done: make(chan struct{})}
+	cm.persistBatch = b
+	timer := cm.config.Clock.NewTimer(cm.config.PersistBatchInterval)
+	go func() {
+		<-timer.C()
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		if cm.persistBatch != b {
+			return // 已经随其它持久化一起完成
+		}
+		if err := cm.persistToStorage(); err != nil {
+			return // 降级时已经结束批次
+		}
+		// leader 自己的一票现在可以计入，follower 可能已经先确认了这些日志
+		if cm.state == Leader && cm.advanceCommitIndex() {
+			cm.signalCommit()
+			cm.triggerAE()
+		}
+	}()
+	return b
+}
+
+// 以 err 结束当前批次，唤醒等待的提交者，需在持有锁的情况下调用
+func (cm *ConsensusModule) finishPersistBatch(err error) {
+	if b := cm.persistBatch; b != nil {
+		cm.persistBatch = nil
+		b.err = err
+		close(b.done)
+	}
+}
+
+// 等待批次持久化完成，b 为 nil（没有开启批量持久化）时直接返回，不能在持有锁的情况下调用
+func (b *persistBatch) wait() error {
+	if b == nil {
+		return nil
+	}
+	<-b.done
+	return b.err
+}
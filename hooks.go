@@ -0,0 +1,17 @@
+package raft
+
+// 测试钩子，在特定的位置暂停模块或注入故障（睡眠、崩溃、屏障），用于确定性地测试微妙的时序问题
+// 只在测试中、模块开始处理请求之前设置；为 nil 时什么也不做，生产环境中从不设置
+type testHooks struct {
+	beforePersist            func() // persistToStorage 编码之后、写入 storage 之前，持有锁
+	afterAppendBeforeTrigger func() // Submit 等追加日志并释放锁之后、通知发送 AE 之前，不持有锁
+	beforeVoteReply          func() // RequestVote 填好回复、返回之前（停止的节点除外），持有锁
+	beforeAppendEntriesReply func() // AppendEntries 填好回复、返回之前（停止的节点除外），持有锁
+}
+
+// 调用设置了的钩子
+func callHook(hook func()) {
+	if hook != nil {
+		hook()
+	}
+}
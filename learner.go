@@ -0,0 +1,40 @@
+package raft
+
+// 节点 id 是否是学习者
+func (cm *ConsensusModule) isLearner(id int) bool {
+	for _, learnerId := range cm.config.Learners {
+		if learnerId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 参与投票的 peer，即除去学习者之外的 peer
+func (cm *ConsensusModule) voters() []int {
+	voters := make([]int, 0, len(cm.peerIds))
+	for _, peerId := range cm.peerIds {
+		if !cm.isLearner(peerId) {
+			voters = append(voters, peerId)
+		}
+	}
+	return voters
+}
+
+// 是否可以提供读服务
+// 学习者在追上 leader 之前（落后超过 Config.LearnerCatchUpThreshold 条已提交日志，或者最近
+// 没有收到过 leader 的请求）返回 false，以免客户端从一个冷节点读到过旧的数据；其它节点只要没有停止就返回 true
+func (cm *ConsensusModule) CanServeReads() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return false
+	}
+	if !cm.isLearner(cm.id) {
+		return true
+	}
+	if cm.leaderId < 0 || cm.config.Clock.Now().Sub(cm.lastLeaderContact) >= electionTimeoutMin+electionTimeoutRange {
+		return false
+	}
+	return cm.leaderCommit-cm.lastApplied <= cm.config.LearnerCatchUpThreshold
+}
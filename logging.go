@@ -0,0 +1,52 @@
+package raft
+
+import (
+	"fmt"
+	"log"
+)
+
+// 调试日志的级别，见 Config.LogLevels
+type Level int
+
+const (
+	LevelDebug Level = iota // 输出所有调试日志，默认
+	LevelInfo               // 只输出角色变化、快照安装等重要事件
+	LevelWarn               // 只输出警告，例如日志分歧、持久化失败
+	LevelOff                // 不输出任何日志
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "Debug"
+	case LevelInfo:
+		return "Info"
+	case LevelWarn:
+		return "Warn"
+	case LevelOff:
+		return "Off"
+	default:
+		return "unknown"
+	}
+}
+
+// 调试日志的子系统，作为 Config.LogLevels 的键
+const (
+	LogElection    = "election"    // 选举、预投票、投票与角色变化
+	LogReplication = "replication" // AppendEntries 与快照的发送和处理
+	LogPersistence = "persistence" // 持久化、快照压缩与安装
+	LogRPC         = "rpc"         // RPC 的故障注入与任期检查
+	LogProposal    = "proposal"    // 客户端提交、转发与准入控制
+	LogApply       = "apply"       // 提交的日志交付给客户端
+	LogMembership  = "membership"  // 集群成员与成员变更
+)
+
+// 输出 subsystem 子系统 level 级别的日志，低于 Config.LogLevels 中该子系统的级别时不输出
+// 没有配置的子系统输出所有级别；低于 LevelWarn 的调试日志只在 DebugCM 大于 0 时输出
+func (cm *ConsensusModule) logf(subsystem string, level Level, format string, args ...interface{}) {
+	if level < cm.config.LogLevels[subsystem] || (DebugCM <= 0 && level < LevelWarn) {
+		return
+	}
+	format = fmt.Sprintf("[%d] ", cm.id) + format
+	log.Printf(format, args...)
+}
@@ -0,0 +1,186 @@
+package raft
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sort"
+)
+
+// 集群配置日志项（EntryConfig）的内容
+type ClusterConfig struct {
+	Voters   []int // 投票成员（不包括学习者），按 id 排序
+	Learners []int // 学习者，按 id 排序
+}
+
+// 成员变更事件的类型，见 Config.OnMembershipChange
+type MembershipEventType int
+
+const (
+	ServerAdded     MembershipEventType = iota // 新的投票成员
+	ServerRemoved                              // 投票成员或学习者被移出集群
+	LearnerAdded                               // 新的学习者
+	LearnerPromoted                            // 学习者成为投票成员
+)
+
+func (t MembershipEventType) String() string {
+	switch t {
+	case ServerAdded:
+		return "ServerAdded"
+	case ServerRemoved:
+		return "ServerRemoved"
+	case LearnerAdded:
+		return "LearnerAdded"
+	case LearnerPromoted:
+		return "LearnerPromoted"
+	default:
+		panic("unreachable")
+	}
+}
+
+// 成员变更事件，在配置日志项被应用时产生，而不是在提议时
+type MembershipEvent struct {
+	Type  MembershipEventType
+	Id    int // 变更的节点 id
+	Index int // 配置日志项的序号
+}
+
+func init() {
+	// 配置日志项通过 RPC 复制，Command 的具体类型需要注册
+	gob.Register(ClusterConfig{})
+}
+
+// 用初始配置引导一个新集群
+// 在没有任何状态的节点上以任期 0 追加一条配置日志项，之后选出的 leader 会把它复制给其它节点，
+// 与该 leader 任期内的第一条日志一起提交。只应该在一个节点上调用，其它节点不调用，直接加入集群即可，
+// 所有节点都应开启 Config.RequireBootstrap，保证当选的是引导的节点。
+// 目前集群成员仍是静态的，initialPeers 必须与 peerIds（除去学习者）加上自己一致；
+// 节点已经有状态（任期、日志或快照）时返回错误
+func (cm *ConsensusModule) Bootstrap(initialPeers []int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return ErrStopped
+	}
+	if cm.currentTerm > 0 || cm.logEnd() > 0 || cm.snapshotIndex >= 0 {
+		return ErrBootstrapped
+	}
+	voters := append([]int(nil), initialPeers...)
+	sort.Ints(voters)
+	if want := cm.staticConfiguration(); fmt.Sprint(voters) != fmt.Sprint(want) {
+		return fmt.Errorf("raft: bootstrap configuration %v does not match voters %v", voters, want)
+	}
+
+	// 不改变任期，选举计时器不受影响；有这条日志的节点比其它新节点的日志更新
+	learners := append([]int(nil), cm.config.Learners...)
+	sort.Ints(learners)
+	cm.log = append(cm.log, LogEntry{Command: ClusterConfig{Voters: voters, Learners: learners}, Term: 0, Type: EntryConfig})
+	cm.logDirty = true
+	if err := cm.persistToStorage(); err != nil {
+		cm.log = cm.log[:len(cm.log)-1]
+		return err
+	}
+	cm.logf(LogMembership, LevelInfo, "bootstrapped with configuration %v", voters)
+	return nil
+}
+
+// 日志中是否有还没提交的配置日志项，需在持有锁的情况下调用
+func (cm *ConsensusModule) hasUncommittedConfig() bool {
+	for index := intMax(cm.commitIndex+1, cm.logBase+1); index < cm.logEnd(); index++ {
+		if cm.log[cm.logPos(index)].Type == EntryConfig {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否在等待引导，见 Config.RequireBootstrap，需在持有锁的情况下调用
+func (cm *ConsensusModule) awaitingBootstrap() bool {
+	return cm.config.RequireBootstrap && cm.logEnd() == 0
+}
+
+// 日志项 Command 的编解码器
+// 配置日志项是 Raft 内部的，客户端的 Codec 不认识它，始终使用 gob
+func (cm *ConsensusModule) commandCodec(t EntryType) Codec {
+	if t == EntryConfig {
+		return GobCodec{}
+	}
+	return cm.config.Codec
+}
+
+// 当前的投票成员（包括自己，不包括学习者），按 id 排序
+// 有已提交的配置日志项时返回其中最新的一个，否则与 peerIds 和 Config.Learners 一致
+func (cm *ConsensusModule) Configuration() []int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.configuration != nil {
+		return append([]int(nil), cm.configuration...)
+	}
+	return cm.staticConfiguration()
+}
+
+// 正在进行中的成员变更（联合配置）的新成员，没有变更时第二个返回值为 false
+// 目前不支持动态成员变更，总是返回 nil, false
+func (cm *ConsensusModule) PendingConfiguration() ([]int, bool) {
+	return nil, false
+}
+
+// 启动时配置的投票成员，包括自己，按 id 排序
+func (cm *ConsensusModule) staticConfiguration() []int {
+	members := append(cm.voters(), cm.id)
+	sort.Ints(members)
+	return members
+}
+
+// 应用已提交的配置日志项，返回与之前的配置相比的成员变更事件，需在持有锁的情况下调用
+// 之前没有提交过配置日志项时与启动时的配置（peerIds 与 Config.Learners）比较
+func (cm *ConsensusModule) applyConfiguration(config ClusterConfig, index int) []MembershipEvent {
+	oldVoters, oldLearners := cm.staticConfiguration(), cm.config.Learners
+	if cm.configuration != nil {
+		oldVoters, oldLearners = cm.configuration, cm.configLearners
+	}
+	cm.configuration = config.Voters
+	cm.configLearners = config.Learners
+
+	wasVoter, wasLearner := idSet(oldVoters), idSet(oldLearners)
+	isMember := idSet(append(append([]int(nil), config.Voters...), config.Learners...))
+	var events []MembershipEvent
+	for _, id := range config.Voters {
+		if wasLearner[id] {
+			events = append(events, MembershipEvent{Type: LearnerPromoted, Id: id, Index: index})
+		} else if !wasVoter[id] {
+			events = append(events, MembershipEvent{Type: ServerAdded, Id: id, Index: index})
+		}
+	}
+	for _, id := range config.Learners {
+		if !wasVoter[id] && !wasLearner[id] {
+			events = append(events, MembershipEvent{Type: LearnerAdded, Id: id, Index: index})
+		}
+	}
+	for _, old := range [][]int{oldVoters, oldLearners} {
+		for _, id := range old {
+			if !isMember[id] {
+				events = append(events, MembershipEvent{Type: ServerRemoved, Id: id, Index: index})
+			}
+		}
+	}
+	return events
+}
+
+// 按顺序调用 Config.OnMembershipChange，在 commitLoop 中调用，不能持有锁
+func (cm *ConsensusModule) reportMembership(events []MembershipEvent) {
+	for _, e := range events {
+		cm.logf(LogMembership, LevelInfo, "membership change at index %d: %v %d", e.Index, e.Type, e.Id)
+		if cb := cm.config.OnMembershipChange; cb != nil {
+			cb(e)
+		}
+	}
+}
+
+// 节点 id 的集合
+func idSet(ids []int) map[int]bool {
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
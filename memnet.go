@@ -0,0 +1,115 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var errMemDisconnected = errors.New("raft: peer unreachable on the in-memory network")
+
+// 进程内的传输层网络，供测试使用，不需要监听端口
+// 每个节点通过 Transport(id) 获得自己的传输层，创建共识模块之后用 Add 加入网络、Connect 连通；RPC 直接调用对端共识模块的同名方法，
+// 参数与回复经过 gob 编解码，与真实的 RPC 一样不共享内存。断开的节点收发的 RPC 都会失败。只支持单个 Raft 组
+type MemNetwork struct {
+	mu        sync.Mutex
+	nodes     map[int]*ConsensusModule
+	connected map[int]bool
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		nodes:     make(map[int]*ConsensusModule),
+		connected: make(map[int]bool),
+	}
+}
+
+// 节点 id 的传输层，用于 NewConsensusModule
+func (mn *MemNetwork) Transport(id int) Transport {
+	return &memTransport{mn: mn, from: id}
+}
+
+// 把节点 id 的共识模块加入网络，替换之前的共识模块（例如重启之后），加入后处于断开状态
+func (mn *MemNetwork) Add(id int, cm *ConsensusModule) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.nodes[id] = cm
+	mn.connected[id] = false
+}
+
+// 断开节点 id，它收发的 RPC 都会失败，正在处理的 RPC 的回复也会丢失
+func (mn *MemNetwork) Disconnect(id int) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.connected[id] = false
+}
+
+// 连通节点 id，它可以与其它连通的节点互相调用
+func (mn *MemNetwork) Connect(id int) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	if _, ok := mn.nodes[id]; ok {
+		mn.connected[id] = true
+	}
+}
+
+// 查找 from 发往 to 的 RPC 的目标共识模块，二者之一断开时返回错误
+func (mn *MemNetwork) route(from, to int) (*ConsensusModule, error) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	cm, ok := mn.nodes[to]
+	if !ok || !mn.connected[from] || !mn.connected[to] {
+		return nil, errMemDisconnected
+	}
+	return cm, nil
+}
+
+// 单个节点在 MemNetwork 上的传输层
+type memTransport struct {
+	mn   *MemNetwork
+	from int
+}
+
+func (t *memTransport) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+	cm, err := t.mn.route(t.from, id)
+	if err != nil {
+		return err
+	}
+	method := reflect.ValueOf(cm).MethodByName(strings.TrimPrefix(serviceMethod, "ConsensusModule."))
+	if !method.IsValid() {
+		return fmt.Errorf("raft: unknown method %s", serviceMethod)
+	}
+	in := reflect.New(method.Type().In(0))
+	if err := gobCopy(in.Interface(), args); err != nil {
+		return err
+	}
+	out := reflect.New(method.Type().In(1).Elem())
+	if errv := method.Call([]reflect.Value{in.Elem(), out})[0]; !errv.IsNil() {
+		return errv.Interface().(error)
+	}
+	// 处理期间被断开，回复同样丢失
+	if _, err := t.mn.route(t.from, id); err != nil {
+		return err
+	}
+	return gobCopy(reply, out.Interface())
+}
+
+func (t *memTransport) PeerConnStatus(id int) PeerConn {
+	if _, err := t.mn.route(t.from, id); err != nil {
+		return PeerConn{State: ConnDisconnected}
+	}
+	return PeerConn{State: ConnConnected}
+}
+
+// 经过 gob 编解码把 src 复制到 dst，dst 为指针
+func gobCopy(dst, src interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+		return err
+	}
+	return gob.NewDecoder(&buf).Decode(dst)
+}
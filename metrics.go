@@ -0,0 +1,246 @@
+package raft
+
+import "time"
+
+// 运行指标，用于调试与观测
+type Metrics struct {
+	Backoff map[int]BackoffState // 每个 peer 的重试退避状态，仅 Leader 有效
+
+	DuplicateLeaderDetected int // 作为 leader 收到同任期其它 leader 请求的次数，非 0 说明集群配置有误
+
+	LogDivergences int // 检测到与 leader 日志分歧的次数，见 Config.DetectLogDivergence
+
+	RejectedTerms int // 因任期跳跃过大而忽略的请求与回复数，见 Config.MaxTermGap
+
+	VoteRejections map[VoteRejection]int // 按原因统计的拒绝投票次数（包括预投票），选不出 leader 时可据此排查
+
+	ApplyLag int // 已提交但还未交给客户端的日志条数，见 ApplyLag
+
+	ApplyBufferLen    int // ApplyBuffer 策略下缓冲中等待客户端读取的条数
+	ApplyBufferFull   int // ApplyBuffer 策略下交付时缓冲已满、commitLoop 只能阻塞等待的次数，持续增长说明缓冲偏小
+	ApplyBufferMaxLen int // ApplyBuffer 策略下缓冲中出现过的最多条数，可据此调整 Config.ApplyBufferSize
+	DroppedCommits    int // ApplyDrop 策略下因客户端读取不及时而丢弃的提交数
+
+	RPCLatency     map[string]LatencyStats         // 每种 RPC（RequestVote、AppendEntries）所有 peer 合计的延迟
+	PeerRPCLatency map[int]map[string]LatencyStats // 每个 peer 每种 RPC 的延迟，与合计对比可以区分网络慢还是某个 peer 慢
+}
+
+// RPC 延迟统计，只统计收到了回复的调用，从发送前到收到回复为止
+type LatencyStats struct {
+	Count int           // 调用次数
+	Sum   time.Duration // 总延迟
+	Min   time.Duration // 最小延迟
+	Max   time.Duration // 最大延迟
+}
+
+// 平均延迟，没有调用时为 0
+func (s LatencyStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+func (s LatencyStats) add(d time.Duration) LatencyStats {
+	if s.Count == 0 || d < s.Min {
+		s.Min = d
+	}
+	if d > s.Max {
+		s.Max = d
+	}
+	s.Count++
+	s.Sum += d
+	return s
+}
+
+// 合并两份统计
+func (s LatencyStats) merge(o LatencyStats) LatencyStats {
+	if o.Count == 0 {
+		return s
+	}
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Count += o.Count
+	s.Sum += o.Sum
+	return s
+}
+
+// 记录一次 RPC 的延迟，需在持有锁的情况下调用
+func (cm *ConsensusModule) recordLatency(peerId int, method string, d time.Duration) {
+	if cm.rpcLatency[peerId] == nil {
+		cm.rpcLatency[peerId] = make(map[string]LatencyStats)
+	}
+	cm.rpcLatency[peerId][method] = cm.rpcLatency[peerId][method].add(d)
+}
+
+// peer 的重试退避状态
+type BackoffState struct {
+	ConsecutiveFailures int       // 连续失败次数
+	RetryAt             time.Time // 下次允许发送的时间，零值表示未在退避中
+}
+
+// 获取当前的运行指标快照
+func (cm *ConsensusModule) Metrics() Metrics {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	m := Metrics{
+		Backoff:                 make(map[int]BackoffState),
+		DuplicateLeaderDetected: cm.duplicateLeaders,
+		RejectedTerms:           cm.rejectedTerms,
+		VoteRejections:          make(map[VoteRejection]int),
+		LogDivergences:          cm.logDivergences,
+		ApplyLag:                cm.applyLag(),
+		ApplyBufferLen:          len(cm.applyBuf),
+		ApplyBufferFull:         cm.applyBufferFull,
+		ApplyBufferMaxLen:       cm.applyBufferMaxLen,
+		DroppedCommits:          cm.droppedCommits,
+		RPCLatency:              make(map[string]LatencyStats),
+		PeerRPCLatency:          make(map[int]map[string]LatencyStats),
+	}
+	for reason, n := range cm.voteRejections {
+		m.VoteRejections[reason] = n
+	}
+	for _, peerId := range cm.peerIds {
+		m.Backoff[peerId] = BackoffState{
+			ConsecutiveFailures: cm.peerFailures[peerId],
+			RetryAt:             cm.peerRetryAt[peerId],
+		}
+	}
+	for peerId, byMethod := range cm.rpcLatency {
+		m.PeerRPCLatency[peerId] = make(map[string]LatencyStats)
+		for method, s := range byMethod {
+			m.PeerRPCLatency[peerId][method] = s
+			m.RPCLatency[method] = m.RPCLatency[method].merge(s)
+		}
+	}
+	return m
+}
+
+// 已提交但还未交给客户端（写入 commitChan）的日志条数
+// 持续增长说明状态机应用太慢，或者没有人在消费 commitChan
+func (cm *ConsensusModule) ApplyLag() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.applyLag()
+}
+
+// 需在持有锁的情况下调用
+func (cm *ConsensusModule) applyLag() int {
+	return cm.commitIndex - cm.deliveredIndex
+}
+
+// leader 最后一次收到 peer 的 AppendEntries 或 InstallSnapshot 回复的时间，仅 Leader 有效，
+// 其它状态或从未收到过回复时返回零值。调用者可以按自己的阈值据此判断 peer 是否已经宕机
+func (cm *ConsensusModule) LastContact(peerId int) time.Time {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Leader {
+		return time.Time{}
+	}
+	return cm.peerLastContact[peerId]
+}
+
+// 本节点成为 leader 的时间，不是 Leader 时返回零值。与当前时间相减即是领导权持续的时长
+func (cm *ConsensusModule) LeaderSince() time.Time {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Leader {
+		return time.Time{}
+	}
+	return cm.leaderSince
+}
+
+// 本节点进入当前任期的时间，任何状态都有效；从存储恢复的任期从节点启动时算起
+// 任期频繁变化（距今很短）说明集群领导权不稳定
+func (cm *ConsensusModule) TermStart() time.Time {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.termStart
+}
+
+// peer 的日志复制状态
+type PeerStatus struct {
+	NextIndex   int       // 下一个要发送的日志序号
+	MatchIndex  int       // 已匹配的日志序号
+	LastContact time.Time // 最后一次 AppendEntries 成功的时间
+	Reachable   bool      // 最近一次 AppendEntries 是否成功
+	Lag         int       // 落后于 Leader 最后一条日志的条数
+	Conn        PeerConn  // 传输层的连接状况
+	Paused      bool      // 是否暂停了复制，见 PauseReplication
+
+	Reachability Reachability // Ping 探测得出的可达状况，见 Config.PingInterval
+}
+
+// 获取每个 peer 的日志复制状态，仅 Leader 有效，其它状态返回 nil
+func (cm *ConsensusModule) ReplicationStatus() map[int]PeerStatus {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Leader {
+		return nil
+	}
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	status := make(map[int]PeerStatus)
+	for _, peerId := range cm.peerIds {
+		lastContact := cm.peerLastContact[peerId]
+		status[peerId] = PeerStatus{
+			NextIndex:   cm.nextIndex[peerId],
+			MatchIndex:  cm.matchIndex[peerId],
+			LastContact: lastContact,
+			Reachable:   !lastContact.IsZero() && cm.peerFailures[peerId] == 0,
+			Lag:         lastLogIndex - cm.matchIndex[peerId],
+			Conn:        cm.server.PeerConnStatus(peerId),
+			Paused:      cm.paused[peerId],
+
+			Reachability: cm.reachability[peerId],
+		}
+	}
+	return status
+}
+
+// 所有投票成员中最小的 matchIndex，仅 Leader 有效，其它状态返回 -1
+// 这个序号及之前的日志已经复制到了每一个投票成员，压缩到这里不会让任何 follower 只能通过快照追赶；
+// 有投票成员还没有匹配任何日志时返回 -1。学习者不计入，没有其它投票成员时返回 leader 最后一个日志序号
+func (cm *ConsensusModule) MinMatchIndex() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Leader {
+		return -1
+	}
+	min, _ := cm.lastLogIndexAndTerm()
+	for _, peerId := range cm.voters() {
+		min = intMin(min, cm.matchIndex[peerId])
+	}
+	return min
+}
+
+// 存活检查，节点未停止、没有因持久化失败而降级，且 commitLoop 与选举计时仍在运行时返回 true，可用于存活探针
+func (cm *ConsensusModule) Healthy() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead || cm.degraded {
+		return false
+	}
+	select {
+	case <-cm.commitLoopDone:
+		return false
+	case <-cm.electionTimerDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// 就绪检查，节点知道当前 leader（或自己就是 leader），并且已应用到 commitIndex 时返回 true，
+// 可用于就绪探针
+func (cm *ConsensusModule) Ready() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead || cm.leaderId < 0 {
+		return false
+	}
+	return cm.lastApplied >= cm.commitIndex
+}
@@ -0,0 +1,45 @@
+package raft
+
+import (
+	"errors"
+	"time"
+)
+
+// 暂停之后剩下的投票成员无法组成提交多数派，见 PauseReplication
+var ErrPauseBreaksQuorum = errors.New("raft: pausing this peer would leave too few voters to commit")
+
+// 暂停向 peer 复制日志，leader 不再向它发送 AppendEntries 与快照，但它仍是集群成员
+// 适用于已知某个节点要停机维护的情况，避免 leader 反复对它重试、回退 nextIndex。
+// 暂停的 peer 不参与之后的提交，为了不让暂停阻塞提交，剩下的投票成员（包括 leader 自己）
+// 无法组成提交多数派时拒绝暂停，返回 ErrPauseBreaksQuorum；学习者不投票，总是可以暂停。
+// 暂停之前它已经确认的日志仍然计入多数派。暂停只对当前节点有效，领导权转移后需要在新 leader 上重新暂停
+func (cm *ConsensusModule) PauseReplication(peerId int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if !cm.paused[peerId] && !cm.isLearner(peerId) {
+		active := 1
+		for _, id := range cm.voters() {
+			if id != peerId && !cm.paused[id] {
+				active++
+			}
+		}
+		if active < cm.replicationQuorum() {
+			cm.logf(LogReplication, LevelInfo, "refusing to pause replication to %d: %d active voters, quorum is %d", peerId, active, cm.replicationQuorum())
+			return ErrPauseBreaksQuorum
+		}
+	}
+	cm.logf(LogReplication, LevelInfo, "pausing replication to %d", peerId)
+	cm.paused[peerId] = true
+	return nil
+}
+
+// 恢复向 peer 复制日志，并立即发送一次 AppendEntries
+func (cm *ConsensusModule) ResumeReplication(peerId int) {
+	cm.mu.Lock()
+	cm.logf(LogReplication, LevelInfo, "resuming replication to %d", peerId)
+	delete(cm.paused, peerId)
+	cm.peerFailures[peerId] = 0
+	cm.peerRetryAt[peerId] = time.Time{}
+	cm.mu.Unlock()
+	cm.triggerAE()
+}
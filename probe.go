@@ -0,0 +1,142 @@
+package raft
+
+// peer 的可达状况，由 Ping 探测得出，见 Config.PingInterval
+type Reachability int
+
+const (
+	PeerReachable   Reachability = iota // 最近一次 Ping 成功，或还没有探测过
+	PeerSuspect                         // 连续失败 Config.PingSuspectAfter 次
+	PeerUnreachable                     // 连续失败 Config.PingUnreachableAfter 次
+)
+
+func (r Reachability) String() string {
+	switch r {
+	case PeerReachable:
+		return "Reachable"
+	case PeerSuspect:
+		return "Suspect"
+	case PeerUnreachable:
+		return "Unreachable"
+	default:
+		panic("unreachable")
+	}
+}
+
+// 探测请求，只用于判断 peer 是否可达，不携带也不改变任期
+type PingArgs struct {
+	From    int // 发送者 id
+	GroupID int // 所属的 Raft 组，见 Config.GroupID
+}
+
+type PingReply struct {
+	Term int // 回复者任期，仅供参考
+}
+
+// 处理探测请求
+func (cm *ConsensusModule) Ping(args PingArgs, reply *PingReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return ErrStopped
+	}
+	reply.Term = cm.currentTerm
+	return nil
+}
+
+// peer 当前的可达状况，没有开启探测时总是 PeerReachable
+func (cm *ConsensusModule) PeerReachability(peerId int) Reachability {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.reachability[peerId]
+}
+
+// 每隔 Config.PingInterval 探测一次所有 peer，节点停止时退出
+// 同一个 peer 上一次探测还没有结束时跳过，不会堆积请求
+func (cm *ConsensusModule) runProbes() {
+	ticker := cm.config.Clock.NewTicker(cm.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C()
+		cm.mu.Lock()
+		if cm.state == Dead {
+			cm.mu.Unlock()
+			return
+		}
+		for _, peerId := range cm.peerIds {
+			if !cm.pinging[peerId] {
+				cm.pinging[peerId] = true
+				go cm.ping(peerId)
+			}
+		}
+		cm.mu.Unlock()
+	}
+}
+
+// 向 peer 发送一次 Ping，超过 Config.PingTimeout 没有回复算作失败
+func (cm *ConsensusModule) ping(peerId int) {
+	done := make(chan bool, 1)
+	go func() {
+		args := PingArgs{From: cm.id, GroupID: cm.config.GroupID}
+		var reply PingReply
+		done <- cm.server.Call(peerId, "ConsensusModule.Ping", args, &reply) == nil
+	}()
+	timer := cm.config.Clock.NewTimer(cm.config.PingTimeout)
+	defer timer.Stop()
+	var ok bool
+	select {
+	case ok = <-done:
+	case <-timer.C():
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.pinging[peerId] = false
+	if cm.state == Dead {
+		return
+	}
+	if ok {
+		cm.pingFailures[peerId] = 0
+	} else {
+		cm.pingFailures[peerId]++
+	}
+	cm.setReachability(peerId)
+}
+
+// 根据连续失败次数更新 peer 的可达状况，需在持有锁的情况下调用
+func (cm *ConsensusModule) setReachability(peerId int) {
+	r := PeerReachable
+	switch failures := cm.pingFailures[peerId]; {
+	case failures >= cm.config.PingUnreachableAfter:
+		r = PeerUnreachable
+	case failures >= cm.config.PingSuspectAfter:
+		r = PeerSuspect
+	}
+	if r != cm.reachability[peerId] {
+		cm.logf(LogRPC, LevelInfo, "peer %d is now %s after %d failed pings", peerId, r, cm.pingFailures[peerId])
+		cm.reachability[peerId] = r
+	}
+}
+
+// 领导权转移的目标：日志最新的投票 peer，优先选择没有被探测为不可达的，需在持有锁的情况下调用
+func (cm *ConsensusModule) transferTarget(voters []int) int {
+	target := -1
+	for _, peerId := range voters {
+		if cm.reachability[peerId] == PeerUnreachable {
+			continue
+		}
+		if target < 0 || cm.matchIndex[peerId] > cm.matchIndex[target] {
+			target = peerId
+		}
+	}
+	if target >= 0 {
+		return target
+	}
+	// 都不可达时仍按日志选择，探测结果可能已经过时
+	target = voters[0]
+	for _, peerId := range voters {
+		if cm.matchIndex[peerId] > cm.matchIndex[target] {
+			target = peerId
+		}
+	}
+	return target
+}
@@ -0,0 +1,156 @@
+package raft
+
+import "context"
+
+// 等待提交的提案
+type proposal struct {
+	term int                      // 提案追加时的任期
+	done chan proposalResult      // 提交结果，带一个缓冲，通知方不会阻塞
+	cb   func(CommitEntry, error) // 提交结果回调，设置时不使用 done
+}
+
+type proposalResult struct {
+	entry CommitEntry
+	err   error
+}
+
+// 提交 command 并等待其被提交与应用
+// 如果该序号最终提交的日志任期与提案的任期不同（Leader 已经更替，日志被覆盖），返回 ErrDropped；
+// 如果 ctx 过期，返回 ctx.Err()，此时 command 仍可能在之后被提交；
+// command 无法编码时返回编码错误，超过 Config.MaxCommandBytes 时返回 ErrTooLarge，被 Config.PreAppendHook 拒绝时原样返回它的错误，
+// 未提交的日志数达到 Config.MaxPendingProposals 时返回 ErrTooManyPending
+func (cm *ConsensusModule) ProposeAndWait(ctx context.Context, command interface{}) (CommitEntry, error) {
+	if err := cm.preAppend(command); err != nil {
+		return CommitEntry{}, err
+	}
+	cm.mu.Lock()
+	cm.logf(LogProposal, LevelDebug, "ProposeAndWait received by %v: %v", cm.state, command)
+	if err := cm.admitProposal(); err != nil {
+		cm.mu.Unlock()
+		return CommitEntry{}, err
+	}
+	if cm.state != Leader || cm.refusingProposals() {
+		cm.mu.Unlock()
+		return CommitEntry{}, ErrNotLeader
+	}
+	p := &proposal{done: make(chan proposalResult, 1)}
+	index, ok := cm.propose(command, p)
+	cm.mu.Unlock()
+	if !ok {
+		return CommitEntry{}, ErrNotLeader
+	}
+	callHook(cm.hooks.afterAppendBeforeTrigger)
+	cm.triggerAE() // 需要发送 AE
+
+	select {
+	case r := <-p.done:
+		return r.entry, r.err
+	case <-ctx.Done():
+		cm.mu.Lock()
+		if cm.pending[index] == p {
+			delete(cm.pending, index)
+		}
+		cm.mu.Unlock()
+		return CommitEntry{}, ctx.Err()
+	}
+}
+
+// 提交 command，并在它被提交与应用（或失败）时调用 cb
+// 失败的原因与 ProposeAndWait 相同：ErrDropped 或 ErrStopped；不是 Leader 时直接返回 ErrNotLeader，
+// command 无法编码、超过 Config.MaxCommandBytes、被 Config.PreAppendHook 拒绝或者未提交的日志过多时返回相应的错误，这些情况都不会调用 cb。提交成功的回调在 commitLoop 中按序号顺序调用，回调不应阻塞太久
+func (cm *ConsensusModule) SubmitWithCallback(command interface{}, cb func(CommitEntry, error)) error {
+	if err := cm.preAppend(command); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	cm.logf(LogProposal, LevelDebug, "SubmitWithCallback received by %v: %v", cm.state, command)
+	if err := cm.admitProposal(); err != nil {
+		cm.mu.Unlock()
+		return err
+	}
+	if cm.state != Leader || cm.refusingProposals() {
+		cm.mu.Unlock()
+		return ErrNotLeader
+	}
+	_, ok := cm.propose(command, &proposal{cb: cb})
+	cm.mu.Unlock()
+	if !ok {
+		return ErrNotLeader
+	}
+	callHook(cm.hooks.afterAppendBeforeTrigger)
+	cm.triggerAE() // 需要发送 AE
+	return nil
+}
+
+// 追加 command 并登记提案，返回日志序号，需在持有锁的情况下调用
+// 追加失败（持久化失败而退位）时不登记提案，第二个返回值为 false
+func (cm *ConsensusModule) propose(command interface{}, p *proposal) (int, bool) {
+	if !cm.appendCommand(command) {
+		return -1, false
+	}
+	index := cm.logEnd() - 1
+	p.term = cm.currentTerm
+	cm.failProposals(index, ErrDropped) // 同一序号上的旧提案不可能再被提交
+	cm.pending[index] = p
+	return index, true
+}
+
+// 根据实际提交的日志项通知提案结果
+func (p *proposal) finish(commitEntry CommitEntry, entry LogEntry) {
+	if entry.Term != p.term {
+		p.resolve(proposalResult{err: ErrDropped})
+		return
+	}
+	p.resolve(proposalResult{entry: commitEntry})
+}
+
+// 通知提案结果
+func (p *proposal) resolve(r proposalResult) {
+	if p.cb != nil {
+		p.cb(r.entry, r.err)
+		return
+	}
+	p.done <- r
+}
+
+// 取出序号在 [from, to] 之间的提案，需在持有锁的情况下调用
+func (cm *ConsensusModule) takeProposals(from, to int) map[int]*proposal {
+	proposals := make(map[int]*proposal)
+	for index := from; index <= to; index++ {
+		if p, ok := cm.pending[index]; ok {
+			proposals[index] = p
+			delete(cm.pending, index)
+		}
+	}
+	return proposals
+}
+
+// 安装快照时结束序号不超过 lastIncludedIndex 的提案，需在持有锁的情况下、替换日志之前调用
+// 这些日志不会再被 commitLoop 逐条应用。kept 表示日志与快照一致、快照之前的日志就是自己的日志，
+// 此时按日志项判断提案是否被提交；否则无法知道这些序号上提交的是哪条日志，以 ErrDropped 结束
+func (cm *ConsensusModule) resolveProposalsInSnapshot(lastIncludedIndex int, kept bool) {
+	for index, p := range cm.pending {
+		if index > lastIncludedIndex {
+			continue
+		}
+		delete(cm.pending, index)
+		// 持有锁，回调需要在另外的 goroutine 中调用
+		if kept && index > cm.logBase {
+			entry := cm.log[cm.logPos(index)]
+			go p.finish(CommitEntry{Command: entry.Command, Index: index, Term: entry.Term}, entry)
+		} else {
+			go p.resolve(proposalResult{err: ErrDropped})
+		}
+	}
+}
+
+// 以 err 结束序号大于等于 from 的所有提案，需在持有锁的情况下调用
+func (cm *ConsensusModule) failProposals(from int, err error) {
+	for index, p := range cm.pending {
+		if index >= from {
+			// 持有锁，回调需要在另外的 goroutine 中调用，以免回调中调用 cm 的方法造成死锁
+			go p.resolve(proposalResult{err: err})
+			delete(cm.pending, index)
+		}
+	}
+}
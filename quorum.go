@@ -0,0 +1,59 @@
+package raft
+
+import (
+	"fmt"
+)
+
+// 多数派大小，只计算参与投票的节点（包括自己）
+// 用于租约与 CheckQuorum：选举多数派不小于多数派，因此任意多数派都与之相交
+func (cm *ConsensusModule) quorum() int {
+	return (len(cm.voters())+1)/2 + 1
+}
+
+// 赢得选举所需的票数，见 Config.ElectionQuorumSize
+func (cm *ConsensusModule) electionQuorum() int {
+	if cm.config.ElectionQuorumSize > 0 {
+		return cm.config.ElectionQuorumSize
+	}
+	return cm.quorum()
+}
+
+// 提交日志所需的节点数，见 Config.ReplicationQuorumSize
+func (cm *ConsensusModule) replicationQuorum() int {
+	if cm.config.ReplicationQuorumSize > 0 {
+		return cm.config.ReplicationQuorumSize
+	}
+	return cm.quorum()
+}
+
+// 校验配置的多数派大小，选举多数派与提交多数派必须相交，选举多数派之间也必须相交
+func (cm *ConsensusModule) validateQuorums() error {
+	n := len(cm.voters()) + 1
+	election, replication := cm.electionQuorum(), cm.replicationQuorum()
+	if election > n || replication > n {
+		return fmt.Errorf("quorum sizes election=%d, replication=%d exceed %d voters", election, replication, n)
+	}
+	if election < cm.quorum() {
+		return fmt.Errorf("election quorum %d is less than a majority of %d voters", election, n)
+	}
+	if election+replication <= n {
+		return fmt.Errorf("election quorum %d and replication quorum %d do not intersect with %d voters", election, replication, n)
+	}
+	return nil
+}
+
+// 去掉 peerIds 中自己的 id 与重复的 id，返回新的切片
+// 所有多数派都按 voters() 加上自己计算，自己出现在 peerIds 中会被多算一票，还会向自己发送 RPC
+func (cm *ConsensusModule) peersWithoutSelf(peerIds []int) []int {
+	peers := make([]int, 0, len(peerIds))
+	seen := map[int]bool{cm.id: true}
+	for _, peerId := range peerIds {
+		if seen[peerId] {
+			cm.logf(LogMembership, LevelWarn, "ignoring peer id %d: it is this node or listed twice", peerId)
+			continue
+		}
+		seen[peerId] = true
+		peers = append(peers, peerId)
+	}
+	return peers
+}
@@ -3,8 +3,8 @@ package raft
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
 	"sync"
@@ -14,6 +14,32 @@ import (
 
 const DebugCM = 1
 
+// AppendEntries 连续失败超过该次数才开始退避，退避时间见 Config.RetryBackoffBase
+const retryBackoffAfter = 3
+
+// 持久化失败重试时持有锁，等待的总时间不超过该值，以免长时间阻塞 RPC 处理与心跳，见 Config.PersistRetries
+const persistRetryMaxWait = 25 * time.Millisecond
+
+// 选举超时的参数
+const (
+	electionTimeoutMin   = 150 * time.Millisecond // 最短选举超时，follower 在此时间内收到过 leader 的请求就不会发起选举
+	electionTimeoutRange = 150 * time.Millisecond // 在最短选举超时之上随机增加的范围
+	electionBootDelay    = 100 * time.Millisecond // 启动后第一次选举超时额外增加的时间，让集群有时间稳定下来
+)
+
+var (
+	ErrNotLeader    = errors.New("raft: not leader")
+	ErrNotCaughtUp  = errors.New("raft: leader has not caught up with the current term")
+	ErrDropped      = errors.New("raft: proposal was overwritten and not committed")
+	ErrStopped      = errors.New("raft: consensus module stopped")
+	ErrStaleRead    = errors.New("raft: follower has not heard from leader recently")
+	ErrCompacted    = errors.New("raft: requested entries have been compacted into a snapshot")
+	ErrCannotLead   = errors.New("raft: witnesses and learners never start elections")
+	ErrDegraded     = errors.New("raft: persisting state failed, node is degraded")
+	ErrBootstrapped = errors.New("raft: node already has state and cannot be bootstrapped")
+	ErrTooLarge     = errors.New("raft: encoded command exceeds Config.MaxCommandBytes")
+)
+
 type CMState int
 
 const (
@@ -38,10 +64,47 @@ func (s CMState) String() string {
 	}
 }
 
+// 日志项类型
+type EntryType int
+
+const (
+	EntryNormal EntryType = iota // 客户端命令
+	EntryConfig                  // 集群配置变更
+	EntryNoOp                    // 空操作
+)
+
+func (t EntryType) String() string {
+	switch t {
+	case EntryNormal:
+		return "Normal"
+	case EntryConfig:
+		return "Config"
+	case EntryNoOp:
+		return "NoOp"
+	default:
+		panic("unreachable")
+	}
+}
+
 // 日志项
 type LogEntry struct {
 	Command interface{} // 命令
 	Term    int         // 任期
+	Type    EntryType   // 类型，只有 Normal 会提交给客户端
+}
+
+// 持久化日志项，Command 已经过 Codec 编码
+type persistedEntry struct {
+	Command []byte    // 编码后的命令
+	Term    int       // 任期
+	Type    EntryType // 类型
+}
+
+// 持久化的日志
+type persistedLog struct {
+	BaseIndex int              // 已被压缩掉的最后一个日志序号
+	BaseTerm  int              // 已被压缩掉的最后一个日志任期
+	Entries   []persistedEntry // logBase 之后的日志
 }
 
 // 提交项
@@ -50,10 +113,14 @@ type LogEntry struct {
 // be applied to the client's state machine.
 // 每一个 CommitEntry 表示客户端已经收到了 Raft 服务的确认命令，并且客户端也可以将 CommitEntry
 // 应用到自己的状态机中
+// Snapshot 不为 nil 时表示 leader 发来的快照已安装，客户端应以它重置状态机，
+// 此时 Index 和 Term 为快照包含的最后一个日志，Command 为 nil。
+// 快照之后提交的都是序号大于 Index 的日志
 type CommitEntry struct {
-	Command interface{} // 命令
-	Index   int         // 序号
-	Term    int         // 任期
+	Command  interface{} // 命令
+	Index    int         // 序号
+	Term     int         // 日志项被追加时的任期，与提交时的任期可能不同
+	Snapshot []byte      // 状态机快照
 }
 
 // 共识模块
@@ -62,153 +129,667 @@ type ConsensusModule struct {
 	mu      sync.Mutex // 锁
 	id      int        // 当前模块id
 	peerIds []int      // 集群端点id
-	server  *Server    // RPC server
+	server  Transport  // RPC 传输
 
 	commitChan chan<- CommitEntry // 提交队列
 
 	// sync channel
-	newCommitReadyChan chan struct{} // 新提交准备
-	triggerAEChan      chan struct{} // AppendEntries 需要发送
+	newCommitReadyChan chan struct{}  // 新提交准备
+	commitLoopDone     chan struct{}  // commitLoop 退出时关闭
+	electionTimerDone  chan struct{}  // runElectionTimer 退出时关闭
+	applyBuf           chan applyItem // ApplyBuffer 策略下 commitLoop 与 commitChan 之间的缓冲
+	applyDone          chan struct{}  // applyBuf 转发完毕时关闭
+	triggerAEChan      chan struct{}  // AppendEntries 需要发送
+	electionTimerChan  chan struct{}  // 选举计时需要重新开始，见 resetElectionTimer
 
 	// persistent Raft state
 	currentTerm int        // 当前任期
 	votedFor    int        // 给谁投过票
-	log         []LogEntry // 日志
+	log         []LogEntry // 日志，cm.log[0] 的序号为 logBase + 1
+	logHashes   []uint64   // 日志校验和的前缀和，按需计算，见 rangeHash
+	logBase     int        // 已被压缩掉的最后一个日志序号，-1 表示没有压缩
+	logBaseTerm int        // 已被压缩掉的最后一个日志任期
+
+	// 快照，logBase <= snapshotIndex，两者之间的日志为慢节点保留
+	snapshot      []byte // 状态机快照
+	snapshotIndex int    // 快照包含的最后一个日志序号，-1 表示没有快照
+	snapshotTerm  int    // 快照包含的最后一个日志任期
 
 	// volatile state
 	commitIndex        int       // 已提交日志序号
 	lastApplied        int       // 最后应用日志序号
+	deliveredIndex     int       // 最后交给客户端（写入 commitChan）的日志序号，落后于 lastApplied 说明客户端消费慢
+	applyStarted       bool      // commitLoop 已开始交付，之后不能再调用 SetLastApplied
 	state              CMState   // 当前角色状态
+	epoch              int       // 每次角色变化时加一，回复时与发送请求时不同则丢弃回复
 	electionResetEvent time.Time // 选举时间
+	lastLeaderContact  time.Time // 最后一次收到当前 leader 请求的时间
+	leaderId           int       // 当前任期的 leader id，-1 表示未知
+	leaderCommit       int       // 最近一次收到的 leader 的 commitIndex
+
+	// 选举超时的随机化
+	booting bool       // 还没有开始过选举计时
+	rand    *rand.Rand // 随机源，每个节点独立播种
 
 	// volatile Raft leader state
 	nextIndex  map[int]int // 下一个日志序号
 	matchIndex map[int]int // 已匹配日志序号
 
+	// AppendEntries 失败重试的退避状态
+	peerFailures map[int]int       // 连续失败次数
+	peerRetryAt  map[int]time.Time // 下次允许发送的时间
+
+	paused map[int]bool // 暂停复制的 peer，见 PauseReplication
+
+	// Ping 探测，见 Config.PingInterval
+	pinging      map[int]bool         // 正在探测的 peer
+	pingFailures map[int]int          // 连续探测失败次数
+	reachability map[int]Reachability // 可达状况
+
+	peerLastContact map[int]time.Time // 最后一次 AppendEntries 成功的时间
+	peerLeaseAck    map[int]time.Time // 最后一次成功的 AppendEntries 的发送时间，用于计算租约
+
+	barrierIndex int // 当前任期空操作屏障的日志序号，-1 表示还未追加
+
+	transferring bool      // 正在转移领导权，不再接受新的提案
+	draining     bool      // 正在排空，不再接受新的提案，见 Drain
+	leaderSince  time.Time // 成为 leader 的时间
+	termStart    time.Time // 进入当前任期的时间，见 TermStart
+
+	// leader 的 commitIndex 停滞检测，见 checkCommitStall
+	stallCommitIndex int       // 上次检查时的 commitIndex
+	stallSince       time.Time // 从何时起 commitIndex 没有推进
+	stallReported    bool      // 这次停滞是否已经报告
+
+	admitCond *sync.Cond // 等待未提交的日志数降到 Config.MaxPendingProposals 以下，使用 mu，见 admitProposal
+
+	// 批量持久化，见 Config.PersistBatchInterval
+	persistBatch *persistBatch // 等待持久化的追加，nil 表示没有
+	persistedEnd int           // 已经持久化的日志末尾，批量持久化时 leader 只对这之前的日志计入自己的一票
+
+	pending map[int]*proposal // 等待提交的提案，以日志序号为 key
+
+	commitWatchers []chan int              // commitIndex 的监听者
+	commitHooks    map[int][]func()        // commitIndex 达到 key 时调用的回调，见 OnCommit
+	applyWaiters   map[int][]chan struct{} // 等待日志交给客户端的调用，以日志序号为 key，见 WaitForApplied
+
+	snapshotSending map[int]bool      // 正在向哪些 peer 发送快照
+	incoming        *incomingSnapshot // 正在接收的快照
+	snapshotPending bool              // 安装的快照还没有交给客户端
+
+	duplicateLeaders int // 作为 leader 收到同任期其它 leader 请求的次数
+	logDivergences   int // 检测到与 leader 日志分歧的次数
+	droppedCommits   int // ApplyDrop 策略下丢弃的提交数
+
+	applyBufferFull   int // ApplyBuffer 策略下交付时缓冲已满的次数
+	applyBufferMaxLen int // ApplyBuffer 策略下缓冲中最多的条数
+
+	rejectedTerms      int       // 因任期跳跃过大而忽略的请求与回复数，见 Config.MaxTermGap
+	lastTermGapWarning time.Time // 上一次打印任期跳跃告警的时间
+
+	voteRejections map[VoteRejection]int // 按原因统计的拒绝投票次数
+
+	rpcLatency map[int]map[string]LatencyStats // 每个 peer 每种 RPC 的延迟，见 Metrics
+
+	configuration  []int // 最近提交的配置日志项中的投票成员，nil 表示没有，见 Configuration
+	configLearners []int // 最近提交的配置日志项中的学习者
+
+	lastCommitted *CommitEntry // 最近提交的客户端命令，nil 表示还没有，见 LastCommitted
+
+	report atomic.Value // 最新的 reportState，Report 无需加锁即可读取，见 publishReport
+
+	hooks testHooks // 测试钩子，见 testHooks
+
 	// persistence
-	storage Storage
+	storage  Storage
+	degraded bool // 持久化失败，不再参与共识，见 degrade
+
+	// 自上次持久化以来改变过的状态，persistToStorage 只写入这些字段
+	termDirty     bool
+	voteDirty     bool
+	logDirty      bool // 包括 logBase 与 logBaseTerm
+	snapshotDirty bool
+
+	config *Config // 配置
 }
 
 // 新建 Raft 共识
-func NewConsensusModule(id int, peerIds []int, server *Server, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry) *ConsensusModule {
+// 如果 storage 中的持久化数据损坏，返回错误
+func NewConsensusModule(id int, peerIds []int, server Transport, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry, config *Config) (*ConsensusModule, error) {
 	cm := new(ConsensusModule)
+	cm.config = config.withDefaults()
 	cm.id = id
-	cm.peerIds = peerIds
+	cm.peerIds = cm.peersWithoutSelf(peerIds)
+	if err := cm.validateQuorums(); err != nil {
+		return nil, err
+	}
 	cm.server = server
 	cm.storage = storage
 	cm.commitChan = commitChan
-	cm.newCommitReadyChan = make(chan struct{}, 16) // 带一个 16 的缓冲，防止过度等待
-	cm.triggerAEChan = make(chan struct{}, 1)       // AE 发送
-	cm.state = Follower                             // 刚开始是 Follower，超时后变成 Candidate
+	cm.newCommitReadyChan = make(chan struct{}, 1) // 只需一个缓冲，见 signalCommit
+	cm.electionTimerChan = make(chan struct{}, 1)  // 同样只需一个缓冲，见 resetElectionTimer
+	cm.triggerAEChan = make(chan struct{}, 1)      // AE 发送
+	cm.commitLoopDone = make(chan struct{})        // commitLoop 退出信号
+	cm.electionTimerDone = make(chan struct{})     // 选举计时退出信号
+	cm.state = Follower                            // 刚开始是 Follower，超时后变成 Candidate
 	cm.votedFor = -1
+	cm.leaderId = -1
+	cm.leaderCommit = -1
+	cm.admitCond = sync.NewCond(&cm.mu)
+	cm.booting = true
+	// 以 Config.Rand 给出的种子或当前时间与 id 一起派生自己的随机源，共享配置的节点以及同时重启的节点得到不同的选举超时
+	cm.rand = rand.New(rand.NewSource(cm.config.randSeed() ^ int64(id+1)<<32))
 	cm.commitIndex = -1
 	cm.lastApplied = -1
+	cm.deliveredIndex = -1
+	cm.barrierIndex = -1
+	cm.snapshotIndex = -1
+	cm.snapshotTerm = -1
+	cm.logBase = -1
+	cm.logBaseTerm = -1
+	cm.log = cm.newLog(nil)
+	cm.termStart = cm.config.Clock.Now() // 恢复的任期实际开始的时间未知，从启动时算起
 	cm.nextIndex = make(map[int]int)
 	cm.matchIndex = make(map[int]int)
-	// 如果 storage 中有状态数据，则恢复
+	cm.peerFailures = make(map[int]int)
+	cm.peerRetryAt = make(map[int]time.Time)
+	cm.peerLastContact = make(map[int]time.Time)
+	cm.peerLeaseAck = make(map[int]time.Time)
+	cm.pending = make(map[int]*proposal)
+	cm.snapshotSending = make(map[int]bool)
+	cm.paused = make(map[int]bool)
+	cm.rpcLatency = make(map[int]map[string]LatencyStats)
+	cm.applyWaiters = make(map[int][]chan struct{})
+	cm.commitHooks = make(map[int][]func())
+	cm.voteRejections = make(map[VoteRejection]int)
+	cm.pinging = make(map[int]bool)
+	cm.pingFailures = make(map[int]int)
+	cm.reachability = make(map[int]Reachability)
+	// 如果 storage 中有状态数据，则恢复，否则第一次持久化需要写入所有字段
 	if cm.storage.HasData() {
-		cm.restoreFromStorage(cm.storage)
+		if err := cm.restoreFromStorage(cm.storage); err != nil {
+			return nil, err
+		}
+	} else {
+		cm.termDirty, cm.voteDirty, cm.logDirty, cm.snapshotDirty = true, true, true, true
 	}
+	cm.persistedEnd = cm.logEnd()
+	cm.publishReport()
 
 	go func() {
 		<-ready // 准备完成，即开始选举
 		cm.mu.Lock()
-		cm.electionResetEvent = time.Now() // 重置选举时间
+		cm.electionResetEvent = cm.config.Clock.Now() // 重置选举时间
+		if cm.snapshotPending {
+			cm.signalCommit() // 交付恢复的快照，在此之前客户端可以调用 SetLastApplied
+		}
 		cm.mu.Unlock()
 		cm.runElectionTimer() // 开始选举
 	}()
 
 	// 开始日志提交 loop
+	if cm.config.ApplyBackpressurePolicy == ApplyBuffer {
+		cm.applyBuf = make(chan applyItem, cm.config.ApplyBufferSize)
+		cm.applyDone = make(chan struct{})
+		go cm.forwardApplies()
+	}
 	go cm.commitLoop()
 
-	return cm
+	if cm.config.PingInterval > 0 {
+		go cm.runProbes()
+	}
+
+	return cm, nil
 }
 
 // 提交 command 日志
+// 返回 true 只表示已追加到 leader 的日志，leader 更替后这条日志可能被覆盖而不会提交；
+// 需要确认提交结果时，使用 ProposeAndWait，它会核对提交的日志项是否是自己追加的那一条。
+// command 无法编码、超过 Config.MaxCommandBytes 或被 Config.PreAppendHook 拒绝时返回 false，
+// 未提交的日志数达到 Config.MaxPendingProposals 时同样返回 false（或者按 Config.BlockOnPendingLimit 等待）。
+// 开启 Config.ForwardSubmit 时，follower 会把 command 转发给已知的 leader 并返回它的结果
 func (cm *ConsensusModule) Submit(command interface{}) bool {
+	if err := cm.preAppend(command); err != nil {
+		return false
+	}
+	return cm.submit(command, 0)
+}
+
+// 追加 command，不是 leader 时按需转发，hops 为 command 已经被转发的次数，不能在持有锁的情况下调用
+func (cm *ConsensusModule) submit(command interface{}, hops int) bool {
 	cm.mu.Lock()
-	cm.dlog("Submit received by %v: %v", cm.state, command)
-	if cm.state == Leader {
-		cm.log = append(cm.log, LogEntry{
-			Command: command,
-			Term:    cm.currentTerm,
-		})
-		cm.persistToStorage() // 更新 log 后持久化
-		cm.dlog("... log=%v", cm.log)
+	cm.logf(LogProposal, LevelDebug, "Submit received by %v: %v", cm.state, command)
+	if cm.admitProposal() == nil && !cm.refusingProposals() && cm.appendCommand(command) {
+		batch := cm.persistBatch
 		cm.mu.Unlock()
-		cm.triggerAEChan <- struct{}{} // 需要发送 AE
-		return true
+		callHook(cm.hooks.afterAppendBeforeTrigger)
+		cm.triggerAE() // 需要发送 AE
+		return batch.wait() == nil
+	}
+	leaderId := cm.leaderId
+	forward := cm.config.ForwardSubmit && cm.state == Follower && !cm.draining && leaderId >= 0 && leaderId != cm.id && hops < maxForwardHops
+	cm.mu.Unlock()
+	if !forward {
+		return false
+	}
+	return cm.forwardSubmit(leaderId, command, hops)
+}
+
+// 只有 leader 日志的最后一个序号等于 expectedLastIndex 时才提交 command，返回追加的日志序号
+// 客户端可以借此实现比较并交换：读取时记下最后的序号，写入时如果期间有其它日志追加则失败，需要重新读取。
+// 注意 leader 追加的空操作屏障与配置日志项也会改变最后的序号；与 Submit 相同，返回 true 只表示已追加
+func (cm *ConsensusModule) SubmitIfIndex(expectedLastIndex int, command interface{}) (int, bool) {
+	if err := cm.preAppend(command); err != nil {
+		return -1, false
+	}
+	cm.mu.Lock()
+	cm.logf(LogProposal, LevelDebug, "SubmitIfIndex(%d) received by %v: %v", expectedLastIndex, cm.state, command)
+	if cm.admitProposal() != nil || cm.refusingProposals() || cm.logEnd()-1 != expectedLastIndex {
+		cm.logf(LogProposal, LevelDebug, "... not appending %v: last log index is %d", command, cm.logEnd()-1)
+		cm.mu.Unlock()
+		return -1, false
 	}
+	if !cm.appendCommand(command) {
+		cm.mu.Unlock()
+		return -1, false
+	}
+	index := cm.logEnd() - 1
+	batch := cm.persistBatch
 	cm.mu.Unlock()
-	return false
+	callHook(cm.hooks.afterAppendBeforeTrigger)
+	cm.triggerAE() // 需要发送 AE
+	if batch.wait() != nil {
+		return -1, false
+	}
+	return index, true
+}
+
+// 与 Submit 相同地追加并持久化 command，但不通知 leader 发送 AppendEntries，返回追加的日志序号
+// 连续调用多次之后调用一次 FlushTriggers 开始复制，由调用者控制批量复制的时机，也可用于不涉及 RPC 的追加路径基准测试。
+// 心跳照常发送，不调用 FlushTriggers 时日志最迟随下一次心跳复制。不是 leader 时不转发，直接失败
+func (cm *ConsensusModule) SubmitNoTrigger(command interface{}) (int, bool) {
+	if err := cm.preAppend(command); err != nil {
+		return -1, false
+	}
+	cm.mu.Lock()
+	if cm.admitProposal() != nil || cm.refusingProposals() || !cm.appendCommand(command) {
+		cm.mu.Unlock()
+		return -1, false
+	}
+	index := cm.logEnd() - 1
+	batch := cm.persistBatch
+	cm.mu.Unlock()
+	if batch.wait() != nil {
+		return -1, false
+	}
+	return index, true
+}
+
+// 通知 leader 发送 AppendEntries，复制 SubmitNoTrigger 追加的日志
+// 多次调用会合并，不是 leader 时没有影响
+func (cm *ConsensusModule) FlushTriggers() {
+	cm.triggerAE()
+}
+
+// 线性一致地提交 command 日志
+// 与 Submit 不同，刚成为 Leader 时，在当前任期有日志提交之前，Leader 的状态机可能还落后于
+// 之前任期已提交的日志，此时会追加一个空操作作为屏障并返回 ErrNotCaughtUp，客户端应稍后重试。
+// command 无法编码时返回编码错误，超过 Config.MaxCommandBytes 时返回 ErrTooLarge，被 Config.PreAppendHook 拒绝时原样返回它的错误，
+// 未提交的日志数达到 Config.MaxPendingProposals 时返回 ErrTooManyPending
+func (cm *ConsensusModule) SubmitLinearizable(command interface{}) error {
+	if err := cm.preAppend(command); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	cm.logf(LogProposal, LevelDebug, "SubmitLinearizable received by %v: %v", cm.state, command)
+	if err := cm.admitProposal(); err != nil {
+		cm.mu.Unlock()
+		return err
+	}
+	if cm.state != Leader || cm.refusingProposals() {
+		cm.mu.Unlock()
+		return ErrNotLeader
+	}
+	if cm.commitIndex < 0 || cm.termAt(cm.commitIndex) != cm.currentTerm {
+		// 当前任期还没有日志提交，追加空操作屏障，它被提交时之前任期的日志也都已提交
+		if cm.barrierIndex < 0 {
+			if !cm.appendBarrier() {
+				cm.mu.Unlock()
+				return ErrNotLeader
+			}
+			cm.mu.Unlock()
+			cm.triggerAE()
+			return ErrNotCaughtUp
+		}
+		cm.mu.Unlock()
+		return ErrNotCaughtUp
+	}
+	if !cm.appendCommand(command) {
+		cm.mu.Unlock()
+		return ErrNotLeader
+	}
+	batch := cm.persistBatch
+	cm.mu.Unlock()
+	callHook(cm.hooks.afterAppendBeforeTrigger)
+	cm.triggerAE() // 需要发送 AE
+	return batch.wait()
+}
+
+// 追加当前任期的空操作屏障并持久化，需在持有锁的情况下调用
+// 屏障被提交时，之前任期的日志也都随之提交；持久化失败时撤销追加并返回 false
+func (cm *ConsensusModule) appendBarrier() bool {
+	cm.log = append(cm.log, LogEntry{Term: cm.currentTerm, Type: EntryNoOp})
+	cm.logDirty = true
+	if err := cm.persistToStorage(); err != nil {
+		cm.log = cm.log[:len(cm.log)-1]
+		return false
+	}
+	cm.barrierIndex = cm.logEnd() - 1
+	cm.logf(LogProposal, LevelDebug, "... appended no-op barrier at index %d", cm.barrierIndex)
+	return true
+}
+
+// 向 Leader 的日志中追加客户端命令并持久化，需在持有锁的情况下调用
+// 不是 Leader 时不追加并返回 false；检查与追加在同一次持有锁期间完成，其间不会有角色变化
+func (cm *ConsensusModule) appendCommand(command interface{}) bool {
+	if cm.state != Leader {
+		cm.logf(LogReplication, LevelDebug, "... not appending %v as %v", command, cm.state)
+		return false
+	}
+	cm.log = append(cm.log, LogEntry{
+		Command: command,
+		Term:    cm.currentTerm,
+	})
+	cm.logDirty = true
+	// 批量持久化时只加入当前批次，调用者释放锁之后等待批次完成
+	if cm.config.PersistBatchInterval > 0 {
+		cm.joinPersistBatch()
+		cm.logf(LogReplication, LevelDebug, "... log=%v (persisting in batch)", cm.log)
+		return true
+	}
+	// 更新 log 后持久化，失败时撤销追加，此时节点已经降级退位
+	if err := cm.persistToStorage(); err != nil {
+		cm.log = cm.log[:len(cm.log)-1]
+		return false
+	}
+	cm.logf(LogReplication, LevelDebug, "... log=%v", cm.log)
+	return true
+}
+
+// 追加之前检查客户端命令，不能在持有锁的情况下调用
+// 先试编码一次，无法编码的命令（例如没有通过 gob.Register 注册的类型）追加后会导致持久化失败、
+// 节点降级，因此直接拒绝；编码后超过 Config.MaxCommandBytes 的命令返回 ErrTooLarge；然后调用 Config.PreAppendHook
+func (cm *ConsensusModule) preAppend(command interface{}) error {
+	data, err := cm.config.Codec.Encode(command)
+	if err != nil {
+		cm.logf(LogProposal, LevelDebug, "cannot encode %v: %v", command, err)
+		return fmt.Errorf("raft: encoding command: %w", err)
+	}
+	if max := cm.config.MaxCommandBytes; max > 0 && len(data) > max {
+		cm.logf(LogProposal, LevelDebug, "rejecting command of %d bytes, limit is %d", len(data), max)
+		return ErrTooLarge
+	}
+	if cm.config.PreAppendHook == nil {
+		return nil
+	}
+	if err := cm.config.PreAppendHook(command); err != nil {
+		cm.logf(LogProposal, LevelDebug, "PreAppendHook rejected %v: %v", command, err)
+		return err
+	}
+	return nil
+}
+
+// Report 返回的状态
+type reportState struct {
+	term     int
+	isLeader bool
 }
 
 // ConsensusModule 状态反馈
+// 不加锁，读取状态变化时发布的副本，适合高频调用（例如每个请求都检查是否是 leader），不会与复制争用锁
 func (cm *ConsensusModule) Report() (id int, term int, isLeader bool) {
+	r := cm.report.Load().(reportState)
+	return cm.id, r.term, r.isLeader
+}
+
+// 发布当前的任期与角色供 Report 读取，任期或角色改变之后调用，需在持有锁的情况下调用
+func (cm *ConsensusModule) publishReport() {
+	cm.report.Store(reportState{term: cm.currentTerm, isLeader: cm.state == Leader})
+}
+
+// 是否是持有有效租约的 leader
+// 与 Report 不同，只有多数派（包括自己）在最短选举超时之内确认过当前 leader 时才返回 true，
+// 此时不可能有其它 leader 被选出，可以据此提供租约读
+// 注意租约依赖各节点时钟速率大致相同
+func (cm *ConsensusModule) IsLeaderWithLease() bool {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	return cm.id, cm.currentTerm, cm.state == Leader
+	if cm.state != Leader {
+		return false
+	}
+	now := cm.config.Clock.Now()
+	acks := 1
+	for _, peerId := range cm.voters() {
+		ack := cm.peerLeaseAck[peerId]
+		if !ack.IsZero() && now.Sub(ack) < electionTimeoutMin {
+			acks++
+		}
+	}
+	return acks >= cm.quorum()
+}
+
+// follower 只读查询
+// 如果在 maxStaleness 之内收到过 leader 的请求，返回 lastApplied，表示已应用到状态机的数据
+// 最多落后 maxStaleness，客户端可以据此在 follower 上执行有界陈旧的读；否则返回 ErrStaleRead
+func (cm *ConsensusModule) FollowerRead(maxStaleness time.Duration) (int, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Follower || cm.lastLeaderContact.IsZero() ||
+		cm.config.Clock.Now().Sub(cm.lastLeaderContact) > maxStaleness {
+		return -1, ErrStaleRead
+	}
+	return cm.lastApplied, nil
+}
+
+// 查询序号为 index、任期为 term 的日志是否已提交
+// 返回 false 表示该日志还未提交，或者已被其它任期的日志覆盖；已被压缩的日志（logBase 除外）
+// 无法确认任期，也返回 false
+func (cm *ConsensusModule) IsCommitted(index int, term int) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if index < cm.logBase || index > cm.commitIndex || index < 0 {
+		return false
+	}
+	return cm.termAt(index) == term
+}
+
+// 获取序号从 from 开始的所有已提交日志，用于客户端重启后重放日志重建状态
+// 与 commitChan 一样只包含客户端命令；如果 from 之后的日志已被压缩进快照，返回 ErrCompacted
+func (cm *ConsensusModule) CommittedEntries(from int) ([]CommitEntry, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if from < 0 {
+		from = 0
+	}
+	if from <= cm.logBase {
+		return nil, ErrCompacted
+	}
+	var entries []CommitEntry
+	for index := from; index <= cm.commitIndex; index++ {
+		entry := cm.log[cm.logPos(index)]
+		if entry.Type != EntryNormal {
+			continue
+		}
+		entries = append(entries, CommitEntry{
+			Command: entry.Command,
+			Index:   index,
+			Term:    entry.Term,
+		})
+	}
+	return entries, nil
+}
+
+// 获取 leader 日志中还未提交的日志项（包括空操作与配置日志项），即还没有得到多数派确认的提案
+// 第一项的序号为当前的 commitIndex + 1；返回的是副本，不是 Leader 时返回 nil。
+// 可用于观测写入积压，或者判断一个超时的提案是否还在等待提交
+func (cm *ConsensusModule) UncommittedEntries() []LogEntry {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Leader {
+		return nil
+	}
+	return append([]LogEntry(nil), cm.log[cm.logPos(cm.commitIndex+1):]...)
 }
 
 // 停止服务
 func (cm *ConsensusModule) Stop() {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return // 已经停止
+	}
 	cm.state = Dead // 死亡
-	cm.dlog("becomes Dead")
+	cm.publishReport()
+	cm.logf(LogElection, LevelInfo, "becomes Dead")
 	close(cm.newCommitReadyChan)
+	cm.closeCommitWatchers()
+	cm.closeApplyWaiters()
+	cm.finishPersistBatch(ErrStopped)
+	cm.admitCond.Broadcast() // 唤醒等待准入的提案，让它们返回 ErrStopped
+	cm.resetElectionTimer()  // 唤醒选举计时，让它退出
 }
 
-// 选举定时器，选举操作在 10ms 后超时，然后开始选举，无论选举结果如何，也会开始下一轮选举
+// 选举计时，准备完成后运行，节点停止时退出
+// 整个生命周期只使用一个 Timer：每轮计时随机选取一个超时时间，Timer 到期时如果期间收到过
+// leader 的请求（electionResetEvent 更新），只把 Timer 推迟到剩余的时间，否则发起选举。
+// 角色或任期变化时通过 resetElectionTimer 开始新的一轮；作为 Leader 时 Timer 到期后不再重置，
+// 直到退位时重新开始计时
 func (cm *ConsensusModule) runElectionTimer() {
-	timeoutDuration := cm.electionTimeout()
+	defer close(cm.electionTimerDone)
 	cm.mu.Lock()
+	timeoutDuration := cm.electionTimeout()
 	termStarted := cm.currentTerm
+	remaining := timeoutDuration - cm.config.Clock.Now().Sub(cm.electionResetEvent)
 	cm.mu.Unlock()
-	cm.dlog("election timer started (%v), term=%d", timeoutDuration, termStarted)
-	// 10ms 下一轮
-	ticker := time.NewTicker(10 * time.Millisecond)
-	defer ticker.Stop()
+	cm.logf(LogElection, LevelDebug, "election timer started (%v), term=%d", timeoutDuration, termStarted)
+	timer := cm.config.Clock.NewTimer(remaining)
+	defer timer.Stop()
+	// 以新的随机超时开始下一轮计时，需在持有锁的情况下调用
+	restart := func() {
+		timeoutDuration = cm.electionTimeout()
+		termStarted = cm.currentTerm
+		remaining = timeoutDuration - cm.config.Clock.Now().Sub(cm.electionResetEvent)
+		if !timer.Stop() {
+			select {
+			case <-timer.C(): // 已到期但还未读取
+			default:
+			}
+		}
+		timer.Reset(remaining)
+		cm.logf(LogElection, LevelDebug, "election timer restarted (%v), term=%d", timeoutDuration, termStarted)
+	}
 	for {
-		<-ticker.C
+		reset := false
+		select {
+		case <-cm.electionTimerChan:
+			reset = true
+		case <-timer.C():
+		}
 
 		cm.mu.Lock()
-		// 当前状态既不是 Candidate 也不是 Follower，即 Follower 或者 Dead，则无需选举，直接退出
-		if cm.state != Candidate && cm.state != Follower {
-			cm.dlog("in election timer state=%s, bailing out", cm.state)
+		if cm.state == Dead {
 			cm.mu.Unlock()
 			return
 		}
-		// 如果任期发生了更新，结束当前选举，进入下一轮选举
-		if termStarted != cm.currentTerm {
-			cm.dlog("in election timer term changed from %d to %d, bailing out", termStarted, cm.currentTerm)
+		// 角色或任期发生了变化，重新开始计时
+		if reset || termStarted != cm.currentTerm {
+			restart()
 			cm.mu.Unlock()
-			return
+			continue
 		}
-		// 选举超时，则触发下一次选举
-		if elapsed := time.Since(cm.electionResetEvent); elapsed >= timeoutDuration {
-			cm.startElection() // 开始选举
+		// Leader 不需要选举计时，等待退位时重新开始
+		if cm.state == Leader {
 			cm.mu.Unlock()
-			return
+			continue
+		}
+		// 选举超时，则触发下一次选举
+		if elapsed := cm.config.Clock.Now().Sub(cm.electionResetEvent); elapsed < timeoutDuration {
+			timer.Reset(timeoutDuration - elapsed)
+		} else if cm.config.Witness || cm.isLearner(cm.id) || cm.degraded || cm.awaitingBootstrap() ||
+			!cm.config.ElectionStrategy.ShouldStartElection(cm.electionState()) {
+			// 见证者、学习者与降级的节点永远不发起选举，等待引导的节点在收到日志之前也不发起，
+			// 选举策略也可以推迟选举，重新计时即可
+			cm.electionResetEvent = cm.config.Clock.Now()
+			timer.Reset(timeoutDuration)
+		} else {
+			// 作为 Candidate 超时，说明这一任期的选举没有分出结果
+			if cm.state == Candidate {
+				cm.reportElection(ElectionResult{Term: cm.currentTerm, Outcome: ElectionTimedOut})
+			}
+			if cm.config.StableLeadership {
+				cm.startPreVote() // 先预投票，会重新开始计时
+			} else {
+				cm.startElection(false) // 开始选举，会重新开始计时
+			}
 		}
 		cm.mu.Unlock()
 	}
 }
 
+// 通知选举计时以新的随机超时重新开始一轮，可以合并，发送永远不会阻塞
+func (cm *ConsensusModule) resetElectionTimer() {
+	select {
+	case cm.electionTimerChan <- struct{}{}:
+	default:
+	}
+}
+
 // 请求投票
-func (cm *ConsensusModule) startElection() {
+// transfer 表示这是领导权转移发起的选举
+func (cm *ConsensusModule) startElection(transfer bool) {
 	cm.state = Candidate // 变更状态
+	cm.epoch++
 	cm.currentTerm += 1
+	cm.termStart = cm.config.Clock.Now()
+	cm.leaderId = -1
 	savedCurrentTerm := cm.currentTerm
-	cm.electionResetEvent = time.Now() // 选举时间重置
-	cm.votedFor = cm.id                // 给自己投票
-	cm.dlog("becomes Candidate (currentTerm=%d); log=%v", savedCurrentTerm, cm.log)
+	savedEpoch := cm.epoch
+	cm.publishReport()
+	cm.electionResetEvent = cm.config.Clock.Now() // 选举时间重置
+	cm.votedFor = cm.id                           // 给自己投票
+	cm.termDirty, cm.voteDirty = true, true
+	cm.logf(LogElection, LevelInfo, "becomes Candidate (currentTerm=%d); log=%v", savedCurrentTerm, cm.log)
+	// 发出投票请求之前持久化新的任期与投给自己的票，失败时节点降级，不再发起选举
+	if err := cm.persistToStorage(); err != nil {
+		cm.state = Follower
+		cm.epoch++
+		cm.publishReport()
+		cm.resetElectionTimer()
+		return
+	}
 
 	var votesReceived int32 = 1 // 已收到票数，自己的一票
 
-	// 发送选票请求 RPC
-	for _, peerId := range cm.peerIds {
+	// 一轮选举的 span，所有投票请求结束后结束
+	round := cm.config.Tracer.StartSpan("raft.election", SpanContext{})
+	round.SetAttribute("raft.id", cm.id)
+	round.SetAttribute("raft.term", savedCurrentTerm)
+	voters := cm.voters()
+	var wg sync.WaitGroup
+	wg.Add(len(voters))
+	go func() {
+		wg.Wait()
+		round.End()
+	}()
+
+	// 发送选票请求 RPC，学习者不参与投票
+	for _, peerId := range voters {
 		go func(peerId int) {
+			defer wg.Done()
+			span := cm.config.Tracer.StartSpan("raft.RequestVote.send", round.Context())
+			span.SetAttribute("raft.peer", peerId)
+			defer span.End()
+
 			cm.mu.Lock()
 			savedLastLogIndex, savedLastLogTerm := cm.lastLogIndexAndTerm()
 			cm.mu.Unlock()
@@ -217,29 +798,42 @@ func (cm *ConsensusModule) startElection() {
 				CandidateId:  cm.id,
 				LastLogIndex: savedLastLogIndex,
 				LastLogTerm:  savedLastLogTerm,
+
+				LeadershipTransfer: transfer,
+				GroupID:            cm.config.GroupID,
+				Trace:              span.Context(),
 			}
-			cm.dlog("sending RequestVote to %d: %+v", peerId, args)
+			cm.logf(LogElection, LevelDebug, "sending RequestVote to %d: %+v", peerId, args)
 			var reply RequestVoteReply
+			sentAt := cm.config.Clock.Now()
 			if err := cm.server.Call(peerId, "ConsensusModule.RequestVote", args, &reply); err == nil {
+				span.SetAttribute("raft.vote_granted", reply.VotedGranted)
 				cm.mu.Lock()
 				defer cm.mu.Unlock()
-				cm.dlog("received RequestVoteReply %+v", reply)
-				// 发送了投票请求，但是我的状态已经发生了改变，不再是 Candidate，那么直接退出
-				if cm.state != Candidate {
-					cm.dlog("while waiting for reply, state=%v", cm.state)
+				cm.recordLatency(peerId, "RequestVote", cm.config.Clock.Now().Sub(sentAt))
+				cm.logf(LogElection, LevelDebug, "received RequestVoteReply %+v", reply)
+				cm.config.ElectionStrategy.OnVoteReply(peerId, args, reply)
+				// 发送了投票请求，但是我的状态已经发生了改变，不再是这一轮的 Candidate，那么直接退出
+				if cm.state != Candidate || cm.epoch != savedEpoch {
+					cm.logf(LogElection, LevelDebug, "while waiting for reply, state=%v", cm.state)
+					return
+				}
+				if cm.termGapExceeded(reply.Term, peerId, "RequestVote reply") {
 					return
 				}
 				// 如果回复者的任期比发送者的任期大，那么我将成为追随者
 				if reply.Term > savedCurrentTerm {
-					cm.dlog("term out of date in RequestVoteReply")
+					cm.logf(LogElection, LevelDebug, "term out of date in RequestVoteReply")
 					cm.becomeFollower(reply.Term)
+					cm.reportElection(ElectionResult{Term: savedCurrentTerm, Outcome: ElectionLostHigherTerm})
 					return
 				} else if reply.Term == savedCurrentTerm { // 如果回复者的任期与请求者的任期相同
 					if reply.VotedGranted { // 且请求者收到了投票
 						votes := int(atomic.AddInt32(&votesReceived, 1))
-						if votes*2 > len(cm.peerIds)+1 { // 如果获得了半数以上的投票
-							cm.dlog("wins election with %d votes", votes)
+						if votes >= cm.electionQuorum() { // 如果获得了足够的投票
+							cm.logf(LogElection, LevelInfo, "wins election with %d votes", votes)
 							cm.startLeader() // 成为 leader
+							cm.reportElection(ElectionResult{Term: savedCurrentTerm, Outcome: ElectionWon, Votes: votes})
 							return
 						}
 					}
@@ -247,19 +841,82 @@ func (cm *ConsensusModule) startElection() {
 			}
 		}(peerId)
 	}
-	// 开始另一次选举
-	go cm.runElectionTimer()
+	// 单节点集群，自己的一票即是多数
+	if cm.electionQuorum() == 1 {
+		cm.logf(LogElection, LevelInfo, "wins election with 1 vote")
+		cm.startLeader()
+		cm.reportElection(ElectionResult{Term: savedCurrentTerm, Outcome: ElectionWon, Votes: 1})
+		return
+	}
+	// 开始另一次选举计时
+	cm.resetElectionTimer()
+}
+
+// 检查 AppendEntries 的日志项能否接在 PrevLogIndex 之后构成合法的日志：
+// 任期不小于 PrevLogTerm、不递减、不超过 leader 的任期，类型已知
+func validateAppendEntries(args AppendEntriesArgs) error {
+	if args.PrevLogIndex < -1 {
+		return fmt.Errorf("prevLogIndex %d is negative", args.PrevLogIndex)
+	}
+	prevTerm := args.PrevLogTerm
+	for i, entry := range args.Entries {
+		if entry.Term < prevTerm {
+			return fmt.Errorf("entry %d has term %d after term %d", args.PrevLogIndex+1+i, entry.Term, prevTerm)
+		}
+		if entry.Term > args.Term {
+			return fmt.Errorf("entry %d has term %d beyond leader term %d", args.PrevLogIndex+1+i, entry.Term, args.Term)
+		}
+		if entry.Type < EntryNormal || entry.Type > EntryNoOp {
+			return fmt.Errorf("entry %d has unknown type %d", args.PrevLogIndex+1+i, int(entry.Type))
+		}
+		prevTerm = entry.Term
+	}
+	return nil
 }
 
 // 当前节点成为 Follower
 func (cm *ConsensusModule) becomeFollower(term int) {
-	cm.dlog("becomes Follower with term=%d; log=%v", term, cm.log)
-	cm.state = Follower                // 状态
-	cm.currentTerm = term              // 请求者的任期
-	cm.votedFor = -1                   // 成为追随者，我票谁也没投
-	cm.electionResetEvent = time.Now() // 重置选举时间
+	cm.logf(LogElection, LevelInfo, "becomes Follower with term=%d; log=%v", term, cm.log)
+	if term != cm.currentTerm {
+		cm.leaderId = -1 // 新任期的 leader 还未知
+		cm.votedFor = -1 // 新任期还没有投票；同一任期内已经投出的票（包括投给自己的）不能撤回
+		cm.termDirty, cm.voteDirty = true, true
+		cm.termStart = cm.config.Clock.Now()
+	}
+	cm.state = Follower                           // 状态
+	cm.epoch++                                    // 之前发出的请求都已过期
+	cm.currentTerm = term                         // 请求者的任期
+	cm.electionResetEvent = cm.config.Clock.Now() // 重置选举时间
+	cm.publishReport()
+	cm.admitCond.Broadcast() // 等待准入的提案不会再被这个节点追加
+	// 回复任何请求之前先持久化新的任期；失败时节点已经降级，不再投票、确认日志与发起选举
+	if err := cm.persistToStorage(); err != nil {
+		return
+	}
+	cm.resetElectionTimer() // 重新开始选举计时
+}
 
-	go cm.runElectionTimer() // 重新开始选举计时
+// 通知 commitLoop 与 commitIndex 的监听者 commitIndex 有更新，需在持有锁的情况下调用
+// commitLoop 每次都会应用到最新的 commitIndex，因此已有未处理的信号时无需再发送，
+// 信号可以合并，发送永远不会阻塞
+func (cm *ConsensusModule) signalCommit() {
+	if cm.state == Dead {
+		return // newCommitReadyChan 已关闭
+	}
+	cm.notifyCommitWatchers()
+	cm.admitCond.Broadcast()
+	select {
+	case cm.newCommitReadyChan <- struct{}{}:
+	default:
+	}
+}
+
+// 通知 leader 发送 AE，同样可以合并，发送永远不会阻塞
+func (cm *ConsensusModule) triggerAE() {
+	select {
+	case cm.triggerAEChan <- struct{}{}:
+	default:
+	}
 }
 
 // 日志提交 loop，当 commitIndex 更新
@@ -267,25 +924,71 @@ func (cm *ConsensusModule) commitLoop() {
 	// 当 newCommitReadyChan 中有新的 commit 信号来领的时候，即会向 commitChan 中提交日志
 	for range cm.newCommitReadyChan {
 		cm.mu.Lock()
-		savedTerm := cm.currentTerm
+		var snapshot *CommitEntry
+		if cm.snapshotPending {
+			cm.snapshotPending = false
+			snapshot = &CommitEntry{Index: cm.snapshotIndex, Term: cm.snapshotTerm, Snapshot: cm.snapshot}
+		}
 		savedLastApplied := cm.lastApplied
 		var entries []LogEntry
 		if cm.commitIndex > cm.lastApplied {
-			entries = cm.log[cm.lastApplied+1 : cm.commitIndex+1] // 需要应用的日志
+			entries = cm.log[cm.logPos(cm.lastApplied+1) : cm.logPos(cm.commitIndex)+1] // 需要应用的日志
 			cm.lastApplied = cm.commitIndex
+			cm.cacheLastCommitted(entries, savedLastApplied+1)
 		}
+		if snapshot != nil || len(entries) > 0 {
+			cm.applyStarted = true
+		}
+		proposals := cm.takeProposals(savedLastApplied+1, savedLastApplied+len(entries))
 		cm.mu.Unlock()
-		cm.dlog("commitLoop entries=%v, savedLastApplied=%d", entries, savedLastApplied)
+		cm.logf(LogApply, LevelDebug, "commitLoop entries=%v, savedLastApplied=%d", entries, savedLastApplied)
+
+		// 见证者没有 Command，无需应用
+		if cm.config.Witness {
+			cm.deliver(CommitEntry{Index: savedLastApplied + len(entries)}, false)
+			continue
+		}
+
+		// 先交付快照，再交付快照之后的日志
+		if snapshot != nil {
+			cm.deliver(*snapshot, true)
+		}
 
 		for i, entry := range entries {
-			cm.commitChan <- CommitEntry{
+			commitEntry := CommitEntry{
 				Command: entry.Command,
 				Index:   savedLastApplied + i + 1,
-				Term:    savedTerm,
+				Term:    entry.Term,
+			}
+			// Raft 内部的日志项在内部处理，不提交给客户端
+			if entry.Type == EntryConfig {
+				cm.logf(LogApply, LevelDebug, "commitLoop applied config entry %v at index %d", entry.Command, commitEntry.Index)
+				if config, ok := entry.Command.(ClusterConfig); ok {
+					cm.mu.Lock()
+					events := cm.applyConfiguration(config, commitEntry.Index)
+					cm.mu.Unlock()
+					cm.reportMembership(events)
+				}
+			}
+			cm.deliver(commitEntry, entry.Type == EntryNormal)
+			// 通知等待这个序号的提案
+			if p, ok := proposals[commitEntry.Index]; ok {
+				p.finish(commitEntry, entry)
 			}
 		}
+
+		cm.maybeSnapshot()
 	}
-	cm.dlog("commitLoop done")
+	if cm.applyBuf != nil {
+		close(cm.applyBuf)
+		<-cm.applyDone // 缓冲中的提交都交给客户端之后才算结束
+	}
+	cm.logf(LogApply, LevelDebug, "commitLoop done")
+	close(cm.commitLoopDone)
+
+	cm.mu.Lock()
+	cm.failProposals(0, ErrStopped)
+	cm.mu.Unlock()
 }
 
 //
@@ -295,22 +998,38 @@ func (cm *ConsensusModule) commitLoop() {
 // 成为 Leader
 func (cm *ConsensusModule) startLeader() {
 	cm.state = Leader
+	cm.epoch++
+	cm.leaderId = cm.id
+	cm.publishReport()
 	// 成为 leader，开始更新每个 peer 的日志情况
 	for _, peerId := range cm.peerIds {
-		cm.nextIndex[peerId] = len(cm.log) // 下一个要发送的日志序号 len(cm.log)
+		cm.nextIndex[peerId] = cm.logEnd() // 下一个要发送的日志序号
 		cm.matchIndex[peerId] = -1         // 匹配的日志序号，未匹配，所以是 -1
+		cm.peerFailures[peerId] = 0
+		cm.peerRetryAt[peerId] = time.Time{}
+		cm.peerLeaseAck[peerId] = time.Time{}
+	}
+	cm.barrierIndex = -1
+	cm.transferring = false
+	cm.leaderSince = cm.config.Clock.Now()
+	cm.stallCommitIndex, cm.stallSince, cm.stallReported = cm.commitIndex, cm.leaderSince, false
+	cm.logf(LogElection, LevelInfo, "becomes Leader; term=%d, nextIndex=%v, matchIndex=%v; log=%v", cm.currentTerm, cm.nextIndex, cm.matchIndex, cm.log)
+	// 有还没提交的配置日志项（例如 Bootstrap 追加的）时立即追加屏障，
+	// 配置随屏障一起提交，不必等到客户端提交命令
+	if cm.hasUncommittedConfig() {
+		cm.appendBarrier()
 	}
-	cm.dlog("becomes Leader; term=%d, nextIndex=%v, matchIndex=%v; log=%v", cm.currentTerm, cm.nextIndex, cm.matchIndex, cm.log)
+	savedEpoch := cm.epoch
 	go func(heartbeatTimeout time.Duration) {
 		cm.sendAppendEntries()
-		t := time.NewTimer(heartbeatTimeout)
+		t := cm.config.Clock.NewTimer(heartbeatTimeout)
 		defer t.Stop()
 		// 向 follower 发送心跳或者同步日志
 		// 注意：是死循环
 		for {
 			doSend := false
 			select {
-			case <-t.C: // 50ms 以后
+			case <-t.C(): // 50ms 以后
 				doSend = true
 				t.Stop()
 				t.Reset(heartbeatTimeout)
@@ -322,17 +1041,23 @@ func (cm *ConsensusModule) startLeader() {
 				}
 
 				if !t.Stop() {
-					<-t.C
+					<-t.C()
 				}
 				t.Reset(heartbeatTimeout)
 			}
 			if doSend {
 				// 发送心跳
 				cm.mu.Lock()
-				if cm.state != Leader {
+				if cm.state != Leader || cm.epoch != savedEpoch { // 已经不是这一次的 leader
 					cm.mu.Unlock()
 					return
 				}
+				if cm.config.StableLeadership && !cm.checkQuorum() {
+					cm.stepDown(fmt.Sprintf("no quorum in %v", electionTimeoutMin+electionTimeoutRange))
+					cm.mu.Unlock()
+					return
+				}
+				cm.checkCommitStall()
 				cm.mu.Unlock()
 				cm.sendAppendEntries()
 			}
@@ -344,18 +1069,60 @@ func (cm *ConsensusModule) startLeader() {
 func (cm *ConsensusModule) sendAppendEntries() {
 	cm.mu.Lock()
 	savedCurrentTerm := cm.currentTerm
+	savedEpoch := cm.epoch
+	// 单节点集群（或只需要自己就能提交），无需等待任何回复即可提交
+	if cm.replicationQuorum() == 1 && cm.state == Leader && cm.advanceCommitIndex() {
+		cm.logf(LogReplication, LevelDebug, "leader sets commitIndex := %d", cm.commitIndex)
+		cm.signalCommit()
+	}
 	cm.mu.Unlock()
 
+	// 一轮复制的 span，所有 AppendEntries 请求结束后结束
+	round := cm.config.Tracer.StartSpan("raft.replicate", SpanContext{})
+	round.SetAttribute("raft.id", cm.id)
+	round.SetAttribute("raft.term", savedCurrentTerm)
+	var wg sync.WaitGroup
+	wg.Add(len(cm.peerIds))
+	go func() {
+		wg.Wait()
+		round.End()
+	}()
+
 	for _, peerId := range cm.peerIds {
 		go func(peerId int) {
+			defer wg.Done()
 			cm.mu.Lock()
+			// 暂停复制或处于退避中的 peer 跳过本轮，不影响其它 peer 的心跳
+			if cm.paused[peerId] || cm.config.Clock.Now().Before(cm.peerRetryAt[peerId]) {
+				cm.mu.Unlock()
+				return
+			}
 			ni := cm.nextIndex[peerId] // peer 的下一个日志序列
-			preLogIndex := ni - 1      // 上一个日志序列
-			preLogTerm := -1           // 上一个日志任期
-			if preLogIndex >= 0 {
-				preLogTerm = cm.log[preLogIndex].Term
+			// nextIndex 超出了日志的范围，修正后继续，而不是在切片时 panic
+			if ni > cm.logEnd() || (ni < 0 && cm.logBase < 0) {
+				cm.logf(LogReplication, LevelWarn, "nextIndex %d for peer %d out of range [0, %d], clamping", ni, peerId, cm.logEnd())
+				ni = intMax(0, intMin(ni, cm.logEnd()))
+				cm.nextIndex[peerId] = ni
+			}
+			// 需要的日志已经被压缩，改为发送快照
+			if ni <= cm.logBase {
+				cm.mu.Unlock()
+				cm.sendSnapshot(peerId)
+				return
+			}
+			preLogIndex := ni - 1                // 上一个日志序列
+			preLogTerm := cm.termAt(preLogIndex) // 上一个日志任期
+			// peer 已经有了所有日志时只发送心跳，Entries 保持为 nil，无需切片与编码日志
+			var entries []LogEntry
+			if ni < cm.logEnd() {
+				entries = cm.log[cm.logPos(ni):] // 序号后面的都是需要同步的日志
+				// 限制单个请求的大小，剩下的日志在之后的轮次中发送
+				if max := cm.config.MaxAppendEntries; max > 0 && len(entries) > max {
+					entries = entries[:max]
+				}
+				// 释放锁之后才编码发送，复制一份，以免与截断日志时对同一底层数组的覆盖冲突
+				entries = append([]LogEntry(nil), entries...)
 			}
-			entries := cm.log[ni:] // 序号后面的都是需要同步的日志
 
 			args := AppendEntriesArgs{
 				Term:         savedCurrentTerm,
@@ -364,107 +1131,337 @@ func (cm *ConsensusModule) sendAppendEntries() {
 				PrevLogTerm:  preLogTerm,
 				Entries:      entries,
 				LeaderCommit: cm.commitIndex,
+				GroupID:      cm.config.GroupID,
 			}
+			cm.addDivergenceCheck(peerId, &args)
 			cm.mu.Unlock()
-			cm.dlog("sending AppendEntries to %v: ni=%d, args=%+v", peerId, ni, args)
+			span := cm.config.Tracer.StartSpan("raft.AppendEntries.send", round.Context())
+			span.SetAttribute("raft.peer", peerId)
+			span.SetAttribute("raft.entries", len(entries))
+			defer span.End()
+			args.Trace = span.Context()
+			cm.logf(LogReplication, LevelDebug, "sending AppendEntries to %v: ni=%d, args=%+v", peerId, ni, args)
+			sentAt := cm.config.Clock.Now()
 
 			var reply AppendEntriesReply
 			if err := cm.server.Call(peerId, "ConsensusModule.AppendEntries", args, &reply); err == nil {
+				span.SetAttribute("raft.success", reply.Success)
 				cm.mu.Lock()
 				defer cm.mu.Unlock()
+				cm.recordLatency(peerId, "AppendEntries", cm.config.Clock.Now().Sub(sentAt))
+				cm.peerFailures[peerId] = 0 // 成功即重置退避
+				cm.peerRetryAt[peerId] = time.Time{}
+				cm.peerLastContact[peerId] = cm.config.Clock.Now()
+				if cm.termGapExceeded(reply.Term, peerId, "AppendEntries reply") {
+					return
+				}
 				if reply.Term > savedCurrentTerm { // 如果接收者的任期大于 leader 的任期
-					cm.dlog("term out of date in heartbeat reply")
+					cm.logf(LogReplication, LevelDebug, "term out of date in heartbeat reply")
 					cm.becomeFollower(reply.Term) // 那么 leader 转变成为 follower
 					return
 				}
-				// 发送心跳成功
-				if cm.state == Leader && savedCurrentTerm == reply.Term {
+				// 发送心跳成功，且发送后没有再经历过角色变化
+				if cm.state == Leader && savedCurrentTerm == reply.Term && cm.epoch == savedEpoch {
+					// peer 在 sentAt 之后承认了当前 leader，从 sentAt 起最短选举超时内不会投票给别人
+					if sentAt.After(cm.peerLeaseAck[peerId]) {
+						cm.peerLeaseAck[peerId] = sentAt
+					}
 					if reply.Success { // 心跳发送成功
-						cm.nextIndex[peerId] = ni + len(entries)         // 更新 nextIndex
-						cm.matchIndex[peerId] = cm.nextIndex[peerId] - 1 // 更新 matchIndex
-						savedCommitIndex := cm.commitIndex
-						// 从 commitIndex + 1 开始，依次查看，更新 commitIndex
-						for i := cm.commitIndex + 1; i < len(cm.log); i++ {
-							if cm.log[i].Term == cm.currentTerm { // 一定得是当前任期的日志
-								matchCount := 1
-								for _, peerId := range cm.peerIds {
-									if cm.matchIndex[peerId] >= i { // matchIndex >= i 即是日志已经应用
-										matchCount++
-									}
-								}
-								if matchCount*2 > len(cm.peerIds)+1 { // 如果超过半数的 peer 已经应用了日志
-									cm.commitIndex = i // 则更新 commitIndex
-								}
-							}
+						// 回复可能重复或乱序到达，matchIndex 只增不减
+						if match := ni + len(entries) - 1; match > cm.matchIndex[peerId] {
+							cm.matchIndex[peerId] = match
 						}
-						cm.dlog("AppendEntries reply from %d success: nextIndex := %v, matchIndex := %v", peerId, cm.nextIndex, cm.matchIndex)
+						cm.nextIndex[peerId] = intMax(cm.nextIndex[peerId], cm.matchIndex[peerId]+1)
+						updated := cm.advanceCommitIndex()
+						cm.logf(LogReplication, LevelDebug, "AppendEntries reply from %d success: nextIndex := %v, matchIndex := %v", peerId, cm.nextIndex, cm.matchIndex)
 						// 更新了 commitIndex
-						if cm.commitIndex != savedCommitIndex {
-							cm.dlog("leader sets commitIndex := %d", cm.commitIndex)
-							cm.newCommitReadyChan <- struct{}{}
-							cm.triggerAEChan <- struct{}{} // leader 更新 commitIndex 需要发送 AE
+						if updated {
+							cm.logf(LogReplication, LevelDebug, "leader sets commitIndex := %d", cm.commitIndex)
+							cm.signalCommit()
 						}
+						// leader 更新 commitIndex，或者 peer 还有日志没有发送，都需要继续发送 AE
+						if updated || cm.nextIndex[peerId] < cm.logEnd() {
+							cm.triggerAE()
+						}
+					} else if reply.LogEnd >= 0 && reply.LogEnd < ni {
+						// peer 的日志不够长，直接跳到它的日志末尾，不必逐条回退；
+						// 新加入的空节点的末尾在压缩点之前，下一轮会改为发送快照，之后再发送剩下的日志
+						cm.nextIndex[peerId] = intMax(reply.LogEnd, cm.matchIndex[peerId]+1)
+						cm.logf(LogReplication, LevelDebug, "AppendEntries reply from %d failed with log end %d: nextIndex := %d", peerId, reply.LogEnd, cm.nextIndex[peerId])
+						cm.triggerAE()
 					} else {
-						cm.nextIndex[peerId] = ni - 1 // 如果日志同步失败，则向后一步，然后继续下一次同步
-						cm.dlog("AppendEntries reply from %d failed: nextIndex := %d", peerId, ni-1)
+						// 如果日志同步失败，则向后一步，然后继续下一次同步；退到压缩点时会改为发送快照
+						// 已匹配的日志不需要再回退
+						cm.nextIndex[peerId] = intMax(ni-1, cm.matchIndex[peerId]+1)
+						cm.logf(LogReplication, LevelDebug, "AppendEntries reply from %d failed: nextIndex := %d", peerId, cm.nextIndex[peerId])
 					}
 				}
+			} else {
+				cm.mu.Lock()
+				cm.backoffPeer(peerId)
+				cm.mu.Unlock()
 			}
 		}(peerId)
 	}
 }
 
+// 根据 matchIndex 推进 leader 的 commitIndex，返回 commitIndex 是否有更新
+// 需在持有锁的情况下调用
+func (cm *ConsensusModule) advanceCommitIndex() bool {
+	savedCommitIndex := cm.commitIndex
+	// 从 commitIndex + 1 开始，依次查看，更新 commitIndex
+	for i := cm.commitIndex + 1; i < cm.logEnd(); i++ {
+		if cm.termAt(i) == cm.currentTerm { // 一定得是当前任期的日志
+			matchCount := 0
+			// 批量持久化时，leader 自己的日志持久化之后才算一票
+			if cm.config.PersistBatchInterval <= 0 || i < cm.persistedEnd {
+				matchCount = 1
+			}
+			for _, peerId := range cm.voters() {
+				if cm.matchIndex[peerId] >= i { // matchIndex >= i 即是日志已经应用
+					matchCount++
+				}
+			}
+			if matchCount >= cm.replicationQuorum() { // 如果足够多的 peer 已经应用了日志
+				cm.commitIndex = i // 则更新 commitIndex
+			}
+		}
+	}
+	return cm.commitIndex != savedCommitIndex
+}
+
+// 记录一次发送失败，按指数退避并加入随机抖动计算下次发送时间
+// 需在持有锁的情况下调用
+func (cm *ConsensusModule) backoffPeer(peerId int) {
+	cm.peerFailures[peerId]++
+	// 短暂的失败不退避，以免 peer 恢复后迟迟收不到心跳而发起选举
+	if cm.peerFailures[peerId] <= retryBackoffAfter {
+		return
+	}
+	max := cm.config.RetryBackoffMax
+	backoff := cm.config.RetryBackoffBase
+	for i := retryBackoffAfter + 1; i < cm.peerFailures[peerId] && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	// 抖动：[backoff/2, backoff)
+	backoff = backoff/2 + time.Duration(cm.rand.Int63n(int64(backoff/2)))
+	cm.peerRetryAt[peerId] = cm.config.Clock.Now().Add(backoff)
+	cm.logf(LogReplication, LevelDebug, "AppendEntries to %d failed %d times, backoff %v", peerId, cm.peerFailures[peerId], backoff)
+}
+
 //
 // ConsensusModule 状态持久化与恢复
 //
 
-// 持久化数据
-func (cm *ConsensusModule) persistToStorage() {
-	var termData bytes.Buffer
-	if err := gob.NewEncoder(&termData).Encode(cm.currentTerm); err != nil {
-		log.Fatal(err)
+// 持久化数据，需在持有锁的情况下调用
+// 写入失败时按 Config.PersistRetries 重试，仍然失败则进入降级状态并返回错误，见 degrade
+func (cm *ConsensusModule) persistToStorage() error {
+	switch cm.storage.(type) {
+	case NoopStorage, *NoopStorage:
+		cm.persistedEnd = cm.logEnd()
+		cm.finishPersistBatch(nil)
+		return nil // 不需要持久化，无需编码
 	}
-	cm.storage.Set("currentTerm", termData.Bytes())
+	if cm.degraded {
+		return ErrDegraded
+	}
+	if !cm.termDirty && !cm.voteDirty && !cm.logDirty && !cm.snapshotDirty {
+		return nil
+	}
+	batch, err := cm.encodeState()
+	if err != nil {
+		cm.degrade(err)
+		return err
+	}
+	callHook(cm.hooks.beforePersist)
+	// 写入可能因为磁盘的瞬时故障失败，退避后重试
+	backoff := cm.config.PersistRetryBackoff
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		if err = cm.storage.SetBatch(batch); err == nil {
+			cm.termDirty, cm.voteDirty, cm.logDirty, cm.snapshotDirty = false, false, false, false
+			cm.persistedEnd = cm.logEnd()
+			cm.finishPersistBatch(nil) // 等待批量持久化的追加也随之完成
+			return nil
+		}
+		if attempt >= cm.config.PersistRetries || waited >= persistRetryMaxWait {
+			break
+		}
+		if backoff > persistRetryMaxWait-waited {
+			backoff = persistRetryMaxWait - waited
+		}
+		cm.logf(LogPersistence, LevelInfo, "persist failed (attempt %d): %v, retrying in %v", attempt+1, err, backoff)
+		<-cm.config.Clock.NewTimer(backoff).C()
+		waited += backoff
+		backoff *= 2
+	}
+	cm.degrade(err)
+	return err
+}
 
-	var votedData bytes.Buffer
-	if err := gob.NewEncoder(&votedData).Encode(cm.votedFor); err != nil {
-		log.Fatal(err)
+// 编码需要持久化的状态，只包括上次持久化以来改变过的字段
+// 大多数持久化只是追加日志，不必每次都重写任期、投票与快照
+func (cm *ConsensusModule) encodeState() (map[string][]byte, error) {
+	batch := make(map[string][]byte)
+	if cm.termDirty {
+		var termData bytes.Buffer
+		if err := gob.NewEncoder(&termData).Encode(cm.currentTerm); err != nil {
+			return nil, err
+		}
+		batch["currentTerm"] = termData.Bytes()
 	}
-	cm.storage.Set("votedFor", votedData.Bytes())
 
-	var logData bytes.Buffer
-	if err := gob.NewEncoder(&logData).Encode(cm.log); err != nil {
-		log.Fatal(err)
+	if cm.voteDirty {
+		var votedData bytes.Buffer
+		if err := gob.NewEncoder(&votedData).Encode(cm.votedFor); err != nil {
+			return nil, err
+		}
+		batch["votedFor"] = votedData.Bytes()
+	}
+
+	if cm.logDirty {
+		// Command 通过 codec 编码（配置日志项除外，见 commandCodec），其余字段仍使用 gob
+		// 空操作与见证者的日志项没有 Command，无需编码
+		entries := make([]persistedEntry, len(cm.log))
+		for i, entry := range cm.log {
+			var data []byte
+			if entry.Command != nil {
+				var err error
+				if data, err = cm.commandCodec(entry.Type).Encode(entry.Command); err != nil {
+					return nil, err
+				}
+			}
+			entries[i] = persistedEntry{Command: data, Term: entry.Term, Type: entry.Type}
+		}
+		var logData bytes.Buffer
+		if err := gob.NewEncoder(&logData).Encode(persistedLog{
+			BaseIndex: cm.logBase,
+			BaseTerm:  cm.logBaseTerm,
+			Entries:   entries,
+		}); err != nil {
+			return nil, err
+		}
+		batch["log"] = logData.Bytes()
+	}
+
+	// 日志只保存快照之后的部分，压缩日志时快照必须与之一同写入
+	if cm.snapshotDirty {
+		var snapshotData bytes.Buffer
+		if err := gob.NewEncoder(&snapshotData).Encode(persistedSnapshot{
+			Index: cm.snapshotIndex,
+			Term:  cm.snapshotTerm,
+			Data:  cm.snapshot,
+		}); err != nil {
+			return nil, err
+		}
+		batch["snapshot"] = snapshotData.Bytes()
+	}
+
+	// 一起原子写入，避免崩溃时任期、投票、日志与快照不一致
+	return batch, nil
+}
+
+// 持久化失败后进入降级状态，需在持有锁的情况下调用
+// 无法持久化的节点不能再安全地参与共识：如果是 Leader 则退位，之后拒绝提交、不再投票、
+// 不再确认 AppendEntries，也不会发起选举，Healthy 返回 false。降级不可恢复，需要重启节点
+func (cm *ConsensusModule) degrade(err error) {
+	if cm.degraded {
+		return
+	}
+	cm.degraded = true
+	cm.finishPersistBatch(err)
+	cm.logf(LogPersistence, LevelWarn, "persisting state failed, node is degraded: %v", err)
+	if cm.state == Leader {
+		cm.state = Follower
+		cm.epoch++
+		cm.leaderId = -1
+		cm.publishReport()
+		cm.failProposals(0, ErrDegraded)
+		cm.admitCond.Broadcast()
+		cm.resetElectionTimer()
+	}
+	if cb := cm.config.OnPersistError; cb != nil {
+		go cb(err) // 持有锁，在另外的 goroutine 中调用
 	}
-	cm.storage.Set("log", logData.Bytes())
 }
 
 // 恢复数据
-func (cm *ConsensusModule) restoreFromStorage(storage Storage) {
+func (cm *ConsensusModule) restoreFromStorage(storage Storage) error {
 	if termData, found := cm.storage.Get("currentTerm"); found {
 		d := gob.NewDecoder(bytes.NewBuffer(termData))
 		if err := d.Decode(&cm.currentTerm); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	} else {
-		log.Fatal("currentTerm not found in storage")
+		return errors.New("currentTerm not found in storage")
 	}
 	if voteData, found := cm.storage.Get("votedFor"); found {
 		d := gob.NewDecoder(bytes.NewBuffer(voteData))
 		if err := d.Decode(&cm.votedFor); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	} else {
-		log.Fatal("votedFor not found in storage")
+		return errors.New("votedFor not found in storage")
 	}
 	if logData, found := cm.storage.Get("log"); found {
+		var persisted persistedLog
 		d := gob.NewDecoder(bytes.NewBuffer(logData))
-		if err := d.Decode(&cm.log); err != nil {
-			log.Fatal(err)
+		if err := d.Decode(&persisted); err != nil {
+			return err
+		}
+		cm.logBase = persisted.BaseIndex
+		cm.logBaseTerm = persisted.BaseTerm
+		entries := persisted.Entries
+		cm.log = make([]LogEntry, len(entries), intMax(len(entries), cm.config.InitialLogCapacity))
+		for i, entry := range entries {
+			if entry.Command != nil {
+				if err := cm.commandCodec(entry.Type).Decode(entry.Command, &cm.log[i].Command); err != nil {
+					return err
+				}
+			}
+			cm.log[i].Term = entry.Term
+			cm.log[i].Type = entry.Type
 		}
 	} else {
-		log.Fatal("log not found in storage")
+		return errors.New("log not found in storage")
 	}
+	if snapshotData, found := cm.storage.Get("snapshot"); found {
+		var snapshot persistedSnapshot
+		d := gob.NewDecoder(bytes.NewBuffer(snapshotData))
+		if err := d.Decode(&snapshot); err != nil {
+			return err
+		}
+		cm.snapshot = snapshot.Data
+		cm.snapshotIndex = snapshot.Index
+		cm.snapshotTerm = snapshot.Term
+		// 快照中的日志都已提交并应用；客户端的状态机随重启丢失，由 commitLoop 重新交付快照
+		cm.commitIndex = cm.snapshotIndex
+		cm.lastApplied = cm.snapshotIndex
+		cm.snapshotPending = snapshot.Index >= 0
+	}
+	return cm.validateRestored()
+}
+
+// 校验恢复的数据，避免损坏的状态在运行时造成难以察觉的错误
+func (cm *ConsensusModule) validateRestored() error {
+	if cm.currentTerm < 0 {
+		return fmt.Errorf("restored currentTerm %d is negative", cm.currentTerm)
+	}
+	if cm.votedFor != -1 && cm.votedFor != cm.id {
+		known := false
+		for _, peerId := range cm.peerIds {
+			if peerId == cm.votedFor {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("restored votedFor %d is not a known peer", cm.votedFor)
+		}
+	}
+	return nil
 }
 
 //
@@ -477,6 +1474,12 @@ type RequestVoteArgs struct {
 	CandidateId  int // 请求者id
 	LastLogIndex int // 请求者最后一个日志的序号
 	LastLogTerm  int // 请求者最后一个日志的任期
+
+	PreVote            bool // 预投票，Term 为请求者将要使用的任期，接收者不改变自己的状态
+	LeadershipTransfer bool // 由领导权转移发起的选举，不受 leader 租约限制
+
+	GroupID int         // 所属的 Raft 组，见 Config.GroupID
+	Trace   SpanContext // 发送方的 span
 }
 
 // 选举投票回复
@@ -493,26 +1496,80 @@ func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteR
 	if cm.state == Dead {
 		return nil
 	}
+	// 之后的每个返回路径（包括降级、任期差距、租约与预投票的拒绝）都会调用
+	defer callHook(cm.hooks.beforeVoteReply)
+	// 降级的节点无法持久化，不再投票
+	if cm.degraded {
+		reply.Term = cm.currentTerm
+		cm.rejectVote(args, VoteRejectedPersistFailed)
+		return nil
+	}
+	if cm.termGapExceeded(args.Term, args.CandidateId, "RequestVote") {
+		reply.Term = cm.currentTerm
+		cm.rejectVote(args, VoteRejectedTermGap)
+		return nil
+	}
+	span := cm.config.Tracer.StartSpan("raft.RequestVote.handle", args.Trace)
+	span.SetAttribute("raft.id", cm.id)
+	defer span.End()
 	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
-	cm.dlog("RequestVote: %+v [currentTerm=%d, votedFor=%d, log index/term=(%d, %d)]", args, cm.currentTerm, cm.votedFor, lastLogIndex, lastLogTerm)
+	cm.logf(LogElection, LevelDebug, "RequestVote: %+v [currentTerm=%d, votedFor=%d, log index/term=(%d, %d)]", args, cm.currentTerm, cm.votedFor, lastLogIndex, lastLogTerm)
+	logOk := args.LastLogTerm > lastLogTerm || (args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex)
+	// 最短选举超时内还收到过 leader 的请求，说明 leader 仍然存活，拒绝投票，也不更新任期，
+	// 避免一个只与部分节点连通的节点反复发起选举打断健康的 leader
+	if !args.LeadershipTransfer && cm.inLeaderLease() {
+		reply.Term = cm.currentTerm
+		reply.VotedGranted = false
+		cm.rejectVote(args, VoteRejectedLeaderLease)
+		return nil
+	}
+	// 预投票不改变任何状态，只回答如果发起选举是否会投票
+	if args.PreVote {
+		reply.Term = cm.currentTerm
+		reply.VotedGranted = false
+		switch {
+		case args.Term <= cm.currentTerm:
+			cm.rejectVote(args, VoteRejectedStaleTerm)
+		case !logOk:
+			cm.rejectVote(args, VoteRejectedStaleLog)
+		case cm.config.ElectionStrategy.OnVoteRequest(args, cm.electionState()) == VoteDeny:
+			cm.rejectVote(args, VoteRejectedStrategy)
+		default:
+			reply.VotedGranted = true
+		}
+		cm.logf(LogElection, LevelDebug, "... RequestVote (pre-vote): %+v", reply)
+		return nil
+	}
 	// 如果对方的任期大于当前任期，直接变成 Follower
 	if args.Term > cm.currentTerm {
-		cm.dlog("... term out of date in RequestVote")
+		cm.logf(LogElection, LevelDebug, "... term out of date in RequestVote")
 		cm.becomeFollower(args.Term)
 	}
-	// 如果对方的任期等于当前任期 且 （当前未投票 或者 投票的人正是发请求的人）
-	// 那么将当前任期的一票投给请求者
-	if cm.currentTerm == args.Term &&
-		(cm.votedFor == -1 || cm.votedFor == args.CandidateId) &&
-		(args.LastLogTerm > lastLogTerm || (args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex)) {
+	// 如果对方的任期等于当前任期 且 （当前未投票 或者 投票的人正是发请求的人）且日志至少与自己的一样新
+	// 那么将当前任期的一票投给请求者，否则记录拒绝的原因
+	reply.VotedGranted = false
+	switch {
+	case args.Term < cm.currentTerm:
+		cm.rejectVote(args, VoteRejectedStaleTerm)
+	case cm.votedFor != -1 && cm.votedFor != args.CandidateId:
+		cm.rejectVote(args, VoteRejectedAlreadyVoted)
+	case !logOk:
+		cm.rejectVote(args, VoteRejectedStaleLog)
+	case cm.config.ElectionStrategy.OnVoteRequest(args, cm.electionState()) == VoteDeny:
+		cm.rejectVote(args, VoteRejectedStrategy)
+	default:
 		reply.VotedGranted = true
 		cm.votedFor = args.CandidateId
-		cm.electionResetEvent = time.Now() // 票已投，当前选举结束，进入下一个选举
-	} else { // 其它的情况，都不进行投票
+		cm.voteDirty = true
+		cm.electionResetEvent = cm.config.Clock.Now() // 票已投，当前选举结束，进入下一个选举
+	}
+	// 回复之前持久化任期与投票，否则重启后可能在同一任期内再投出一票
+	if err := cm.persistToStorage(); err != nil && reply.VotedGranted {
 		reply.VotedGranted = false
+		cm.rejectVote(args, VoteRejectedPersistFailed)
 	}
 	reply.Term = cm.currentTerm
-	cm.dlog("... RequestVote: %+v", reply)
+	cm.logf(LogElection, LevelDebug, "... RequestVote: %+v", reply)
 	return nil
 }
 
@@ -525,26 +1582,55 @@ type AppendEntriesArgs struct {
 	PrevLogTerm  int        // leader 中当前 peer 的上一个日志任期
 	Entries      []LogEntry // 同步日志
 	LeaderCommit int        // leader commit index
+
+	// 已匹配日志 (CheckFrom, CheckTo] 的校验和，CheckFrom >= CheckTo 表示没有，见 Config.DetectLogDivergence
+	CheckFrom int
+	CheckTo   int
+	CheckHash uint64
+
+	GroupID int         // 所属的 Raft 组，见 Config.GroupID
+	Trace   SpanContext // 发送方的 span
 }
 
 type AppendEntriesReply struct {
 	Term    int  // 回复者任期
 	Success bool // 日志同步是否成功
+	LogEnd  int  // 因日志不够长（没有 PrevLogIndex）而失败时为回复者的日志末尾（最后一个日志序号 + 1），否则为 -1
 }
 
 // 处理追加日志请求
 func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	reply.LogEnd = -1
 	if cm.state == Dead {
 		return nil
 	}
-	cm.dlog("AppendEntries: %+v", args)
+	// 之后的每个返回路径（包括降级、任期差距、请求异常、与已提交日志冲突和持久化失败）都会调用
+	defer callHook(cm.hooks.beforeAppendEntriesReply)
+	// 降级的节点无法持久化，不再确认任何日志
+	if cm.degraded {
+		reply.Term = cm.currentTerm
+		return nil
+	}
+	if cm.termGapExceeded(args.Term, args.LeaderId, "AppendEntries") {
+		reply.Term = cm.currentTerm
+		return nil
+	}
+	span := cm.config.Tracer.StartSpan("raft.AppendEntries.handle", args.Trace)
+	span.SetAttribute("raft.id", cm.id)
+	defer span.End()
+	cm.logf(LogReplication, LevelDebug, "AppendEntries: %+v", args)
 	// 如果请求者的任期比我大，直接成为 Follower
 	if args.Term > cm.currentTerm {
-		cm.dlog("... term out of date in AppendEntries")
+		cm.logf(LogReplication, LevelDebug, "... term out of date in AppendEntries")
 		cm.becomeFollower(args.Term)
 	}
+	// 新的任期没能持久化，节点已经降级
+	if cm.degraded {
+		reply.Term = cm.currentTerm
+		return nil
+	}
 	reply.Success = false
 	if args.Term == cm.currentTerm { // 任期相同
 		//Q: What if this peer is a leader - why does it become a follower to another leader?
@@ -554,46 +1640,102 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 		// you'll see that two leaders can't exist in the cluster with the same term.
 		// This condition is important for candidates that find out that
 		// another peer won the election for this term.
+		if cm.state == Leader {
+			cm.duplicateLeaderDetected(args.LeaderId)
+		}
 		if cm.state != Follower { // 收到了心跳请求，但是我不是 Follower，那么直接成为 Follower
 			cm.becomeFollower(args.Term)
 		}
 		// 收到了 leader 心跳，则重置选举时间
-		cm.electionResetEvent = time.Now()
+		cm.electionResetEvent = cm.config.Clock.Now()
+		cm.lastLeaderContact = cm.electionResetEvent
+		cm.leaderId = args.LeaderId
+
+		// 日志项不带序号，依次对应 PrevLogIndex 之后的位置，先检查它们能否构成合法的日志，
+		// 以免出错的 leader 或传输层破坏本地日志
+		if err := validateAppendEntries(args); err != nil {
+			cm.logf(LogReplication, LevelWarn, "malformed AppendEntries from %d, rejecting: %v", args.LeaderId, err)
+			reply.Success = false
+			reply.Term = cm.currentTerm
+			return nil
+		}
+		cm.leaderCommit = args.LeaderCommit
+
+		// 被压缩的日志都已提交，必然与 leader 一致，跳过这部分
+		if args.PrevLogIndex < cm.logBase {
+			skip := intMin(cm.logBase-args.PrevLogIndex, len(args.Entries))
+			args.Entries = args.Entries[skip:]
+			args.PrevLogIndex = cm.logBase
+			args.PrevLogTerm = cm.logBaseTerm
+		}
 
 		if args.PrevLogIndex == -1 || // -1 代表未同步过日志
 			// 同步的日志序号小于当前端点的日志长度 且 同步的任期与日志的任期是一致的
-			(args.PrevLogIndex < len(cm.log) && args.PrevLogTerm == cm.log[args.PrevLogIndex].Term) {
-			reply.Success = true                    // 心跳成功
+			(args.PrevLogIndex < cm.logEnd() && args.PrevLogTerm == cm.termAt(args.PrevLogIndex)) {
 			logInsertIndex := args.PrevLogIndex + 1 // 插入日志的序号
 			newEntriesIndex := 0                    // Entries 序号，与 logInsertIndex 一一对应
 
 			for {
-				if logInsertIndex >= len(cm.log) || newEntriesIndex >= len(args.Entries) {
+				if logInsertIndex >= cm.logEnd() || newEntriesIndex >= len(args.Entries) {
 					break
 				}
-				if cm.log[logInsertIndex].Term != args.Entries[newEntriesIndex].Term {
+				if cm.termAt(logInsertIndex) != args.Entries[newEntriesIndex].Term {
 					break
 				}
 				logInsertIndex++
 				newEntriesIndex++
 			}
-			// 待插入的日志个数得小于心跳中的日志数量
+			// 已提交的日志不可能与 leader 冲突，出现冲突说明这是一个异常的请求，拒绝而不是截断
+			if newEntriesIndex < len(args.Entries) && logInsertIndex < cm.logEnd() && logInsertIndex <= cm.commitIndex {
+				cm.logf(LogReplication, LevelWarn, "AppendEntries from %d conflicts with committed index %d (commitIndex=%d), rejecting", args.LeaderId, logInsertIndex, cm.commitIndex)
+				reply.Term = cm.currentTerm
+				return nil
+			}
+			// 请求中的日志都已存在时（重复或延迟到达的请求），不做任何截断，
+			// 以免丢掉之后的请求追加的日志；只有出现冲突时才从冲突处截断
 			if newEntriesIndex < len(args.Entries) {
-				cm.dlog("... inserting entries %v from index %d", args.Entries[newEntriesIndex:], logInsertIndex)
-				cm.log = append(cm.log[:logInsertIndex], args.Entries[newEntriesIndex:]...)
-				cm.dlog("... log is now: %v", cm.log)
+				cm.logf(LogReplication, LevelDebug, "... inserting entries %v from index %d", args.Entries[newEntriesIndex:], logInsertIndex)
+				newEntries := args.Entries[newEntriesIndex:]
+				if cm.config.Witness { // 见证者只保存任期，丢弃 Command
+					newEntries = make([]LogEntry, len(args.Entries)-newEntriesIndex)
+					for i, entry := range args.Entries[newEntriesIndex:] {
+						newEntries[i] = LogEntry{Term: entry.Term, Type: entry.Type}
+					}
+				}
+				// 被覆盖的日志不会再被提交，通知等待它们的提案
+				if logInsertIndex < cm.logEnd() {
+					cm.failProposals(logInsertIndex, ErrDropped)
+				}
+				cm.log = append(cm.log[:cm.logPos(logInsertIndex)], newEntries...)
+				cm.truncateLogHashes(cm.logPos(logInsertIndex))
+				cm.logDirty = true
+				// 确认之前先持久化新日志，失败时不能确认
+				if err := cm.persistToStorage(); err != nil {
+					reply.Term = cm.currentTerm
+					return nil
+				}
+				cm.logf(LogReplication, LevelDebug, "... log is now: %v", cm.log)
 			}
-			// 如果 leader 的提交序号大于当前节点的提交序号
-			if args.LeaderCommit > cm.commitIndex {
-				cm.commitIndex = intMin(args.LeaderCommit, len(cm.log)-1) // 更新 commitIndex
-				cm.dlog("... setting commitIndex=%d", cm.commitIndex)
-				cm.newCommitReadyChan <- struct{}{}
+			// 如果 leader 的提交序号大于当前节点的提交序号，则更新 commitIndex
+			// 只能提交到本次请求确认过的最后一条日志，之后的日志可能与 leader 不一致，
+			// 且 commitIndex 永远不能回退
+			cm.verifyDivergenceCheck(args)
+			lastNewIndex := args.PrevLogIndex + len(args.Entries)
+			if newCommitIndex := intMin(args.LeaderCommit, lastNewIndex); newCommitIndex > cm.commitIndex {
+				cm.commitIndex = newCommitIndex
+				cm.logf(LogReplication, LevelDebug, "... setting commitIndex=%d", cm.commitIndex)
+				cm.signalCommit()
 			}
+			// 任期（becomeFollower 中）与日志都已持久化，可以确认
+			reply.Success = true
+		} else if args.PrevLogIndex >= cm.logEnd() {
+			// 日志比 leader 以为的短，告诉 leader 日志的末尾，让它直接从那里开始发送
+			reply.LogEnd = cm.logEnd()
 		}
 	}
 
 	reply.Term = cm.currentTerm
-	cm.dlog("AppendEntries reply: %+v", *reply)
+	cm.logf(LogReplication, LevelDebug, "AppendEntries reply: %+v", *reply)
 	return nil
 }
 
@@ -601,29 +1743,79 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 // ConsensusModule 基础函数
 //
 
+// 同一任期出现了两个 leader，违反了 Raft 的安全性，通常是配置错误（例如 id 重复）导致的
+// 记录次数并打印警告，调用者随后转为 Follower，需在持有锁的情况下调用
+func (cm *ConsensusModule) duplicateLeaderDetected(otherId int) {
+	cm.duplicateLeaders++
+	cm.logf(LogElection, LevelWarn, "duplicate leader detected in term %d: %d also claims leadership", cm.currentTerm, otherId)
+}
+
 // 获得最后的日志序号和任期
+// 日志全部被压缩进快照时，返回压缩点（不早于快照包含的最后一条日志）的序号与任期，
+// 而不是 -1，否则投票时这个节点会被当作没有任何数据
 func (cm *ConsensusModule) lastLogIndexAndTerm() (int, int) {
 	if len(cm.log) > 0 {
-		lastIndex := len(cm.log) - 1
-		return lastIndex, cm.log[lastIndex].Term
+		lastIndex := cm.logEnd() - 1
+		return lastIndex, cm.log[len(cm.log)-1].Term
 	} else {
-		return -1, -1 // -1 表示还没有任何数据
+		return cm.logBase, cm.logBaseTerm // 没有压缩时为 -1，表示还没有任何数据
+	}
+}
+
+// 下一个日志序号，即最后一个日志序号 + 1
+func (cm *ConsensusModule) logEnd() int {
+	return cm.logBase + 1 + len(cm.log)
+}
+
+// 以 entries 的副本新建日志切片，容量至少为 Config.InitialLogCapacity，
+// 压缩日志之后不必从很小的容量重新扩容
+func (cm *ConsensusModule) newLog(entries []LogEntry) []LogEntry {
+	if cm.config.InitialLogCapacity <= 0 {
+		return append([]LogEntry(nil), entries...)
+	}
+	newLog := make([]LogEntry, len(entries), intMax(len(entries), cm.config.InitialLogCapacity))
+	copy(newLog, entries)
+	return newLog
+}
+
+// 日志序号在 cm.log 中的位置
+func (cm *ConsensusModule) logPos(index int) int {
+	return index - cm.logBase - 1
+}
+
+// 日志序号对应的任期，index 不能小于 logBase
+func (cm *ConsensusModule) termAt(index int) int {
+	if index == cm.logBase {
+		return cm.logBaseTerm
 	}
+	return cm.log[cm.logPos(index)].Term
 }
 
-// 随机返回选举超时时间，150ms ～ 300ms
+// 随机返回选举超时时间，150ms ～ 300ms，启动后的第一次再额外增加 electionBootDelay，
+// 配置了选举优先级时再加上 priorityDelay
+// 需在持有锁的情况下调用
 func (cm *ConsensusModule) electionTimeout() time.Duration {
-	if len(os.Getenv("RAFT_FORCE_MORE_REELECTION")) > 0 && rand.Intn(3) == 0 {
-		return time.Duration(150) * time.Millisecond
+	var d time.Duration
+	if len(os.Getenv("RAFT_FORCE_MORE_REELECTION")) > 0 && cm.rand.Intn(3) == 0 {
+		d = electionTimeoutMin
 	} else {
-		return time.Duration(150+rand.Intn(150)) * time.Millisecond
+		d = electionTimeoutMin + time.Duration(cm.rand.Int63n(int64(electionTimeoutRange)))
 	}
+	if cm.booting {
+		cm.booting = false
+		d += electionBootDelay
+	}
+	return d + cm.priorityDelay()
 }
 
-// Debug 输出日志信息
-func (cm *ConsensusModule) dlog(format string, args ...interface{}) {
-	if DebugCM > 0 {
-		format = fmt.Sprintf("[%d] ", cm.id) + format
-		log.Printf(format, args...)
+// 优先级带来的额外选举超时，每有一个优先级更高的投票节点增加 electionTimeoutRange
+func (cm *ConsensusModule) priorityDelay() time.Duration {
+	priority := cm.config.Priorities[cm.id]
+	higher := 0
+	for _, peerId := range cm.voters() {
+		if cm.config.Priorities[peerId] > priority {
+			higher++
+		}
 	}
+	return time.Duration(higher) * electionTimeoutRange
 }
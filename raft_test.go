@@ -3,6 +3,23 @@
 package raft
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	mathrand "math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -390,6 +407,600 @@ func TestCommitsWithLeaderDisconnects(t *testing.T) {
 	h.CheckNotCommitted(7)
 }
 
+func TestCommitBurst(t *testing.T) {
+	commitChan := make(chan CommitEntry)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	const n = 2000
+	cm.mu.Lock()
+	for i := 0; i < n; i++ {
+		cm.log = append(cm.log, LogEntry{Command: i, Term: 1})
+	}
+	cm.mu.Unlock()
+
+	// Nobody reads commitChan yet, so commitLoop is stuck delivering; signalling
+	// every single commit must still never block the caller holding the lock.
+	signalled := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			cm.mu.Lock()
+			cm.commitIndex = i
+			cm.signalCommit()
+			cm.mu.Unlock()
+		}
+		close(signalled)
+	}()
+	select {
+	case <-signalled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("signalCommit blocked with commitChan full")
+	}
+
+	// The coalesced signals still deliver every entry, in order.
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-commitChan:
+			if e.Command != i || e.Index != i {
+				t.Fatalf("commit %d got %+v", i, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for commit %d", i)
+		}
+	}
+}
+
+func TestReplicationQuorumSize(t *testing.T) {
+	// Writes need every node; elections still need a majority.
+	h := NewHarnessWithConfig(t, 3, &Config{ReplicationQuorumSize: 3, ElectionQuorumSize: 2})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+	h.CheckNotCommitted(5)
+
+	// Leadership may change after the reconnect, and an entry from an earlier
+	// term only commits along with one from the current term.
+	h.ReconnectPeer(otherId)
+	sleepMs(250)
+	newLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(newLeaderId, 6)
+	sleepMs(250)
+	h.CheckCommittedN(5, 3)
+	h.CheckCommittedN(6, 3)
+}
+
+func TestPauseReplication(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[origLeaderId].cm
+	pausedId := (origLeaderId + 1) % 3
+	otherId := (origLeaderId + 2) % 3
+
+	// Resume before the paused follower's election timeout runs out.
+	if err := leader.PauseReplication(pausedId); err != nil {
+		t.Fatalf("PauseReplication(%d) = %v, want nil", pausedId, err)
+	}
+	// Pausing the only other follower would leave the leader alone, which can't commit.
+	if err := leader.PauseReplication(otherId); err != ErrPauseBreaksQuorum {
+		t.Errorf("PauseReplication(%d) = %v, want ErrPauseBreaksQuorum", otherId, err)
+	}
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(80)
+	if !leader.ReplicationStatus()[pausedId].Paused {
+		t.Errorf("want peer %d reported as paused", pausedId)
+	}
+	h.mu.Lock()
+	nLeader, nOther, nPaused := len(h.commits[origLeaderId]), len(h.commits[otherId]), len(h.commits[pausedId])
+	h.mu.Unlock()
+	if nLeader != 1 || nOther != 1 || nPaused != 0 {
+		t.Errorf("got commits leader=%d, other=%d, paused=%d; want 1, 1, 0", nLeader, nOther, nPaused)
+	}
+
+	leader.ResumeReplication(pausedId)
+	sleepMs(50)
+	h.CheckCommittedN(5, 3)
+}
+
+func TestPausedPeerMatchCounts(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.log = []LogEntry{{Command: 1, Term: 1}}
+	cm.matchIndex = map[int]int{1: 0, 2: -1}
+	cm.paused[1] = true
+
+	// Peer 1 acknowledged the entry before it was paused; its copy still counts.
+	if !cm.advanceCommitIndex() || cm.commitIndex != 0 {
+		t.Errorf("commitIndex = %d, want 0 counting the paused peer's match", cm.commitIndex)
+	}
+}
+
+func TestLastContact(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[origLeaderId].cm
+	otherId := (origLeaderId + 1) % 3
+	sleepMs(100)
+	if since := time.Since(leader.LastContact(otherId)); since > 100*time.Millisecond {
+		t.Errorf("LastContact(%d) was %v ago, want within a heartbeat", otherId, since)
+	}
+	if got := h.cluster[otherId].cm.LastContact(origLeaderId); !got.IsZero() {
+		t.Errorf("follower LastContact = %v, want zero", got)
+	}
+
+	h.DisconnectPeer(otherId)
+	sleepMs(200)
+	if since := time.Since(leader.LastContact(otherId)); since < 150*time.Millisecond {
+		t.Errorf("LastContact(%d) was %v ago after disconnect, want at least 150ms", otherId, since)
+	}
+}
+
+func TestForceElection(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	if err := h.cluster[otherId].cm.ForceElection(); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(100)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId != otherId || newTerm <= origTerm {
+		t.Errorf("got leader %d in term %d, want %d in a term after %d", newLeaderId, newTerm, otherId, origTerm)
+	}
+
+	h.CrashPeer(origLeaderId)
+	if err := h.cluster[origLeaderId].cm.ForceElection(); err != ErrStopped {
+		t.Errorf("ForceElection on a stopped node: got %v, want ErrStopped", err)
+	}
+}
+
+func TestElectionEvents(t *testing.T) {
+	var mu sync.Mutex
+	results := make(map[int][]ElectionResult)
+	h := NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		return &Config{
+			OnElection: func(r ElectionResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				results[id] = append(results[id], r)
+			},
+		}
+	})
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	sleepMs(50)
+	mu.Lock()
+	won := false
+	for _, r := range results[origLeaderId] {
+		if r.Outcome == ElectionWon && r.Term == origTerm && r.Votes >= 2 {
+			won = true
+		}
+	}
+	if !won {
+		t.Errorf("leader %d reported %v, want a win in term %d", origLeaderId, results[origLeaderId], origTerm)
+	}
+	mu.Unlock()
+
+	// An isolated follower keeps campaigning without ever getting a result.
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	sleepMs(1000)
+	mu.Lock()
+	defer mu.Unlock()
+	timedOut := 0
+	for _, r := range results[otherId] {
+		if r.Outcome == ElectionWon {
+			t.Errorf("isolated peer %d won an election: %+v", otherId, r)
+		}
+		if r.Outcome == ElectionTimedOut {
+			timedOut++
+		}
+	}
+	if timedOut == 0 {
+		t.Errorf("isolated peer %d reported %v, want timed out elections", otherId, results[otherId])
+	}
+}
+
+func TestSubmitIfIndex(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	cm := h.cluster[origLeaderId].cm
+	index, ok := cm.SubmitIfIndex(-1, 5)
+	if !ok || index != 0 {
+		t.Fatalf("SubmitIfIndex(-1) = %d, %v; want 0, true", index, ok)
+	}
+	// A stale expectation fails without appending anything.
+	if _, ok := cm.SubmitIfIndex(-1, 6); ok {
+		t.Errorf("SubmitIfIndex succeeded with a stale last index")
+	}
+	if index, ok := cm.SubmitIfIndex(0, 7); !ok || index != 1 {
+		t.Errorf("SubmitIfIndex(0) = %d, %v; want 1, true", index, ok)
+	}
+	otherId := (origLeaderId + 1) % 3
+	if _, ok := h.cluster[otherId].cm.SubmitIfIndex(1, 8); ok {
+		t.Errorf("SubmitIfIndex succeeded on a follower")
+	}
+
+	sleepMs(250)
+	h.CheckCommittedN(5, 3)
+	h.CheckCommittedN(7, 3)
+	h.CheckNotCommitted(6)
+	h.CheckNotCommitted(8)
+}
+
+func TestForwardSubmit(t *testing.T) {
+	h := NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		return &Config{ForwardSubmit: true}
+	})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	sleepMs(100) // let the follower learn who the leader is
+	if !h.SubmitToServer(otherId, 5) {
+		t.Fatalf("Submit to follower %d was not forwarded", otherId)
+	}
+	// Requests that already used up their hops are not forwarded again.
+	if h.cluster[otherId].cm.submit(6, maxForwardHops) {
+		t.Errorf("submit forwarded past the hop limit")
+	}
+
+	sleepMs(250)
+	h.CheckCommittedN(5, 3)
+	h.CheckNotCommitted(6)
+}
+
+func TestDrain(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	for i := 5; i < 8; i++ {
+		h.SubmitToServer(origLeaderId, i)
+	}
+	cm := h.cluster[origLeaderId].cm
+	done := cm.Drain()
+	if h.SubmitToServer(origLeaderId, 8) {
+		t.Errorf("Submit succeeded while draining")
+	}
+	if _, err := cm.ProposeAndWait(context.Background(), 9); err != ErrNotLeader {
+		t.Errorf("ProposeAndWait while draining: got %v, want ErrNotLeader", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not finish")
+	}
+	// Everything appended before draining reached the leader's client.
+	h.mu.Lock()
+	delivered := len(h.commits[origLeaderId])
+	h.mu.Unlock()
+	if delivered != 3 {
+		t.Errorf("leader delivered %d commits when drained, want 3", delivered)
+	}
+	if _, _, isLeader := cm.Report(); !isLeader {
+		t.Errorf("draining moved leadership away")
+	}
+	sleepMs(150)
+	h.CheckCommittedN(7, 3)
+	h.CheckNotCommitted(8)
+	h.CheckNotCommitted(9)
+}
+
+func TestMultipleGroups(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// Run a second raft group over the same servers and connections.
+	ready := make(chan interface{})
+	groupCommits := make([]chan CommitEntry, 3)
+	groups := make([]*ConsensusModule, 3)
+	for i := 0; i < 3; i++ {
+		peerIds := make([]int, 0)
+		for p := 0; p < 3; p++ {
+			if p != i {
+				peerIds = append(peerIds, p)
+			}
+		}
+		groupCommits[i] = make(chan CommitEntry, 16)
+		cm, err := h.cluster[i].AddGroup(1, peerIds, NewMapStorage(), ready, groupCommits[i], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups[i] = cm
+	}
+	if _, err := h.cluster[0].AddGroup(1, []int{1, 2}, NewMapStorage(), ready, make(chan CommitEntry), nil); err == nil {
+		t.Errorf("adding group 1 twice succeeded")
+	}
+	close(ready)
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+
+	var groupLeader *ConsensusModule
+	for r := 0; r < 10 && groupLeader == nil; r++ {
+		sleepMs(100)
+		for _, cm := range groups {
+			if _, _, isLeader := cm.Report(); isLeader {
+				groupLeader = cm
+			}
+		}
+	}
+	if groupLeader == nil {
+		t.Fatal("group 1 elected no leader")
+	}
+	if !groupLeader.Submit(50) {
+		t.Fatal("Submit to group 1 leader failed")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case c := <-groupCommits[i]:
+			if c.Command != 50 {
+				t.Errorf("group 1 on server %d committed %v, want 50", i, c.Command)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("group 1 on server %d committed nothing", i)
+		}
+	}
+
+	// The groups keep separate logs.
+	sleepMs(150)
+	h.CheckCommittedN(5, 3)
+	h.CheckNotCommitted(50)
+	if h.cluster[1].Group(1) != groups[1] || h.cluster[1].Group(2) != nil {
+		t.Errorf("Group returned the wrong modules")
+	}
+}
+
+func TestStepDown(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	otherId := (origLeaderId + 1) % 3
+	if err := h.cluster[otherId].cm.StepDown(); err != ErrNotLeader {
+		t.Errorf("StepDown on a follower: got %v, want ErrNotLeader", err)
+	}
+	if err := h.cluster[origLeaderId].cm.StepDown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, term, isLeader := h.cluster[origLeaderId].cm.Report(); isLeader || term != origTerm {
+		t.Errorf("after StepDown got isLeader=%v term=%d, want a follower in term %d", isLeader, term, origTerm)
+	}
+
+	// Heartbeats stop, so a new election picks a leader in a later term and the
+	// cluster keeps working; the old leader takes part as usual.
+	sleepMs(450)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newTerm <= origTerm {
+		t.Errorf("got term %d after StepDown, want a term after %d", newTerm, origTerm)
+	}
+	h.SubmitToServer(newLeaderId, 6)
+	sleepMs(250)
+	h.CheckCommittedN(6, 3)
+}
+
+func TestMaxAppendEntries(t *testing.T) {
+	h := NewHarnessWithConfig(t, 3, &Config{MaxAppendEntries: 2})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	for cmd := 1; cmd <= 15; cmd++ {
+		h.SubmitToServer(origLeaderId, cmd)
+	}
+	sleepMs(250)
+	h.CheckCommittedN(15, 2)
+
+	// The reconnected follower catches up two entries per round. It has bumped
+	// its term, so leadership may change first; poll until it has everything.
+	h.ReconnectPeer(otherId)
+	for r := 0; r < 20; r++ {
+		sleepMs(250)
+		h.mu.Lock()
+		n := len(h.commits[otherId])
+		h.mu.Unlock()
+		if n == 15 {
+			break
+		}
+	}
+	h.CheckSingleLeader()
+	h.CheckCommittedN(15, 3)
+}
+
+func TestTriggerAECoalesces(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	cm := h.cluster[origLeaderId].cm
+
+	// Triggers beyond the one already pending must be no-ops, not block until
+	// the heartbeat loop drains the channel.
+	done := make(chan struct{})
+	go func() {
+		cm.mu.Lock()
+		for i := 0; i < 100; i++ {
+			cm.triggerAE()
+		}
+		cm.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("triggerAE blocked with a trigger already pending")
+	}
+}
+
+func TestSubmitNoTrigger(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	for want := 0; want < 3; want++ {
+		if index, ok := cm.SubmitNoTrigger(want); !ok || index != want {
+			t.Errorf("got index=%d ok=%v, want %d and true", index, ok, want)
+		}
+	}
+	if n := len(cm.triggerAEChan); n != 0 {
+		t.Errorf("SubmitNoTrigger left %d triggers pending, want 0", n)
+	}
+	cm.FlushTriggers()
+	cm.FlushTriggers()
+	if n := len(cm.triggerAEChan); n != 1 {
+		t.Errorf("got %d triggers pending after FlushTriggers, want 1", n)
+	}
+}
+
+func TestMaxPendingProposals(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.config.MaxPendingProposals = 2
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	if !cm.Submit(1) || !cm.Submit(2) {
+		t.Fatalf("Submit failed below the limit")
+	}
+	if n := cm.PendingProposals(); n != 2 {
+		t.Errorf("PendingProposals = %d, want 2", n)
+	}
+	if cm.Submit(3) {
+		t.Errorf("Submit succeeded with 2 entries pending")
+	}
+	if err := cm.SubmitWithCallback(3, func(CommitEntry, error) {}); err != ErrTooManyPending {
+		t.Errorf("SubmitWithCallback got err %v, want ErrTooManyPending", err)
+	}
+
+	// Committing one entry makes room for exactly one more.
+	cm.mu.Lock()
+	cm.commitIndex = 0
+	cm.signalCommit()
+	cm.mu.Unlock()
+	if !cm.Submit(3) {
+		t.Errorf("Submit failed after the commit index advanced")
+	}
+
+	// With BlockOnPendingLimit the proposal waits for the commit index instead.
+	cm.mu.Lock()
+	cm.config.BlockOnPendingLimit = true
+	cm.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := cm.ProposeAndWait(context.Background(), 4)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("ProposeAndWait returned %v while over the limit, want it to block", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cm.mu.Lock()
+	cm.becomeFollower(2)
+	cm.mu.Unlock()
+	if err := <-done; err != ErrNotLeader {
+		t.Errorf("blocked ProposeAndWait got err %v after stepping down, want ErrNotLeader", err)
+	}
+	if n := cm.PendingProposals(); n != 0 {
+		t.Errorf("follower PendingProposals = %d, want 0", n)
+	}
+}
+
+func TestUncommittedEntries(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	if got := cm.UncommittedEntries(); got != nil {
+		t.Errorf("follower returned %v, want nil", got)
+	}
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.log = []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}}
+	cm.commitIndex = 0
+	cm.mu.Unlock()
+
+	got := cm.UncommittedEntries()
+	if fmt.Sprint(got) != "[{2 1 Normal} {3 1 Normal}]" {
+		t.Errorf("got %v, want entries 2 and 3", got)
+	}
+	// The result is a copy.
+	got[0].Command = 42
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.log[1].Command != 2 {
+		t.Errorf("changing the result changed the log to %v", cm.log)
+	}
+}
+
+func TestCommitStalled(t *testing.T) {
+	stalls := make(chan CommitStall, 10)
+	h := NewHarnessWithConfig(t, 3, &Config{
+		CommitStallTimeout: 200 * time.Millisecond,
+		OnCommitStalled:    func(s CommitStall) { stalls <- s },
+	})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(350)
+	h.CheckCommittedN(5, 3)
+	select {
+	case s := <-stalls:
+		t.Fatalf("got stall %+v while the cluster is healthy", s)
+	default:
+	}
+
+	// Without its followers the leader can't commit anything new.
+	h.DisconnectPeer((origLeaderId + 1) % 3)
+	h.DisconnectPeer((origLeaderId + 2) % 3)
+	h.SubmitToServer(origLeaderId, 6)
+	select {
+	case s := <-stalls:
+		if s.LastLogIndex <= s.CommitIndex || len(s.MatchIndex) != 2 {
+			t.Errorf("got stall %+v, want entries after commitIndex and two peers", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no stall reported")
+	}
+	// A stall is only reported once.
+	sleepMs(300)
+	if n := len(stalls); n != 0 {
+		t.Errorf("got %d more stall reports, want none", n)
+	}
+}
+
 func TestCrashFollower(t *testing.T) {
 	// Basic test to verify that crashing a peer doesn't blow up.
 	defer leaktest.CheckTimeout(t, 100*time.Millisecond)()
@@ -471,24 +1082,59 @@ func TestCrashThenRestartLeader(t *testing.T) {
 	}
 }
 
-func TestCrashThenRestartAll(t *testing.T) {
+func TestAcknowledgedEntrySurvivesFollowerCrash(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 100*time.Millisecond)()
 
 	h := NewHarness(t, 3)
 	defer h.Shutdown()
 
 	origLeaderId, _ := h.CheckSingleLeader()
+	laggingId := (origLeaderId + 1) % 3
+	ackId := (origLeaderId + 2) % 3
+	h.CrashPeer(laggingId)
+
+	// Only ackId acknowledges 5, so its copy is what makes 5 committed.
 	h.SubmitToServer(origLeaderId, 5)
-	h.SubmitToServer(origLeaderId, 6)
-	h.SubmitToServer(origLeaderId, 7)
+	sleepMs(250)
+	h.CheckCommittedN(5, 2)
 
-	vals := []int{5, 6, 7}
+	// ackId crashes right after acknowledging, and the old leader is gone. The
+	// restarted ackId must still have 5, or the lagging node could win and
+	// overwrite a committed entry.
+	h.CrashPeer(origLeaderId)
+	h.CrashPeer(ackId)
+	h.RestartPeer(ackId)
+	h.RestartPeer(laggingId)
 
-	sleepMs(350)
-	for _, v := range vals {
-		h.CheckCommittedN(v, 3)
+	sleepMs(450)
+	newLeaderId, _ := h.CheckSingleLeader()
+	if newLeaderId != ackId {
+		t.Errorf("leader is %d, want %d which has the committed entry", newLeaderId, ackId)
 	}
-
+	h.SubmitToServer(newLeaderId, 6)
+	sleepMs(250)
+	h.CheckCommittedN(5, 2)
+	h.CheckCommittedN(6, 2)
+}
+
+func TestCrashThenRestartAll(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 100*time.Millisecond)()
+
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	h.SubmitToServer(origLeaderId, 6)
+	h.SubmitToServer(origLeaderId, 7)
+
+	vals := []int{5, 6, 7}
+
+	sleepMs(350)
+	for _, v := range vals {
+		h.CheckCommittedN(v, 3)
+	}
+
 	for i := 0; i < 3; i++ {
 		h.CrashPeer((origLeaderId + i) % 3)
 	}
@@ -608,3 +1254,3359 @@ func TestCrashAfterSubmit(t *testing.T) {
 	h.CheckCommittedN(5, 3)
 	h.CheckCommittedN(6, 3)
 }
+
+// intCodec encodes int commands as decimal strings, to check that persistence
+// goes through the configured Codec rather than gob.
+type intCodec struct{}
+
+func (intCodec) Encode(command interface{}) ([]byte, error) {
+	return []byte(strconv.Itoa(command.(int))), nil
+}
+
+func (intCodec) Decode(data []byte, command *interface{}) error {
+	v, err := strconv.Atoi(string(data))
+	if err != nil {
+		return err
+	}
+	*command = v
+	return nil
+}
+
+func TestCustomCodecRestart(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 100*time.Millisecond)()
+
+	h := NewHarnessWithConfig(t, 3, &Config{Codec: intCodec{}})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	h.SubmitToServer(origLeaderId, 6)
+
+	sleepMs(350)
+	h.CheckCommittedN(6, 3)
+
+	// The restarted leader decodes its log from storage with intCodec.
+	h.CrashPeer(origLeaderId)
+	sleepMs(350)
+	h.RestartPeer(origLeaderId)
+	sleepMs(550)
+	for _, v := range []int{5, 6} {
+		h.CheckCommittedN(v, 3)
+	}
+}
+
+func TestWitness(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 100*time.Millisecond)()
+
+	const witnessId = 2
+	h := NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		return &Config{Witness: id == witnessId}
+	})
+	defer h.Shutdown()
+
+	// committed reports whether cmd was delivered on server i's commitChan.
+	committed := func(i int, cmd int) bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, c := range h.commits[i] {
+			if c.Command == cmd {
+				return true
+			}
+		}
+		return false
+	}
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	if origLeaderId == witnessId {
+		t.Fatalf("witness %d became leader", witnessId)
+	}
+	otherId := 1 - origLeaderId
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+	if !committed(origLeaderId, 5) || !committed(otherId, 5) {
+		t.Errorf("5 not committed on both full nodes")
+	}
+
+	// With one full node down, the witness's vote still elects the other full
+	// node and makes up the quorum for commits.
+	h.CrashPeer(origLeaderId)
+	sleepMs(450)
+	newLeaderId, _ := h.CheckSingleLeader()
+	if newLeaderId != otherId {
+		t.Fatalf("leader is %d, want full node %d", newLeaderId, otherId)
+	}
+	h.SubmitToServer(newLeaderId, 6)
+	sleepMs(250)
+	if !committed(newLeaderId, 6) {
+		t.Errorf("6 not committed with a full node down")
+	}
+
+	h.mu.Lock()
+	if n := len(h.commits[witnessId]); n != 0 {
+		t.Errorf("witness delivered %d commits, want none", n)
+	}
+	h.mu.Unlock()
+
+	witness := h.cluster[witnessId].cm
+	witness.mu.Lock()
+	defer witness.mu.Unlock()
+	if len(witness.log) != 2 {
+		t.Errorf("witness log = %v, want 2 entries", witness.log)
+	}
+	for i, entry := range witness.log {
+		if entry.Command != nil || entry.Term <= 0 || entry.Type != EntryNormal {
+			t.Errorf("witness log[%d] = %+v, want a term and type but no command", i, entry)
+		}
+	}
+}
+
+func TestMapStorageSetBatch(t *testing.T) {
+	ms := NewMapStorage()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			v := []byte(strconv.Itoa(i))
+			ms.SetBatch(map[string][]byte{"currentTerm": v, "votedFor": v, "log": v})
+		}
+	}()
+
+	// A reader holding the lock must never see part of a batch.
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		ms.mu.Lock()
+		term, vote, entries := string(ms.m["currentTerm"]), string(ms.m["votedFor"]), string(ms.m["log"])
+		ms.mu.Unlock()
+		if term != vote || term != entries {
+			t.Fatalf("saw a partial batch: currentTerm=%q votedFor=%q log=%q", term, vote, entries)
+		}
+	}
+	if v, _ := ms.Get("log"); string(v) != "999" {
+		t.Errorf("log = %q after all batches, want \"999\"", v)
+	}
+}
+
+func TestBackoffOnDisconnectedPeer(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	sleepMs(250)
+
+	m := h.cluster[origLeaderId].cm.Metrics()
+	if m.Backoff[otherId].ConsecutiveFailures == 0 {
+		t.Errorf("want failures for disconnected peer %d, got %+v", otherId, m.Backoff)
+	}
+
+	// The reconnected peer may have forced a new election; whoever leads now
+	// should be talking to everyone.
+	h.ReconnectPeer(otherId)
+	sleepMs(350)
+	newLeaderId, _ := h.CheckSingleLeader()
+	m = h.cluster[newLeaderId].cm.Metrics()
+	for peerId, b := range m.Backoff {
+		if b.ConsecutiveFailures != 0 {
+			t.Errorf("want backoff reset for peer %d, got %+v", peerId, b)
+		}
+	}
+}
+
+func TestBackoffGrowsToConfiguredMax(t *testing.T) {
+	clock := NewFakeClock()
+	config := &Config{Clock: clock, RetryBackoffBase: 100 * time.Millisecond, RetryBackoffMax: time.Second}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	// With jitter each wait lies in [backoff/2, backoff).
+	for i, want := range []time.Duration{0, 0, 0, 100, 200, 400, 800, 1000, 1000} {
+		failures := i + 1
+		cm.backoffPeer(1)
+		wait := cm.peerRetryAt[1].Sub(clock.Now())
+		if want == 0 {
+			if wait > 0 {
+				t.Errorf("after %d failures waiting %v, want no backoff", failures, wait)
+			}
+			continue
+		}
+		want *= time.Millisecond
+		if wait < want/2 || wait >= want {
+			t.Errorf("after %d failures waiting %v, want in [%v, %v)", failures, wait, want/2, want)
+		}
+	}
+}
+
+func TestRPCLatencyMetrics(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	sleepMs(200)
+
+	// The leader won an election and has been sending heartbeats since.
+	m := h.cluster[origLeaderId].cm.Metrics()
+	if m.RPCLatency["RequestVote"].Count == 0 {
+		t.Errorf("no RequestVote latency recorded: %+v", m.RPCLatency)
+	}
+	total := m.RPCLatency["AppendEntries"]
+	if total.Count == 0 {
+		t.Fatalf("no AppendEntries latency recorded: %+v", m.RPCLatency)
+	}
+	if total.Min > total.Mean() || total.Mean() > total.Max {
+		t.Errorf("inconsistent AppendEntries latency %+v", total)
+	}
+
+	// The aggregate is the sum over peers.
+	count := 0
+	for peerId, byMethod := range m.PeerRPCLatency {
+		s := byMethod["AppendEntries"]
+		if s.Count == 0 || s.Min < total.Min || s.Max > total.Max {
+			t.Errorf("peer %d AppendEntries latency %+v, total %+v", peerId, s, total)
+		}
+		count += s.Count
+	}
+	if count != total.Count {
+		t.Errorf("per-peer counts add up to %d, want %d", count, total.Count)
+	}
+}
+
+func TestDetectLogDivergence(t *testing.T) {
+	divergences := make(chan LogDivergence, 16)
+	h := NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		return &Config{DetectLogDivergence: true, OnLogDivergence: func(d LogDivergence) {
+			divergences <- d
+		}}
+	})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	for i := 1; i <= 3; i++ {
+		h.SubmitToServer(origLeaderId, i)
+	}
+	sleepMs(250)
+	h.CheckCommittedN(3, 3)
+	for i := 0; i < 3; i++ {
+		if n := h.cluster[i].cm.Metrics().LogDivergences; n != 0 {
+			t.Errorf("server %d reported %d divergences on a healthy cluster", i, n)
+		}
+	}
+
+	// Silently corrupt a replicated entry on a follower, as a bad disk might.
+	otherId := (origLeaderId + 1) % 3
+	follower := h.cluster[otherId].cm
+	follower.mu.Lock()
+	follower.log[1].Command = 42
+	follower.resetLogHashes()
+	follower.mu.Unlock()
+
+	select {
+	case d := <-divergences:
+		if d.LeaderId != origLeaderId || d.From != -1 || d.To != 2 {
+			t.Errorf("got divergence %+v, want leader %d over (-1, 2]", d, origLeaderId)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("divergence not detected")
+	}
+	if n := follower.Metrics().LogDivergences; n == 0 {
+		t.Errorf("LogDivergences metric not updated")
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+
+	status := h.cluster[origLeaderId].cm.ReplicationStatus()
+	for peerId, ps := range status {
+		if !ps.Reachable || ps.Lag != 0 || ps.MatchIndex != 0 || ps.Conn.State != ConnConnected {
+			t.Errorf("peer %d status got %+v, want reachable with no lag", peerId, ps)
+		}
+	}
+
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	h.SubmitToServer(origLeaderId, 6)
+	sleepMs(100)
+
+	ps := h.cluster[origLeaderId].cm.ReplicationStatus()[otherId]
+	if ps.Reachable || ps.Lag != 1 || ps.Conn.State != ConnDisconnected {
+		t.Errorf("disconnected peer %d status got %+v, want unreachable with lag 1", otherId, ps)
+	}
+
+	if status := h.cluster[otherId].cm.ReplicationStatus(); status != nil {
+		t.Errorf("follower status got %+v, want nil", status)
+	}
+}
+
+// lockedBuilder is a strings.Builder that is safe to write from several
+// goroutines, for capturing log output.
+type lockedBuilder struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (lb *lockedBuilder) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.Write(p)
+}
+
+func (lb *lockedBuilder) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.String()
+}
+
+func TestHookCrashBeforePersist(t *testing.T) {
+	storage := NewMapStorage()
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.persistToStorage()
+	cm.mu.Unlock()
+
+	// Copy storage after the entry is appended in memory but before it is
+	// written, as if the node crashed there. Replication must only be
+	// triggered once the append is done.
+	var crashed *MapStorage
+	cm.hooks.beforePersist = func() { crashed = storage.Clone() }
+	triggered := -1
+	cm.hooks.afterAppendBeforeTrigger = func() { triggered = len(cm.triggerAEChan) }
+	if !cm.Submit(5) {
+		t.Fatalf("Submit failed")
+	}
+	if triggered != 0 {
+		t.Errorf("AE was triggered before the hook ran")
+	}
+
+	restarted, err := NewConsensusModule(0, []int{1, 2}, nil, crashed, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+	restarted.mu.Lock()
+	defer restarted.mu.Unlock()
+	if len(restarted.log) != 0 || restarted.currentTerm != 1 {
+		t.Errorf("restored term=%d log=%v from before the persist, want term 1 and no entries", restarted.currentTerm, restarted.log)
+	}
+}
+
+func TestHookVoteReplySeesPersistedVote(t *testing.T) {
+	storage := NewMapStorage()
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// Whatever happens after this point, a restart must remember the vote.
+	var persisted *MapStorage
+	cm.hooks.beforeVoteReply = func() { persisted = storage.Clone() }
+	var reply RequestVoteReply
+	cm.RequestVote(RequestVoteArgs{Term: 1, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1}, &reply)
+	if !reply.VotedGranted {
+		t.Fatalf("vote not granted: %+v", reply)
+	}
+
+	restarted, err := NewConsensusModule(0, []int{1, 2}, nil, persisted, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+	restarted.mu.Lock()
+	defer restarted.mu.Unlock()
+	if restarted.votedFor != 2 || restarted.currentTerm != 1 {
+		t.Errorf("restored votedFor=%d term=%d, want 2 and 1", restarted.votedFor, restarted.currentTerm)
+	}
+}
+
+func TestHookVoteReplyOnRejection(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	calls := 0
+	cm.hooks.beforeVoteReply = func() { calls++ }
+	cm.mu.Lock()
+	cm.degraded = true
+	cm.mu.Unlock()
+
+	// Early rejections must reach the hook too, not just the normal vote path.
+	var reply RequestVoteReply
+	cm.RequestVote(RequestVoteArgs{Term: 1, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1}, &reply)
+	if reply.VotedGranted {
+		t.Fatalf("degraded node granted a vote: %+v", reply)
+	}
+	if calls != 1 {
+		t.Errorf("beforeVoteReply ran %d times, want 1", calls)
+	}
+}
+
+func TestHookAppendEntriesReplyOnRejection(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	calls := 0
+	cm.hooks.beforeAppendEntriesReply = func() { calls++ }
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.log = []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}}
+	cm.commitIndex = 1
+	cm.mu.Unlock()
+
+	// A request that would overwrite a committed entry is rejected early.
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 2, LeaderId: 1, PrevLogIndex: 0, PrevLogTerm: 1, LeaderCommit: 1,
+		Entries: []LogEntry{{Command: 9, Term: 2}},
+	}, &reply)
+	if reply.Success {
+		t.Fatalf("conflicting AppendEntries acknowledged: %+v", reply)
+	}
+	if calls != 1 {
+		t.Errorf("beforeAppendEntriesReply ran %d times, want 1", calls)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	var out lockedBuilder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	config := &Config{LogLevels: map[string]Level{
+		LogElection:    LevelInfo,
+		LogReplication: LevelOff,
+		LogProposal:    LevelOff,
+	}}
+	cm, err := NewConsensusModule(7, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.RequestVote(RequestVoteArgs{Term: 1, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &RequestVoteReply{})
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}, &AppendEntriesReply{})
+	cm.Submit(5)
+
+	logged := out.String()
+	if !strings.Contains(logged, "[7] becomes Follower") {
+		t.Errorf("log is missing the election info message:\n%s", logged)
+	}
+	for _, unwanted := range []string{"[7] RequestVote:", "[7] AppendEntries:", "[7] Submit received"} {
+		if strings.Contains(logged, unwanted) {
+			t.Errorf("log has %q below its subsystem's level:\n%s", unwanted, logged)
+		}
+	}
+}
+
+func TestLogLevelWarn(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	for _, level := range []Level{LevelWarn, LevelOff} {
+		var out lockedBuilder
+		log.SetOutput(&out)
+		config := &Config{MaxTermGap: 5, LogLevels: map[string]Level{LogRPC: level}}
+		cm, err := NewConsensusModule(7, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm.RequestVote(RequestVoteArgs{Term: 100, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &RequestVoteReply{})
+		cm.Stop()
+
+		logged := out.String()
+		if strings.Contains(logged, "[7] ... ignoring RequestVote") {
+			t.Errorf("LogRPC at %v: log has the debug message:\n%s", level, logged)
+		}
+		warned := strings.Contains(logged, "[7] ignoring RequestVote from 1 with term 100")
+		if want := level == LevelWarn; warned != want {
+			t.Errorf("LogRPC at %v: warning logged = %v, want %v:\n%s", level, warned, want, logged)
+		}
+	}
+}
+
+func TestPeerIdsIncludingSelf(t *testing.T) {
+	cm, err := NewConsensusModule(0, []int{0, 1, 2, 1}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if got := fmt.Sprint(cm.peerIds); got != "[1 2]" {
+		t.Errorf("peerIds = %s, want [1 2]", got)
+	}
+	if q := cm.quorum(); q != 2 {
+		t.Errorf("quorum() = %d, want 2 for 3 voters", q)
+	}
+
+	// Self counts once: the leader plus one matching peer commit, the leader
+	// alone does not.
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.log = []LogEntry{{Command: 1, Term: 1}}
+	cm.matchIndex = map[int]int{1: -1, 2: -1}
+	if cm.advanceCommitIndex() {
+		t.Errorf("committed index %d with only the leader's copy", cm.commitIndex)
+	}
+	cm.matchIndex[1] = 0
+	if !cm.advanceCommitIndex() || cm.commitIndex != 0 {
+		t.Errorf("commitIndex = %d with a majority, want 0", cm.commitIndex)
+	}
+}
+
+func TestMinMatchIndex(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+	if got := h.cluster[origLeaderId].cm.MinMatchIndex(); got != 0 {
+		t.Errorf("MinMatchIndex() = %d, want 0", got)
+	}
+
+	// A lagging voter holds the truncation point back even though the entry
+	// commits without it.
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	h.SubmitToServer(origLeaderId, 6)
+	sleepMs(100)
+	h.CheckCommittedN(6, 2)
+	if got := h.cluster[origLeaderId].cm.MinMatchIndex(); got != 0 {
+		t.Errorf("MinMatchIndex() with a lagging peer = %d, want 0", got)
+	}
+
+	if got := h.cluster[(origLeaderId+2)%3].cm.MinMatchIndex(); got != -1 {
+		t.Errorf("follower MinMatchIndex() = %d, want -1", got)
+	}
+}
+
+func TestSubmitLinearizableWaitsForBarrier(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	if err := h.cluster[(origLeaderId+1)%3].cm.SubmitLinearizable(5); err != ErrNotLeader {
+		t.Errorf("follower SubmitLinearizable got %v, want ErrNotLeader", err)
+	}
+
+	if err := h.cluster[origLeaderId].cm.SubmitLinearizable(5); err != ErrNotCaughtUp {
+		t.Errorf("fresh leader SubmitLinearizable got %v, want ErrNotCaughtUp", err)
+	}
+	sleepMs(150)
+	if err := h.cluster[origLeaderId].cm.SubmitLinearizable(5); err != nil {
+		t.Errorf("SubmitLinearizable after barrier got %v, want nil", err)
+	}
+	sleepMs(150)
+	h.CheckCommittedN(5, 3)
+}
+
+func TestInternalEntriesNotDelivered(t *testing.T) {
+	h := NewHarnessWithConfig(t, 3, &Config{RequireBootstrap: true})
+	defer h.Shutdown()
+
+	// Index 0 holds the configuration entry and index 1 the no-op the first
+	// leader appends to commit it, so the first command lands at index 2.
+	if err := h.cluster[0].cm.Bootstrap([]int{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	sleepMs(250)
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+
+	// The next leader's barrier takes index 3.
+	h.CrashPeer(origLeaderId)
+	sleepMs(450)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if err := h.cluster[newLeaderId].cm.SubmitLinearizable(6); err != ErrNotCaughtUp {
+		t.Fatalf("fresh leader SubmitLinearizable got %v, want ErrNotCaughtUp", err)
+	}
+	sleepMs(250)
+	if err := h.cluster[newLeaderId].cm.SubmitLinearizable(6); err != nil {
+		t.Fatalf("SubmitLinearizable after barrier got %v, want nil", err)
+	}
+	sleepMs(250)
+
+	want := fmt.Sprint([]CommitEntry{{Command: 5, Index: 2, Term: origTerm}, {Command: 6, Index: 4, Term: newTerm}})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if !h.alive[i] {
+			continue
+		}
+		if got := fmt.Sprint(h.commits[i]); got != want {
+			t.Errorf("server %d delivered %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestProposeAndWait(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	entry, err := h.cluster[origLeaderId].cm.ProposeAndWait(ctx, 5)
+	if err != nil {
+		t.Fatalf("ProposeAndWait got err=%v", err)
+	}
+	if entry.Command != 5 {
+		t.Errorf("got command %v, want 5", entry.Command)
+	}
+	sleepMs(100)
+	_, index := h.CheckCommitted(5)
+	if entry.Index != index {
+		t.Errorf("got index %d, want %d", entry.Index, index)
+	}
+
+	if _, err := h.cluster[(origLeaderId+1)%3].cm.ProposeAndWait(ctx, 6); err != ErrNotLeader {
+		t.Errorf("follower ProposeAndWait got err=%v, want ErrNotLeader", err)
+	}
+}
+
+func TestProposeAndWaitOnDeposedLeader(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// The leader is partitioned before proposing, so the proposal can never be
+	// replicated.
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.DisconnectPeer(origLeaderId)
+
+	errc := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := h.cluster[origLeaderId].cm.ProposeAndWait(ctx, 5)
+		errc <- err
+	}()
+
+	sleepMs(350)
+	newLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(newLeaderId, 6)
+	sleepMs(250)
+
+	// Once reconnected, the old leader's entry is overwritten by the new
+	// leader's and the waiter must be told.
+	h.ReconnectPeer(origLeaderId)
+	if err := <-errc; err != ErrDropped {
+		t.Errorf("ProposeAndWait got err=%v, want ErrDropped", err)
+	}
+	sleepMs(250)
+	h.CheckNotCommitted(5)
+	h.CheckCommittedN(6, 3)
+}
+
+func TestSubmitWithCallback(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	results := make(chan CommitEntry, 2)
+	for _, cmd := range []int{5, 6} {
+		err := h.cluster[origLeaderId].cm.SubmitWithCallback(cmd, func(entry CommitEntry, err error) {
+			if err != nil {
+				t.Errorf("callback got err=%v", err)
+			}
+			results <- entry
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []int{5, 6} {
+		select {
+		case entry := <-results:
+			if entry.Command != want {
+				t.Errorf("callback got command %v, want %d", entry.Command, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("callback for %d not called", want)
+		}
+	}
+
+	otherId := (origLeaderId + 1) % 3
+	if err := h.cluster[otherId].cm.SubmitWithCallback(7, nil); err != ErrNotLeader {
+		t.Errorf("SubmitWithCallback on follower got err=%v, want ErrNotLeader", err)
+	}
+}
+
+func TestStopGracefullyTransfersLeadership(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.cluster[origLeaderId].cm.StopGracefully(ctx); err != nil {
+		t.Fatalf("StopGracefully got err=%v", err)
+	}
+	h.DisconnectPeer(origLeaderId)
+
+	// The transferee wins right away, so there's no election storm.
+	sleepMs(20)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId == origLeaderId || newTerm != origTerm+1 {
+		t.Errorf("got leader %d term %d, want a new leader in term %d", newLeaderId, newTerm, origTerm+1)
+	}
+	h.SubmitToServer(newLeaderId, 6)
+	sleepMs(150)
+	h.CheckCommittedN(5, 2)
+	h.CheckCommittedN(6, 2)
+}
+
+func TestConfigRandIsReproducible(t *testing.T) {
+	timeouts := func() []time.Duration {
+		config := &Config{Rand: mathrand.New(mathrand.NewSource(42))}
+		cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cm.Stop()
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		var ds []time.Duration
+		for i := 0; i < 5; i++ {
+			ds = append(ds, cm.electionTimeout())
+		}
+		return ds
+	}
+
+	// The same seed gives the same election timeouts.
+	if a, b := timeouts(), timeouts(); fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("timeouts differ with the same seed: %v vs %v", a, b)
+	}
+}
+
+func TestConfigRandShared(t *testing.T) {
+	config := &Config{Rand: mathrand.New(mathrand.NewSource(42))}
+	var cms []*ConsensusModule
+	for id := 0; id < 3; id++ {
+		cm, err := NewConsensusModule(id, []int{0, 1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cm.Stop()
+		if cm.rand == config.Rand {
+			t.Fatalf("node %d uses Config.Rand directly", id)
+		}
+		cms = append(cms, cm)
+	}
+
+	// Each module only touches its own source under its own lock, so drawing
+	// timeouts concurrently is race-free.
+	var wg sync.WaitGroup
+	for _, cm := range cms {
+		wg.Add(1)
+		go func(cm *ConsensusModule) {
+			defer wg.Done()
+			cm.mu.Lock()
+			defer cm.mu.Unlock()
+			for i := 0; i < 100; i++ {
+				cm.electionTimeout()
+			}
+		}(cm)
+	}
+	wg.Wait()
+}
+
+func TestElectionPriority(t *testing.T) {
+	h := NewHarnessWithConfig(t, 3, &Config{Priorities: map[int]int{2: 10, 1: 5}})
+	defer h.Shutdown()
+
+	// Everyone else waits an extra election timeout range per higher-priority
+	// voter, so the top-priority node campaigns first.
+	leaderId, _ := h.CheckSingleLeader()
+	if leaderId != 2 {
+		t.Fatalf("leader got %d, want 2", leaderId)
+	}
+
+	// Priority only delays campaigns, lower-priority nodes still take over.
+	h.DisconnectPeer(2)
+	newLeaderId, _ := h.CheckSingleLeader()
+	if newLeaderId != 1 {
+		t.Errorf("leader got %d, want 1", newLeaderId)
+	}
+}
+
+func TestStableLeadershipRejoinDoesNotDisrupt(t *testing.T) {
+	h := NewHarnessWithConfig(t, 3, &Config{StableLeadership: true})
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	sleepMs(800)
+
+	// The isolated follower never won a pre-vote, so its term didn't move and
+	// rejoining doesn't depose the leader.
+	if _, term, _ := h.cluster[otherId].cm.Report(); term != origTerm {
+		t.Errorf("isolated follower term got %d, want %d", term, origTerm)
+	}
+	h.ReconnectPeer(otherId)
+	sleepMs(300)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId != origLeaderId || newTerm != origTerm {
+		t.Errorf("got leader %d term %d, want leader %d term %d", newLeaderId, newTerm, origLeaderId, origTerm)
+	}
+}
+
+func TestStableLeadershipLeaderStepsDown(t *testing.T) {
+	h := NewHarnessWithConfig(t, 3, &Config{StableLeadership: true})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.DisconnectPeer(origLeaderId)
+	sleepMs(500)
+
+	if _, _, isLeader := h.cluster[origLeaderId].cm.Report(); isLeader {
+		t.Errorf("leader %d without quorum did not step down", origLeaderId)
+	}
+	newLeaderId, _ := h.CheckSingleLeader()
+	if newLeaderId == origLeaderId {
+		t.Errorf("want a new leader in the majority partition")
+	}
+}
+
+func TestRejectVoteInLeaderLease(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	var aeReply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}, &aeReply)
+
+	var reply RequestVoteReply
+	cm.RequestVote(RequestVoteArgs{Term: 2, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1}, &reply)
+	if reply.VotedGranted || reply.Term != 1 {
+		t.Errorf("RequestVote in leader lease got %+v, want rejection in term 1", reply)
+	}
+	cm.RequestVote(RequestVoteArgs{Term: 2, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1, LeadershipTransfer: true}, &reply)
+	if !reply.VotedGranted {
+		t.Errorf("RequestVote for leadership transfer got %+v, want granted", reply)
+	}
+}
+
+func TestPartiallyPartitionedNodeCannotDisrupt(t *testing.T) {
+	ft := NewFaultTransport()
+	h := NewHarnessWithConfig(t, 3, &Config{WrapTransport: ft.Wrap})
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	flapId := (origLeaderId + 1) % 3
+	otherId := (origLeaderId + 2) % 3
+
+	// flapId can't reach the leader but can reach the other follower, so it
+	// keeps timing out and asking otherId for votes with ever higher terms.
+	ft.DropRate(flapId, origLeaderId, 1)
+	ft.DropRate(origLeaderId, flapId, 1)
+	sleepMs(800)
+
+	if _, term, isLeader := h.cluster[origLeaderId].cm.Report(); !isLeader || term != origTerm {
+		t.Errorf("leader %d got term=%d isLeader=%v, want undisturbed in term %d", origLeaderId, term, isLeader, origTerm)
+	}
+	if _, term, _ := h.cluster[otherId].cm.Report(); term != origTerm {
+		t.Errorf("follower %d term got %d, want %d", otherId, term, origTerm)
+	}
+}
+
+func TestLearnerCanServeReads(t *testing.T) {
+	h := NewHarnessWithConfig(t, 3, &Config{Learners: []int{2}})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	if origLeaderId == 2 {
+		t.Fatalf("learner became leader")
+	}
+	sleepMs(100)
+	learner := h.cluster[2].cm
+	if !learner.CanServeReads() {
+		t.Errorf("caught-up learner can't serve reads")
+	}
+
+	// The two voters commit without the learner, and the learner knows it's
+	// behind.
+	h.DisconnectPeer(2)
+	for cmd := 5; cmd < 10; cmd++ {
+		h.SubmitToServer(origLeaderId, cmd)
+	}
+	sleepMs(350)
+	h.CheckCommittedN(9, 2)
+	if learner.CanServeReads() {
+		t.Errorf("disconnected learner can serve reads")
+	}
+
+	h.ReconnectPeer(2)
+	sleepMs(250)
+	h.CheckCommittedN(9, 3)
+	if !learner.CanServeReads() {
+		t.Errorf("learner can't serve reads after catching up")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	h := NewHarnessWithConfig(t, 3, &Config{RequireBootstrap: true})
+	defer h.Shutdown()
+
+	if err := h.cluster[1].cm.Bootstrap([]int{0, 1}); err == nil {
+		t.Errorf("Bootstrap accepted a configuration that doesn't match the peers")
+	}
+	if err := h.cluster[0].cm.Bootstrap([]int{2, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.cluster[0].cm.Bootstrap([]int{0, 1, 2}); err != ErrBootstrapped {
+		t.Errorf("second Bootstrap got err %v, want ErrBootstrapped", err)
+	}
+
+	// The configuration entry takes index 0 and commits with the no-op the
+	// new leader appends for its term, without any client writes.
+	h.CheckSingleLeader()
+	sleepMs(250)
+	for i := 0; i < 3; i++ {
+		cm := h.cluster[i].cm
+		cm.mu.Lock()
+		configuration := fmt.Sprint(cm.configuration)
+		cm.mu.Unlock()
+		if configuration != "[0 1 2]" {
+			t.Errorf("server %d committed configuration %s, want [0 1 2]", i, configuration)
+		}
+	}
+}
+
+func TestConfiguration(t *testing.T) {
+	cm, err := NewConsensusModule(1, []int{2, 0, 3}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry), &Config{Learners: []int{3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	if got, want := fmt.Sprint(cm.Configuration()), "[0 1 2]"; got != want {
+		t.Errorf("Configuration() = %s, want %s", got, want)
+	}
+	if _, ok := cm.PendingConfiguration(); ok {
+		t.Errorf("want no pending configuration")
+	}
+}
+
+func TestMembershipEvents(t *testing.T) {
+	events := make(chan MembershipEvent, 8)
+	config := &Config{
+		Learners:           []int{2},
+		OnMembershipChange: func(e MembershipEvent) { events <- e },
+	}
+	commitChan := make(chan CommitEntry, 16)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), commitChan, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// Nothing is reported when proposed, only once the entries are applied.
+	cm.mu.Lock()
+	cm.log = []LogEntry{
+		{Command: ClusterConfig{Voters: []int{0, 1, 2}, Learners: []int{3}}, Term: 1, Type: EntryConfig},
+		{Command: ClusterConfig{Voters: []int{0, 2}, Learners: []int{3}}, Term: 1, Type: EntryConfig},
+	}
+	cm.mu.Unlock()
+	select {
+	case e := <-events:
+		t.Fatalf("got event %v before the config entries were committed", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cm.mu.Lock()
+	cm.commitIndex = 1
+	cm.signalCommit()
+	cm.mu.Unlock()
+	want := []MembershipEvent{
+		{Type: LearnerPromoted, Id: 2, Index: 0},
+		{Type: LearnerAdded, Id: 3, Index: 0},
+		{Type: ServerRemoved, Id: 1, Index: 1},
+	}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e != w {
+				t.Errorf("got event %+v, want %+v", e, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %+v", w)
+		}
+	}
+	if got := fmt.Sprint(cm.Configuration()); got != "[0 2]" {
+		t.Errorf("Configuration() = %s, want [0 2]", got)
+	}
+}
+
+func TestWatchCommitIndex(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	watchers := []<-chan int{
+		h.cluster[origLeaderId].cm.WatchCommitIndex(),
+		h.cluster[origLeaderId].cm.WatchCommitIndex(),
+		h.cluster[otherId].cm.WatchCommitIndex(),
+	}
+	for cmd := 5; cmd < 8; cmd++ {
+		h.SubmitToServer(origLeaderId, cmd)
+	}
+	sleepMs(250)
+	_, index := h.CheckCommitted(7)
+
+	for i, w := range watchers {
+		select {
+		case got := <-w:
+			if got != index {
+				t.Errorf("watcher %d got commitIndex %d, want latest %d", i, got, index)
+			}
+		default:
+			t.Errorf("watcher %d got nothing", i)
+		}
+	}
+}
+
+func TestReportWithoutLock(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	cm := h.cluster[origLeaderId].cm
+
+	// Report must not wait for the lock held by the replication path.
+	cm.mu.Lock()
+	done := make(chan bool, 1)
+	go func() {
+		_, term, isLeader := cm.Report()
+		done <- isLeader && term == origTerm
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("Report() disagrees with the leader in term %d", origTerm)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Report() blocked on the lock")
+	}
+	cm.becomeFollower(origTerm + 1)
+	cm.mu.Unlock()
+
+	if _, term, isLeader := cm.Report(); isLeader || term != origTerm+1 {
+		t.Errorf("after stepping down got term=%d isLeader=%v, want %d and false", term, isLeader, origTerm+1)
+	}
+}
+
+func TestLastCommitted(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	if _, ok := h.cluster[origLeaderId].cm.LastCommitted(); ok {
+		t.Errorf("LastCommitted reported an entry before anything was committed")
+	}
+	h.SubmitToServer(origLeaderId, 5)
+	h.SubmitToServer(origLeaderId, 6)
+	sleepMs(250)
+	_, index := h.CheckCommitted(6)
+
+	for i := 0; i < 3; i++ {
+		e, ok := h.cluster[i].cm.LastCommitted()
+		if !ok || e.Command != 6 || e.Index != index {
+			t.Errorf("server %d LastCommitted() = %+v, %v; want command 6 at index %d", i, e, ok, index)
+		}
+	}
+}
+
+func TestOnCommit(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	fired := make(chan int, 4)
+	cm.OnCommit(1, func() { fired <- 1 })
+	cm.OnCommit(2, func() { fired <- 2 })
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 1,
+		Entries: []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}},
+	}, &reply)
+	select {
+	case got := <-fired:
+		if got != 1 {
+			t.Errorf("callback for index %d fired at commitIndex 1", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback for index 1 did not fire")
+	}
+
+	// Already committed indices fire right away, and each callback fires once.
+	cm.OnCommit(0, func() { fired <- 0 })
+	if got := <-fired; got != 0 {
+		t.Errorf("got callback for index %d, want 0", got)
+	}
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: 2, PrevLogTerm: 1, LeaderCommit: 2}, &reply)
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: 2, PrevLogTerm: 1, LeaderCommit: 2}, &reply)
+	if got := <-fired; got != 2 {
+		t.Errorf("got callback for index %d, want 2", got)
+	}
+	sleepMs(50)
+	if len(fired) != 0 {
+		t.Errorf("callbacks fired more than once")
+	}
+}
+
+// testTLSConfig creates a self-signed CA and a certificate for "localhost"
+// signed by it, valid for both server and client authentication.
+func testTLSConfig(t *testing.T) *tls.Config {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "praft test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ServerName:   "localhost",
+	}
+}
+
+func TestTLSCommit(t *testing.T) {
+	h := NewHarnessWithConfig(t, 3, &Config{TLSConfig: testTLSConfig(t)})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+	h.CheckCommittedN(5, 3)
+}
+
+func TestFakeClockDrivesElection(t *testing.T) {
+	fc := NewFakeClock()
+	h := NewHarnessWithConfig(t, 3, &Config{Clock: fc})
+	defer func() {
+		h.Shutdown()
+		// Let the timer goroutines observe the shutdown and exit.
+		fc.Advance(time.Second)
+	}()
+
+	// Without advancing the clock no election timeout can ever fire.
+	sleepMs(350)
+	h.CheckNoLeader()
+
+	for i := 0; i < 60; i++ {
+		fc.Advance(10 * time.Millisecond)
+		sleepMs(5)
+	}
+	h.CheckSingleLeader()
+}
+
+func TestElectionTimerReused(t *testing.T) {
+	ready := make(chan interface{})
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), ready, make(chan CommitEntry), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	close(ready)
+	sleepMs(10)
+
+	// Every term change restarts the election timer; none of them may leave a
+	// goroutine behind.
+	before := runtime.NumGoroutine()
+	for term := 1; term <= 100; term++ {
+		cm.mu.Lock()
+		cm.becomeFollower(term)
+		cm.mu.Unlock()
+	}
+	sleepMs(10)
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("goroutines grew from %d to %d after 100 term changes", before, after)
+	}
+}
+
+func TestFirstElectionTimeoutIsLonger(t *testing.T) {
+	fc := NewFakeClock()
+	ready := make(chan interface{})
+	cm, err := NewConsensusModule(0, nil, nil, NewMapStorage(), ready, make(chan CommitEntry), &Config{Clock: fc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cm.Stop()
+		fc.Advance(time.Second)
+	}()
+	close(ready)
+
+	advance := func(d time.Duration) {
+		for step := time.Duration(0); step < d; step += 10 * time.Millisecond {
+			sleepMs(2)
+			fc.Advance(10 * time.Millisecond)
+		}
+		sleepMs(10)
+	}
+
+	// A steady-state timeout could have fired by now, but not the first one.
+	advance(electionTimeoutMin + electionBootDelay - 10*time.Millisecond)
+	if _, _, isLeader := cm.Report(); isLeader {
+		t.Errorf("election started before the boot delay elapsed")
+	}
+	advance(electionTimeoutRange + 20*time.Millisecond)
+	if _, _, isLeader := cm.Report(); !isLeader {
+		t.Errorf("single node not leader after the first election timeout")
+	}
+}
+
+func TestReorderedAndDuplicatedAppendEntries(t *testing.T) {
+	ft := NewFaultTransport()
+	h := NewHarnessWithConfig(t, 3, &Config{WrapTransport: ft.Wrap})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	for i := 0; i < 3; i++ {
+		if i != origLeaderId {
+			ft.SetReorder(origLeaderId, i, 30*time.Millisecond)
+			ft.DuplicateRate(origLeaderId, i, 0.3)
+		}
+	}
+	for cmd := 1; cmd <= 20; cmd++ {
+		h.SubmitToServer(origLeaderId, cmd)
+		sleepMs(5)
+	}
+	sleepMs(300)
+	ft.Heal()
+	sleepMs(200)
+	for cmd := 1; cmd <= 20; cmd++ {
+		h.CheckCommittedN(cmd, 3)
+	}
+}
+
+func TestFaultTransportPartition(t *testing.T) {
+	ft := NewFaultTransport()
+	h := NewHarnessWithConfig(t, 3, &Config{WrapTransport: ft.Wrap})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	others := []int{(origLeaderId + 1) % 3, (origLeaderId + 2) % 3}
+	ft.Partition([]int{origLeaderId}, others)
+
+	// The harness still considers everyone connected, so look for a leader in
+	// the majority side only. The two nodes may split their vote a few times.
+	newLeaderId := -1
+	for r := 0; r < 20 && newLeaderId < 0; r++ {
+		sleepMs(150)
+		for _, id := range others {
+			if _, _, isLeader := h.cluster[id].cm.Report(); isLeader {
+				newLeaderId = id
+			}
+		}
+	}
+	if newLeaderId < 0 {
+		t.Fatalf("no leader in majority partition %v", others)
+	}
+
+	ft.Heal()
+	sleepMs(250)
+	leaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(leaderId, 5)
+	sleepMs(250)
+	h.CheckCommittedN(5, 3)
+}
+
+func TestMemHarnessCrashAndRestart(t *testing.T) {
+	h := NewMemHarness(t, 3, nil)
+	defer h.Shutdown()
+
+	leaderId := h.SubmitToLeader(5)
+	h.WaitCommitted(5)
+
+	// A restarted follower replays its persisted log and catches up over the
+	// in-memory network.
+	otherId := (leaderId + 1) % 3
+	h.CrashPeer(otherId)
+	h.SubmitToLeader(6)
+	h.WaitCommitted(6)
+	h.RestartPeer(otherId)
+	h.SubmitToLeader(7)
+	if index := h.WaitCommitted(7); index != 2 {
+		t.Errorf("7 committed at index %d, want 2", index)
+	}
+}
+
+func TestFaultTransportSeedIsDeterministic(t *testing.T) {
+	decisions := func(seed int64) string {
+		ft := NewFaultTransportWithSeed(seed)
+		ft.DropRate(0, 1, 0.3)
+		ft.SetReorder(0, 1, 50*time.Millisecond)
+		ft.DuplicateRate(0, 1, 0.3)
+		var b strings.Builder
+		for i := 0; i < 100; i++ {
+			drop, delay, duplicate := ft.decide(0, 1)
+			fmt.Fprintf(&b, "%v/%v/%v ", drop, delay, duplicate)
+		}
+		return b.String()
+	}
+	if decisions(42) != decisions(42) {
+		t.Errorf("same seed produced different fault decisions")
+	}
+	if decisions(42) == decisions(43) {
+		t.Errorf("different seeds produced identical fault decisions")
+	}
+}
+
+func TestSnapshotSurvivesRestart(t *testing.T) {
+	var h *Harness
+	h = NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		return &Config{
+			SnapshotThreshold:       3,
+			SnapshotEntriesRetained: 1,
+			SnapshotProvider: func() ([]byte, int, error) {
+				h.mu.Lock()
+				defer h.mu.Unlock()
+				commits := h.commits[id]
+				return []byte("snapshot"), commits[len(commits)-1].Index, nil
+			},
+		}
+	})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	for i := 1; i <= 5; i++ {
+		h.SubmitToServer(origLeaderId, i)
+		sleepMs(30)
+	}
+	sleepMs(250)
+	h.CheckCommittedN(5, 3)
+
+	cm := h.cluster[otherId].cm
+	cm.mu.Lock()
+	snapshotIndex, snapshotTerm := cm.snapshotIndex, cm.snapshotTerm
+	cm.mu.Unlock()
+	if snapshotIndex < 0 {
+		t.Fatalf("follower %d took no snapshot", otherId)
+	}
+
+	h.CrashPeer(otherId)
+	h.RestartPeer(otherId)
+	sleepMs(250)
+
+	cm = h.cluster[otherId].cm
+	cm.mu.Lock()
+	gotIndex, gotTerm, commitIndex, lastApplied := cm.snapshotIndex, cm.snapshotTerm, cm.commitIndex, cm.lastApplied
+	cm.mu.Unlock()
+	if gotIndex != snapshotIndex || gotTerm != snapshotTerm {
+		t.Errorf("restored snapshot index=%d term=%d, want %d and %d", gotIndex, gotTerm, snapshotIndex, snapshotTerm)
+	}
+	if commitIndex < snapshotIndex || lastApplied < snapshotIndex {
+		t.Errorf("restored commitIndex=%d lastApplied=%d, want at least %d", commitIndex, lastApplied, snapshotIndex)
+	}
+
+	// The restarted client lost its state, so it gets the snapshot back first,
+	// followed only by the entries after it.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	commits := h.commits[otherId]
+	if len(commits) == 0 || commits[0].Snapshot == nil || commits[0].Index != snapshotIndex {
+		t.Fatalf("got commits %v after restart, want the snapshot at index %d first", commits, snapshotIndex)
+	}
+	for i, c := range commits[1:] {
+		if c.Index != snapshotIndex+i+1 {
+			t.Errorf("commit %d has index %d, want %d", i+1, c.Index, snapshotIndex+i+1)
+		}
+	}
+	if last := commits[len(commits)-1]; last.Command != 5 {
+		t.Errorf("last commit after restart is %v, want command 5", last)
+	}
+}
+
+func TestForceSnapshot(t *testing.T) {
+	calls := 0
+	config := &Config{
+		SnapshotProvider: func() ([]byte, int, error) {
+			calls++
+			return []byte("snapshot"), 2, nil
+		},
+	}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 10), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// Nothing applied yet, so there is nothing to compact.
+	if err := cm.ForceSnapshot(); err != nil || calls != 0 {
+		t.Fatalf("got err=%v calls=%d on an empty log, want nil and 0", err, calls)
+	}
+
+	appendThreeCommitted(cm)
+	if err := cm.ForceSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	cm.mu.Lock()
+	snapshotIndex, data, logBase := cm.snapshotIndex, string(cm.snapshot), cm.logBase
+	cm.mu.Unlock()
+	if snapshotIndex != 2 || data != "snapshot" || logBase != 2 {
+		t.Errorf("got snapshotIndex=%d data=%q logBase=%d, want 2, \"snapshot\", 2", snapshotIndex, data, logBase)
+	}
+
+	// Everything applied is already in the snapshot.
+	if err := cm.ForceSnapshot(); err != nil || calls != 1 {
+		t.Errorf("got err=%v calls=%d when up to date, want nil and 1", err, calls)
+	}
+}
+
+func TestPeerReachability(t *testing.T) {
+	h := NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		return &Config{PingInterval: 20 * time.Millisecond}
+	})
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	otherId := (leaderId + 1) % 3
+	leader := h.cluster[leaderId].cm
+	if r := leader.PeerReachability(otherId); r != PeerReachable {
+		t.Errorf("got %s for connected peer %d, want Reachable", r, otherId)
+	}
+
+	h.DisconnectPeer(otherId)
+	sleepMs(150)
+	if r := leader.PeerReachability(otherId); r != PeerUnreachable {
+		t.Errorf("got %s for disconnected peer %d, want Unreachable", r, otherId)
+	}
+	if s := leader.ReplicationStatus(); s != nil && s[otherId].Reachability != PeerUnreachable {
+		t.Errorf("got status %+v for disconnected peer %d, want Unreachable", s[otherId], otherId)
+	}
+	leader.mu.Lock()
+	target := leader.transferTarget([]int{otherId, (leaderId + 2) % 3})
+	leader.mu.Unlock()
+	if target == otherId {
+		t.Errorf("picked unreachable peer %d as the transfer target", otherId)
+	}
+
+	h.ReconnectPeer(otherId)
+	sleepMs(150)
+	if r := leader.PeerReachability(otherId); r != PeerReachable {
+		t.Errorf("got %s for reconnected peer %d, want Reachable", r, otherId)
+	}
+}
+
+func TestSnapshotForBackup(t *testing.T) {
+	config := &Config{
+		SnapshotProvider: func() ([]byte, int, error) {
+			return []byte("state"), 2, nil
+		},
+	}
+	storage := NewMapStorage()
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 10), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	appendThreeCommitted(cm)
+	index, backup, err := cm.SnapshotForBackup()
+	if err != nil || index != 2 {
+		t.Fatalf("got index=%d err=%v, want 2 and nil", index, err)
+	}
+	cm.mu.Lock()
+	logBase := cm.logBase
+	cm.mu.Unlock()
+	if logBase != -1 {
+		t.Errorf("backup compacted the log to %d", logBase)
+	}
+
+	if err := RestoreFromBackup(storage, backup); err != ErrBootstrapped {
+		t.Errorf("got %v restoring over existing state, want ErrBootstrapped", err)
+	}
+
+	// A fresh node seeded from the backup starts from the snapshot.
+	fresh := NewMapStorage()
+	if err := RestoreFromBackup(fresh, backup); err != nil {
+		t.Fatal(err)
+	}
+	ready := make(chan interface{})
+	commitChan := make(chan CommitEntry, 10)
+	restored, err := NewConsensusModule(3, []int{0, 1, 2}, nil, fresh, ready, commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Stop()
+	close(ready)
+	if c := <-commitChan; string(c.Snapshot) != "state" || c.Index != 2 || c.Term != 1 {
+		t.Errorf("got first commit %+v, want the backup snapshot at index 2, term 1", c)
+	}
+	if _, term, _ := restored.Report(); term != 1 {
+		t.Errorf("restored node has term %d, want 1", term)
+	}
+}
+
+func TestLeaderSinceAndTermStart(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[origLeaderId].cm
+	since, termStart := leader.LeaderSince(), leader.TermStart()
+	if since.IsZero() || since.Before(termStart) {
+		t.Errorf("got LeaderSince=%v TermStart=%v, want a leadership that began in its term", since, termStart)
+	}
+	if s := h.cluster[(origLeaderId+1)%3].cm.LeaderSince(); !s.IsZero() {
+		t.Errorf("follower reports LeaderSince=%v, want zero", s)
+	}
+
+	h.DisconnectPeer(origLeaderId)
+	newLeaderId, _ := h.CheckSingleLeader()
+	newLeader := h.cluster[newLeaderId].cm
+	if ts := newLeader.TermStart(); !ts.After(termStart) {
+		t.Errorf("new term started at %v, not after the old one at %v", ts, termStart)
+	}
+	if s := newLeader.LeaderSince(); !s.After(since) {
+		t.Errorf("new leader since %v, not after the old leader since %v", s, since)
+	}
+}
+
+func TestInitialLogCapacity(t *testing.T) {
+	config := &Config{InitialLogCapacity: 64}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 10), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	initial := cap(cm.log)
+	cm.mu.Unlock()
+	if initial < 64 {
+		t.Errorf("new log has capacity %d, want at least 64", initial)
+	}
+
+	// Compaction keeps the preallocated capacity.
+	appendThreeCommitted(cm)
+	cm.mu.Lock()
+	cm.compactLog(1, []byte("snapshot"))
+	compacted, entries := cap(cm.log), len(cm.log)
+	cm.mu.Unlock()
+	if compacted < 64 || entries != 1 {
+		t.Errorf("compacted log has capacity %d and %d entries, want at least 64 and 1", compacted, entries)
+	}
+}
+
+func TestInstallSnapshotResolvesProposals(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+	results := make(chan error, 2)
+	for cmd := 5; cmd <= 6; cmd++ {
+		go func(cmd int) {
+			_, err := cm.ProposeAndWait(context.Background(), cmd)
+			results <- err
+		}(cmd)
+	}
+	for {
+		cm.mu.Lock()
+		n := len(cm.pending)
+		cm.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		sleepMs(1)
+	}
+
+	install := func(index, term int) {
+		var reply InstallSnapshotReply
+		cm.InstallSnapshot(InstallSnapshotArgs{
+			Term: 2, LeaderId: 1, LastIncludedIndex: index, LastIncludedTerm: term, Data: []byte("x"), Done: true,
+		}, &reply)
+		if !reply.Success {
+			t.Fatalf("snapshot at index %d rejected", index)
+		}
+	}
+
+	// The new leader's snapshot agrees with index 0: that proposal committed
+	// inside the snapshot. Index 1 isn't covered yet.
+	install(0, 1)
+	if err := <-results; err != nil {
+		t.Errorf("proposal covered by a matching snapshot got %v, want success", err)
+	}
+	select {
+	case err := <-results:
+		t.Fatalf("proposal beyond the snapshot resolved early with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A snapshot from another history replaces index 1 without applying it.
+	install(3, 2)
+	select {
+	case err := <-results:
+		if err != ErrDropped {
+			t.Errorf("proposal replaced by a snapshot got %v, want ErrDropped", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("proposal inside the snapshot never resolved")
+	}
+}
+
+func TestInstallSnapshotChunks(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, term := h.CheckSingleLeader()
+	cm := h.cluster[(origLeaderId+1)%3].cm
+
+	send := func(offset int, data string, done bool) bool {
+		var reply InstallSnapshotReply
+		cm.InstallSnapshot(InstallSnapshotArgs{
+			Term:              term + 100,
+			LeaderId:          origLeaderId,
+			LastIncludedIndex: 5,
+			LastIncludedTerm:  term,
+			Offset:            offset,
+			Data:              []byte(data),
+			Done:              done,
+		}, &reply)
+		return reply.Success
+	}
+
+	if !send(0, "abc", false) {
+		t.Errorf("first chunk rejected")
+	}
+	if send(5, "xyz", true) {
+		t.Errorf("out-of-order chunk accepted")
+	}
+	if !send(3, "def", true) {
+		t.Errorf("last chunk rejected")
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.snapshotIndex != 5 || string(cm.snapshot) != "abcdef" || cm.commitIndex != 5 {
+		t.Errorf("got snapshot index=%d data=%q commitIndex=%d, want 5, \"abcdef\", 5", cm.snapshotIndex, cm.snapshot, cm.commitIndex)
+	}
+}
+
+func TestAutoSnapshotAndInstall(t *testing.T) {
+	var h *Harness
+	h = NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		return &Config{
+			SnapshotThreshold:       3,
+			SnapshotEntriesRetained: 1,
+			SnapshotProvider: func() ([]byte, int, error) {
+				h.mu.Lock()
+				defer h.mu.Unlock()
+				commits := h.commits[id]
+				return []byte("snapshot"), commits[len(commits)-1].Index, nil
+			},
+			SnapshotChunkSize: 3,
+		}
+	})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	for i := 1; i <= 5; i++ {
+		h.SubmitToServer(origLeaderId, i)
+		sleepMs(30)
+	}
+	sleepMs(250)
+	h.CheckCommittedN(5, 3)
+
+	// Fall behind by more than the retained entries, so that the follower can
+	// only catch up through InstallSnapshot.
+	h.DisconnectPeer(otherId)
+	for i := 6; i <= 15; i++ {
+		h.SubmitToServer(origLeaderId, i)
+		sleepMs(30)
+	}
+	sleepMs(100)
+	h.ReconnectPeer(otherId)
+
+	// The reconnected follower has bumped its term, so leadership may change
+	// a few times before it catches up; poll until it does.
+	var leaderEnd, leaderBase, leaderLen, followerEnd, followerSnapshot int
+	for r := 0; r < 20; r++ {
+		sleepMs(250)
+		leaderId := -1
+		for i := 0; i < 3; i++ {
+			if _, _, isLeader := h.cluster[i].cm.Report(); isLeader {
+				leaderId = i
+			}
+		}
+		if leaderId < 0 {
+			continue // still electing
+		}
+		leader := h.cluster[leaderId].cm
+		follower := h.cluster[otherId].cm
+		leader.mu.Lock()
+		leaderEnd, leaderBase, leaderLen = leader.logEnd(), leader.logBase, len(leader.log)
+		leader.mu.Unlock()
+		follower.mu.Lock()
+		followerEnd, followerSnapshot = follower.logEnd(), follower.snapshotIndex
+		follower.mu.Unlock()
+		if followerEnd == leaderEnd && followerSnapshot >= 5 {
+			break
+		}
+	}
+
+	if leaderBase < 0 || leaderLen > 5 {
+		t.Errorf("leader log not compacted: logBase=%d, len=%d", leaderBase, leaderLen)
+	}
+	if followerEnd != leaderEnd || followerSnapshot < 5 {
+		t.Errorf("follower logEnd=%d snapshotIndex=%d, want logEnd=%d and snapshot installed", followerEnd, followerSnapshot, leaderEnd)
+	}
+
+	// The follower's client got the snapshot instead of the compacted entries,
+	// followed only by the entries after it.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	commits := h.commits[otherId]
+	snapshotAt := -1
+	for i, c := range commits {
+		if c.Snapshot != nil {
+			snapshotAt = i
+		}
+	}
+	if snapshotAt < 0 {
+		t.Fatalf("follower commits %+v have no snapshot", commits)
+	}
+	snapshot := commits[snapshotAt]
+	if string(snapshot.Snapshot) != "snapshot" || snapshot.Index < 5 || snapshot.Command != nil {
+		t.Errorf("snapshot commit = %+v", snapshot)
+	}
+	for i, c := range commits[snapshotAt+1:] {
+		if want := snapshot.Index + i + 1; c.Index != want {
+			t.Errorf("commit after snapshot has index %d, want %d", c.Index, want)
+		}
+	}
+}
+
+func TestColdNodeCatchesUpFromSnapshot(t *testing.T) {
+	var h *Harness
+	h = NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		return &Config{
+			SnapshotThreshold:       3,
+			SnapshotEntriesRetained: 1,
+			SnapshotProvider: func() ([]byte, int, error) {
+				h.mu.Lock()
+				defer h.mu.Unlock()
+				commits := h.commits[id]
+				return []byte("snapshot"), commits[len(commits)-1].Index, nil
+			},
+		}
+	})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	newId := (origLeaderId + 1) % 3
+	h.CrashPeer(newId)
+	for i := 1; i <= 10; i++ {
+		h.SubmitToServer(origLeaderId, i)
+		sleepMs(30)
+	}
+	sleepMs(100)
+
+	// The node comes back with nothing at all; the leader no longer has the
+	// start of its log, so the node must be seeded from the snapshot.
+	h.RestartPeerEmpty(newId)
+	var leaderEnd, leaderBase, followerEnd, followerSnapshot int
+	for r := 0; r < 20; r++ {
+		sleepMs(250)
+		leaderId := -1
+		for i := 0; i < 3; i++ {
+			if _, _, isLeader := h.cluster[i].cm.Report(); isLeader {
+				leaderId = i
+			}
+		}
+		if leaderId < 0 {
+			continue // still electing
+		}
+		leader := h.cluster[leaderId].cm
+		follower := h.cluster[newId].cm
+		leader.mu.Lock()
+		leaderEnd, leaderBase = leader.logEnd(), leader.logBase
+		leader.mu.Unlock()
+		follower.mu.Lock()
+		followerEnd, followerSnapshot = follower.logEnd(), follower.snapshotIndex
+		follower.mu.Unlock()
+		if followerEnd == leaderEnd && followerSnapshot >= 0 {
+			break
+		}
+	}
+	if leaderBase <= 0 {
+		t.Errorf("leader log not compacted: logBase=%d", leaderBase)
+	}
+	if followerEnd != leaderEnd || followerSnapshot < 0 {
+		t.Errorf("new node logEnd=%d snapshotIndex=%d, want logEnd=%d and snapshot installed", followerEnd, followerSnapshot, leaderEnd)
+	}
+
+	// The client of the new node starts from the snapshot and then gets the
+	// tail entries in order.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	commits := h.commits[newId]
+	if len(commits) == 0 || commits[0].Snapshot == nil {
+		t.Fatalf("new node commits %+v don't start with a snapshot", commits)
+	}
+	for i, c := range commits[1:] {
+		if want := commits[0].Index + i + 1; c.Index != want {
+			t.Errorf("commit after snapshot has index %d, want %d", c.Index, want)
+		}
+	}
+}
+
+func TestFollowerRead(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+	_, index := h.CheckCommitted(5)
+
+	otherId := (origLeaderId + 1) % 3
+	applied, err := h.cluster[otherId].cm.FollowerRead(100 * time.Millisecond)
+	if err != nil || applied != index {
+		t.Errorf("FollowerRead got (%d, %v), want (%d, nil)", applied, err, index)
+	}
+	if _, err := h.cluster[origLeaderId].cm.FollowerRead(time.Second); err != ErrStaleRead {
+		t.Errorf("FollowerRead on leader got err=%v, want ErrStaleRead", err)
+	}
+
+	// A partitioned follower stops hearing from the leader.
+	h.DisconnectPeer(otherId)
+	sleepMs(120)
+	if _, err := h.cluster[otherId].cm.FollowerRead(100 * time.Millisecond); err != ErrStaleRead {
+		t.Errorf("FollowerRead without leader got err=%v, want ErrStaleRead", err)
+	}
+}
+
+func TestHealthyAndReady(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+	h.CheckCommitted(5)
+
+	for i := 0; i < 3; i++ {
+		cm := h.cluster[i].cm
+		if !cm.Healthy() || !cm.Ready() {
+			t.Errorf("server %d: Healthy=%v Ready=%v, want both true", i, cm.Healthy(), cm.Ready())
+		}
+	}
+
+	cm := h.cluster[origLeaderId].cm
+	h.CrashPeer(origLeaderId)
+	sleepMs(50)
+	if cm.Healthy() || cm.Ready() {
+		t.Errorf("crashed server: Healthy=%v Ready=%v, want both false", cm.Healthy(), cm.Ready())
+	}
+}
+
+func TestHealthyNeedsElectionTimer(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	if !cm.Healthy() {
+		t.Fatalf("fresh node reports unhealthy")
+	}
+	// The ready channel is never closed, so the timer hasn't started and
+	// closing its done channel here stands in for it exiting unexpectedly.
+	close(cm.electionTimerDone)
+	if cm.Healthy() {
+		t.Errorf("node without an election timer reports healthy")
+	}
+}
+
+func TestSingleNodeCommits(t *testing.T) {
+	h := NewHarness(t, 1)
+	defer h.Shutdown()
+
+	h.CheckSingleLeader()
+	for cmd := 5; cmd < 8; cmd++ {
+		if !h.SubmitToServer(0, cmd) {
+			t.Fatalf("want single node to be leader")
+		}
+	}
+	sleepMs(50)
+	h.CheckCommittedN(5, 1)
+	h.CheckCommittedN(7, 1)
+}
+
+func TestIsCommitted(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+	_, index := h.CheckCommitted(5)
+
+	for i := 0; i < 3; i++ {
+		cm := h.cluster[i].cm
+		if !cm.IsCommitted(index, origTerm) {
+			t.Errorf("server %d: IsCommitted(%d, %d) = false, want true", i, index, origTerm)
+		}
+		if cm.IsCommitted(index, origTerm+1) {
+			t.Errorf("server %d: IsCommitted(%d, %d) = true, want false", i, index, origTerm+1)
+		}
+		if cm.IsCommitted(index+1, origTerm) {
+			t.Errorf("server %d: IsCommitted(%d, %d) = true, want false", i, index+1, origTerm)
+		}
+	}
+}
+
+func TestIsLeaderWithLease(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	sleepMs(100)
+	leader := h.cluster[origLeaderId].cm
+	if !leader.IsLeaderWithLease() {
+		t.Errorf("want leader %d to hold a lease", origLeaderId)
+	}
+	otherId := (origLeaderId + 1) % 3
+	if h.cluster[otherId].cm.IsLeaderWithLease() {
+		t.Errorf("want follower %d to hold no lease", otherId)
+	}
+
+	// Cut the leader off from its followers: it still believes it's leader,
+	// but its lease runs out.
+	h.cluster[origLeaderId].DisconnectAll()
+	sleepMs(200)
+	if _, _, isLeader := leader.Report(); isLeader && leader.IsLeaderWithLease() {
+		t.Errorf("want partitioned leader %d to lose its lease", origLeaderId)
+	}
+}
+
+func TestCommittedEntries(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	for cmd := 5; cmd <= 7; cmd++ {
+		h.SubmitToServer(origLeaderId, cmd)
+	}
+	sleepMs(250)
+	_, index := h.CheckCommitted(6)
+
+	otherId := (origLeaderId + 1) % 3
+	entries, err := h.cluster[otherId].cm.CommittedEntries(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Command != 6 || entries[1].Command != 7 || entries[0].Index != index {
+		t.Errorf("CommittedEntries(%d) got %+v, want commands 6 and 7", index, entries)
+	}
+}
+
+// newTestCM creates a standalone follower that never starts an election, for
+// driving RPC handlers directly.
+func newTestCM(t *testing.T) (*ConsensusModule, chan CommitEntry) {
+	commitChan := make(chan CommitEntry, 16)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm, commitChan
+}
+
+func TestSubmitAfterStepDown(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.becomeFollower(2)
+	cm.mu.Unlock()
+
+	if cm.Submit(5) {
+		t.Errorf("Submit succeeded after stepping down")
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if len(cm.log) != 0 {
+		t.Errorf("log = %v after rejected Submit, want empty", cm.log)
+	}
+}
+
+func TestCommitEntryCarriesEntryTerm(t *testing.T) {
+	cm, commitChan := newTestCM(t)
+	defer cm.Stop()
+
+	// A term 3 leader commits entries appended in terms 1 and 2.
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 3, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 1,
+		Entries: []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 2}},
+	}, &reply)
+	for i, want := range []int{1, 2} {
+		if got := <-commitChan; got.Term != want {
+			t.Errorf("commit %d: Term = %d, want %d", i, got.Term, want)
+		}
+	}
+}
+
+func TestMaxTermGap(t *testing.T) {
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), &Config{MaxTermGap: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// A runaway node's absurd term is ignored instead of adopted.
+	var rvReply RequestVoteReply
+	cm.RequestVote(RequestVoteArgs{Term: 1000, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &rvReply)
+	if rvReply.VotedGranted || rvReply.Term != 0 {
+		t.Errorf("got %+v for RequestVote in term 1000, want a rejection in term 0", rvReply)
+	}
+	var aeReply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 1000, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}, &aeReply)
+	if aeReply.Success || aeReply.Term != 0 {
+		t.Errorf("got %+v for AppendEntries in term 1000, want a rejection in term 0", aeReply)
+	}
+	if _, term, _ := cm.Report(); term != 0 {
+		t.Errorf("term jumped to %d", term)
+	}
+	if got := cm.Metrics().RejectedTerms; got != 2 {
+		t.Errorf("got RejectedTerms=%d, want 2", got)
+	}
+
+	// Terms within the gap are handled as usual.
+	cm.RequestVote(RequestVoteArgs{Term: 5, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &rvReply)
+	if !rvReply.VotedGranted || rvReply.Term != 5 {
+		t.Errorf("got %+v for RequestVote in term 5, want a vote in term 5", rvReply)
+	}
+}
+
+func TestNoopStorage(t *testing.T) {
+	commitChan := make(chan CommitEntry, 16)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NoopStorage{}, make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 0,
+		Entries: []LogEntry{{Command: 5, Term: 1}},
+	}, &reply)
+	if !reply.Success {
+		t.Fatalf("AppendEntries failed")
+	}
+	if got := <-commitChan; got.Command != 5 {
+		t.Errorf("got commit %+v, want command 5", got)
+	}
+	if cm.storage.HasData() {
+		t.Errorf("NoopStorage has data")
+	}
+}
+
+func TestMapStorageClone(t *testing.T) {
+	ms := NewMapStorage()
+	commitChan := make(chan CommitEntry, 16)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, ms, make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 0,
+		Entries: []LogEntry{{Command: 5, Term: 1}},
+	}, &reply)
+	<-commitChan
+	cm.Stop()
+
+	// Writes to either copy after cloning don't show up in the other one.
+	clone := ms.Clone()
+	ms.Set("currentTerm", []byte("garbage"))
+	clone.Set("extra", []byte{1})
+	if _, found := ms.Get("extra"); found {
+		t.Errorf("write to the clone is visible in the original")
+	}
+	if v, _ := clone.Get("currentTerm"); string(v) == "garbage" {
+		t.Errorf("write to the original is visible in the clone")
+	}
+
+	// The clone restores the state persisted before it was taken.
+	cm, err = NewConsensusModule(0, []int{1, 2}, nil, clone, make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	if _, term, _ := cm.Report(); term != 1 {
+		t.Errorf("restored term %d from the clone, want 1", term)
+	}
+	cm.mu.Lock()
+	logLen := len(cm.log)
+	cm.mu.Unlock()
+	if logLen != 1 {
+		t.Errorf("restored %d log entries from the clone, want 1", logLen)
+	}
+}
+
+func TestSetLastApplied(t *testing.T) {
+	ms := NewMapStorage()
+	commitChan := make(chan CommitEntry, 16)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, ms, make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 1,
+		Entries: []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}},
+	}, &reply)
+	for i := 0; i < 2; i++ {
+		<-commitChan
+	}
+	cm.Stop()
+
+	// The client persisted its state machine up to index 1 before crashing.
+	ready := make(chan interface{})
+	cm, err = NewConsensusModule(0, []int{1, 2}, nil, ms, ready, commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	if err := cm.SetLastApplied(3); err == nil {
+		t.Errorf("SetLastApplied beyond the log end succeeded")
+	}
+	if err := cm.SetLastApplied(1); err != nil {
+		t.Fatal(err)
+	}
+	close(ready)
+
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: 2, PrevLogTerm: 1, LeaderCommit: 2}, &reply)
+	if got := <-commitChan; got.Index != 2 || got.Command != 3 {
+		t.Errorf("got commit %+v after restart, want only index 2", got)
+	}
+	if err := cm.SetLastApplied(2); err == nil {
+		t.Errorf("SetLastApplied after delivering commits succeeded")
+	}
+}
+
+func TestAppendEntriesRejectsMalformedEntries(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 2, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1,
+		Entries: []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 2}}}, &reply)
+	if !reply.Success {
+		t.Fatalf("well-formed AppendEntries rejected")
+	}
+
+	for _, args := range []AppendEntriesArgs{
+		// Terms going backwards mean the entries are out of order.
+		{Term: 2, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 2, LeaderCommit: -1, Entries: []LogEntry{{Command: 3, Term: 2}, {Command: 4, Term: 1}}},
+		{Term: 2, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 2, LeaderCommit: -1, Entries: []LogEntry{{Command: 3, Term: 1}}},
+		// A leader can't have entries from a later term than its own.
+		{Term: 2, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 2, LeaderCommit: -1, Entries: []LogEntry{{Command: 3, Term: 3}}},
+		{Term: 2, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 2, LeaderCommit: -1, Entries: []LogEntry{{Command: 3, Term: 2, Type: EntryType(7)}}},
+		{Term: 2, LeaderId: 1, PrevLogIndex: -3, PrevLogTerm: -1, LeaderCommit: -1},
+	} {
+		reply = AppendEntriesReply{}
+		cm.AppendEntries(args, &reply)
+		if reply.Success || reply.Term != 2 {
+			t.Errorf("got %+v for malformed %+v, want a rejection in term 2", reply, args)
+		}
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if len(cm.log) != 2 {
+		t.Errorf("log has %d entries after malformed requests, want 2", len(cm.log))
+	}
+}
+
+func TestVotePersistedBeforeReply(t *testing.T) {
+	ms := NewMapStorage()
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, ms, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply RequestVoteReply
+	cm.RequestVote(RequestVoteArgs{Term: 3, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &reply)
+	if !reply.VotedGranted {
+		t.Fatalf("vote not granted")
+	}
+	// Crash right after replying: the restarted node must remember the vote.
+	cm.Stop()
+	cm, err = NewConsensusModule(0, []int{1, 2}, nil, ms, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { cm.Stop() }()
+	cm.RequestVote(RequestVoteArgs{Term: 3, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1}, &reply)
+	if reply.VotedGranted {
+		t.Errorf("restarted node voted twice in term 3")
+	}
+
+	// A heartbeat from a later term is persisted before it is acknowledged.
+	var aeReply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 5, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}, &aeReply)
+	cm.Stop()
+	cm, err = NewConsensusModule(0, []int{1, 2}, nil, ms, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, term, _ := cm.Report(); term != 5 {
+		t.Errorf("restarted in term %d after acknowledging term 5", term)
+	}
+}
+
+func TestCandidateKeepsVoteWhenLeaderAppears(t *testing.T) {
+	sent := make(chan AppendEntriesArgs, 16)
+	cm, err := NewConsensusModule(0, []int{1, 2}, recordAppendEntries(sent), NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.startElection(false)
+	term := cm.currentTerm
+	cm.mu.Unlock()
+
+	// The leader of the same term shows up; the candidate already voted for
+	// itself in this term and can't vote for anyone else.
+	var aeReply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: term, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}, &aeReply)
+	var reply RequestVoteReply
+	cm.RequestVote(RequestVoteArgs{Term: term, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1, LeadershipTransfer: true}, &reply)
+	if reply.VotedGranted {
+		t.Errorf("node voted for 2 after voting for itself in term %d", term)
+	}
+}
+
+func TestAppendEntriesDelayedPrefix(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	entries := []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}}
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1, Entries: entries}, &reply)
+
+	// An earlier AppendEntries carrying only a prefix arrives late, and a
+	// duplicate of the first one arrives after that.
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1, Entries: entries[:1]}, &reply)
+	if !reply.Success {
+		t.Errorf("delayed prefix rejected")
+	}
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: 0, PrevLogTerm: 1, LeaderCommit: -1, Entries: entries[1:2]}, &reply)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if len(cm.log) != 3 {
+		t.Errorf("log = %v, want all 3 entries kept", cm.log)
+	}
+}
+
+func TestAppendEntriesConflictWithCommitted(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 2, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 1,
+		Entries: []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 2}},
+	}, &reply)
+
+	// Nothing at or below commitIndex may be overwritten.
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 2, LeaderId: 1, PrevLogIndex: 0, PrevLogTerm: 1, LeaderCommit: 1,
+		Entries: []LogEntry{{Command: 9, Term: 1}},
+	}, &reply)
+	if reply.Success {
+		t.Errorf("AppendEntries overwriting a committed entry succeeded")
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if len(cm.log) != 2 || cm.log[1].Command != 2 {
+		t.Errorf("log = %v, want committed entries intact", cm.log)
+	}
+}
+
+func TestVoteRejectionReasons(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.log = []LogEntry{{Command: 1, Term: 2}}
+	cm.mu.Unlock()
+
+	vote := func(args RequestVoteArgs) bool {
+		var reply RequestVoteReply
+		cm.RequestVote(args, &reply)
+		return reply.VotedGranted
+	}
+	if !vote(RequestVoteArgs{Term: 3, CandidateId: 1, LastLogIndex: 0, LastLogTerm: 2}) {
+		t.Fatalf("vote for an up-to-date candidate not granted")
+	}
+	cases := []struct {
+		args RequestVoteArgs
+		want VoteRejection
+	}{
+		{RequestVoteArgs{Term: 2, CandidateId: 2, LastLogIndex: 0, LastLogTerm: 2}, VoteRejectedStaleTerm},
+		{RequestVoteArgs{Term: 3, CandidateId: 2, LastLogIndex: 0, LastLogTerm: 2}, VoteRejectedAlreadyVoted},
+		{RequestVoteArgs{Term: 4, CandidateId: 2, LastLogIndex: 5, LastLogTerm: 1}, VoteRejectedStaleLog},
+		{RequestVoteArgs{Term: 4, CandidateId: 2, LastLogIndex: 0, LastLogTerm: 2, PreVote: true}, VoteRejectedStaleTerm},
+	}
+	for _, c := range cases {
+		before := cm.Metrics().VoteRejections[c.want]
+		if vote(c.args) {
+			t.Errorf("vote granted for %+v", c.args)
+		}
+		if got := cm.Metrics().VoteRejections[c.want]; got != before+1 {
+			t.Errorf("%+v: %v rejections went from %d to %d, want one more", c.args, c.want, before, got)
+		}
+	}
+}
+
+// pinnedLeaderStrategy only lets one node start elections and collect votes.
+type pinnedLeaderStrategy struct {
+	StandardElection
+	leader  int
+	mu      sync.Mutex
+	replies int
+}
+
+func (p *pinnedLeaderStrategy) ShouldStartElection(s ElectionState) bool {
+	return s.Id == p.leader
+}
+
+func (p *pinnedLeaderStrategy) OnVoteRequest(args RequestVoteArgs, s ElectionState) VoteDecision {
+	if args.CandidateId != p.leader {
+		return VoteDeny
+	}
+	return VoteAllow
+}
+
+func (p *pinnedLeaderStrategy) OnVoteReply(peerId int, args RequestVoteArgs, reply RequestVoteReply) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replies++
+}
+
+func TestElectionStrategy(t *testing.T) {
+	strategies := make([]*pinnedLeaderStrategy, 3)
+	h := NewHarnessWithConfigs(t, 3, func(id int) *Config {
+		strategies[id] = &pinnedLeaderStrategy{leader: 2}
+		return &Config{ElectionStrategy: strategies[id]}
+	})
+	defer h.Shutdown()
+
+	if leaderId, _ := h.CheckSingleLeader(); leaderId != 2 {
+		t.Errorf("got leader %d, want the pinned node 2", leaderId)
+	}
+	strategies[2].mu.Lock()
+	replies := strategies[2].replies
+	strategies[2].mu.Unlock()
+	if replies == 0 {
+		t.Errorf("strategy saw no vote replies on the pinned node")
+	}
+
+	// Nobody else may take over, even with the leader gone.
+	h.DisconnectPeer(2)
+	sleepMs(700)
+	h.CheckNoLeader()
+}
+
+func TestVoteWithFullyCompactedLog(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	// Everything up to index 4 (term 2) is in a snapshot; the log is empty.
+	cm.mu.Lock()
+	cm.currentTerm = 2
+	cm.installSnapshot(4, 2, []byte("s"))
+	if index, term := cm.lastLogIndexAndTerm(); index != 4 || term != 2 {
+		t.Errorf("lastLogIndexAndTerm() = (%d, %d), want (4, 2)", index, term)
+	}
+	cm.mu.Unlock()
+
+	var reply RequestVoteReply
+	cm.RequestVote(RequestVoteArgs{Term: 3, CandidateId: 1, LastLogIndex: 1, LastLogTerm: 1}, &reply)
+	if reply.VotedGranted {
+		t.Errorf("voted for a candidate whose log is behind the snapshot")
+	}
+	cm.RequestVote(RequestVoteArgs{Term: 3, CandidateId: 2, LastLogIndex: 4, LastLogTerm: 2}, &reply)
+	if !reply.VotedGranted {
+		t.Errorf("refused a candidate whose log matches the snapshot")
+	}
+}
+
+// failingStorage is a MapStorage whose SetBatch fails the next failures
+// times, or always if failures is negative.
+type failingStorage struct {
+	*MapStorage
+	mu       sync.Mutex
+	failures int
+}
+
+func (fs *failingStorage) SetBatch(kv map[string][]byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.failures != 0 {
+		if fs.failures > 0 {
+			fs.failures--
+		}
+		return errors.New("disk hiccup")
+	}
+	return fs.MapStorage.SetBatch(kv)
+}
+
+func TestPersistRetriesTransientFailure(t *testing.T) {
+	storage := &failingStorage{MapStorage: NewMapStorage(), failures: 2}
+	config := &Config{PersistRetries: 3, PersistRetryBackoff: time.Millisecond}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	if ok := cm.Submit(1); !ok || !cm.Healthy() {
+		t.Errorf("got submitted=%v, healthy=%v after a transient failure; want both true", ok, cm.Healthy())
+	}
+	if !storage.HasData() {
+		t.Errorf("state not persisted after retrying")
+	}
+}
+
+func TestPersistRetryUsesClock(t *testing.T) {
+	storage := &failingStorage{MapStorage: NewMapStorage(), failures: 1}
+	clock := NewFakeClock()
+	config := &Config{Clock: clock, PersistRetryBackoff: 10 * time.Millisecond}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	done := make(chan bool)
+	go func() { done <- cm.Submit(1) }()
+	select {
+	case <-done:
+		t.Fatalf("Submit returned before the retry backoff elapsed on the fake clock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(10 * time.Millisecond)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("Submit failed although the retry succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Submit still blocked after advancing the clock")
+	}
+}
+
+func TestPersistRetryWaitIsBounded(t *testing.T) {
+	storage := &failingStorage{MapStorage: NewMapStorage(), failures: -1}
+	config := &Config{PersistRetries: 10, PersistRetryBackoff: 10 * time.Millisecond}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	// Ten doubling retries would hold the lock for over ten seconds.
+	start := time.Now()
+	if cm.Submit(1) {
+		t.Errorf("Submit succeeded although persisting failed")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("persist retries held the lock for %v", elapsed)
+	}
+}
+
+func TestPersistFailureDegradesLeader(t *testing.T) {
+	storage := &failingStorage{MapStorage: NewMapStorage(), failures: -1}
+	errs := make(chan error, 1)
+	config := &Config{PersistRetries: 2, PersistRetryBackoff: time.Millisecond, OnPersistError: func(err error) { errs <- err }}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	if cm.Submit(5) {
+		t.Errorf("Submit succeeded although persisting failed")
+	}
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Errorf("OnPersistError not called")
+	}
+	if _, _, isLeader := cm.Report(); isLeader {
+		t.Errorf("degraded node is still leader")
+	}
+	if cm.Healthy() {
+		t.Errorf("degraded node reports healthy")
+	}
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}, &reply)
+	if reply.Success {
+		t.Errorf("degraded node acknowledged AppendEntries")
+	}
+}
+
+func TestPreAppendHook(t *testing.T) {
+	errOdd := errors.New("odd command")
+	h := NewHarnessWithConfig(t, 3, &Config{PreAppendHook: func(command interface{}) error {
+		if command.(int)%2 != 0 {
+			return errOdd
+		}
+		return nil
+	}})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	cm := h.cluster[origLeaderId].cm
+	if cm.Submit(3) {
+		t.Errorf("Submit accepted a vetoed command")
+	}
+	if _, err := cm.ProposeAndWait(context.Background(), 5); err != errOdd {
+		t.Errorf("ProposeAndWait got err %v, want %v", err, errOdd)
+	}
+	if err := cm.SubmitWithCallback(7, func(CommitEntry, error) {}); err != errOdd {
+		t.Errorf("SubmitWithCallback got err %v, want %v", err, errOdd)
+	}
+	h.SubmitToServer(origLeaderId, 4)
+	sleepMs(250)
+
+	// Only the accepted command made it into the log.
+	h.CheckCommittedN(4, 3)
+	h.CheckNotCommitted(3)
+	h.CheckNotCommitted(5)
+	h.CheckNotCommitted(7)
+}
+
+func TestProposeWithPersistFailure(t *testing.T) {
+	storage := &failingStorage{MapStorage: NewMapStorage(), failures: -1}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), &Config{PersistRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	if err := cm.SubmitWithCallback(5, func(CommitEntry, error) {}); err != ErrNotLeader {
+		t.Errorf("SubmitWithCallback got err %v, want ErrNotLeader", err)
+	}
+	cm.mu.Lock()
+	pending := len(cm.pending)
+	cm.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("got %d pending proposals, want none", pending)
+	}
+}
+
+// recordingStorage is a MapStorage that remembers the keys of every batch
+// written to it.
+type recordingStorage struct {
+	*MapStorage
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (rs *recordingStorage) SetBatch(kv map[string][]byte) error {
+	rs.mu.Lock()
+	var keys []string
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	rs.batches = append(rs.batches, keys)
+	rs.mu.Unlock()
+	return rs.MapStorage.SetBatch(kv)
+}
+
+func TestPersistOnlyDirtyState(t *testing.T) {
+	storage := &recordingStorage{MapStorage: NewMapStorage()}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	// The first write of a fresh node has everything; after that, appending
+	// only rewrites the log.
+	cm.Submit(1)
+	cm.Submit(2)
+	storage.mu.Lock()
+	batches := storage.batches
+	storage.mu.Unlock()
+	if len(batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(batches))
+	}
+	if len(batches[0]) != 4 {
+		t.Errorf("first batch wrote %v, want all state", batches[0])
+	}
+	if len(batches[1]) != 1 || batches[1][0] != "log" {
+		t.Errorf("second batch wrote %v, want only the log", batches[1])
+	}
+	cm.Stop()
+
+	restarted, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+	restarted.mu.Lock()
+	defer restarted.mu.Unlock()
+	if restarted.currentTerm != 1 || len(restarted.log) != 2 {
+		t.Errorf("restored term=%d log=%v, want term 1 and 2 entries", restarted.currentTerm, restarted.log)
+	}
+}
+
+func TestPersistBatchInterval(t *testing.T) {
+	storage := &recordingStorage{MapStorage: NewMapStorage()}
+	clock := NewFakeClock()
+	config := &Config{Clock: clock, PersistBatchInterval: 10 * time.Millisecond}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	if d := cm.PersistBatchInterval(); d != 10*time.Millisecond {
+		t.Errorf("PersistBatchInterval() = %v, want 10ms", d)
+	}
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	// Concurrent submits land in the same batch and don't return until it's
+	// written.
+	results := make(chan bool, 5)
+	for i := 0; i < 5; i++ {
+		go func(i int) { results <- cm.Submit(i) }(i)
+	}
+	for {
+		cm.mu.Lock()
+		n := len(cm.log)
+		cm.mu.Unlock()
+		if n == 5 {
+			break
+		}
+		sleepMs(1)
+	}
+	select {
+	case ok := <-results:
+		t.Fatalf("Submit returned %v before its batch was persisted", ok)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if ok := <-results; !ok {
+			t.Errorf("Submit failed")
+		}
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if len(storage.batches) != 1 {
+		t.Errorf("got %d writes for 5 submits, want 1", len(storage.batches))
+	}
+}
+
+// unregisteredCommand is never passed to gob.Register, so GobCodec can't
+// encode it as a command.
+type unregisteredCommand struct{ X int }
+
+func TestSubmitUnencodableCommand(t *testing.T) {
+	storage := NewMapStorage()
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	if cm.Submit(unregisteredCommand{1}) {
+		t.Errorf("Submit accepted a command that can't be encoded")
+	}
+	if err := cm.SubmitWithCallback(unregisteredCommand{2}, func(CommitEntry, error) {}); err == nil {
+		t.Errorf("SubmitWithCallback accepted a command that can't be encoded")
+	}
+
+	// Nothing was appended and the node is still fine.
+	if !cm.Healthy() {
+		t.Errorf("node unhealthy after rejecting a command")
+	}
+	if !cm.Submit(5) {
+		t.Errorf("Submit(5) rejected")
+	}
+	cm.mu.Lock()
+	entries := fmt.Sprint(cm.log)
+	cm.mu.Unlock()
+	if entries != "[{5 1 Normal}]" {
+		t.Errorf("log = %s, want only cmd 5", entries)
+	}
+}
+
+func TestMaxCommandBytes(t *testing.T) {
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), &Config{MaxCommandBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	big := strings.Repeat("x", 100)
+	if cm.Submit(big) {
+		t.Errorf("Submit accepted an oversized command")
+	}
+	if _, ok := cm.SubmitIfIndex(-1, big); ok {
+		t.Errorf("SubmitIfIndex accepted an oversized command")
+	}
+	if err := cm.SubmitWithCallback(big, func(CommitEntry, error) {}); err != ErrTooLarge {
+		t.Errorf("SubmitWithCallback got err %v, want ErrTooLarge", err)
+	}
+	if _, err := cm.ProposeAndWait(context.Background(), big); err != ErrTooLarge {
+		t.Errorf("ProposeAndWait got err %v, want ErrTooLarge", err)
+	}
+	if !cm.Submit("small") {
+		t.Errorf("Submit rejected a command under the limit")
+	}
+	cm.mu.Lock()
+	entries := len(cm.log)
+	cm.mu.Unlock()
+	if entries != 1 {
+		t.Errorf("got %d log entries, want only the small command", entries)
+	}
+}
+
+func TestApplyLag(t *testing.T) {
+	commitChan := make(chan CommitEntry)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// Nobody reads commitChan yet, so the committed entries pile up.
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 2,
+		Entries: []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}},
+	}, &reply)
+	sleepMs(20)
+	if got := cm.ApplyLag(); got != 3 {
+		t.Errorf("ApplyLag() = %d before reading commitChan, want 3", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		<-commitChan
+	}
+	sleepMs(20)
+	if got := cm.ApplyLag(); got != 0 {
+		t.Errorf("ApplyLag() = %d after reading commitChan, want 0", got)
+	}
+	if got := cm.Metrics().ApplyLag; got != 0 {
+		t.Errorf("Metrics().ApplyLag = %d, want 0", got)
+	}
+}
+
+// appendThreeCommitted has a follower cm append and commit three entries, as if
+// sent by leader 1.
+func appendThreeCommitted(cm *ConsensusModule) {
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 2,
+		Entries: []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}},
+	}, &reply)
+	sleepMs(20)
+}
+
+func TestApplyBufferPolicy(t *testing.T) {
+	commitChan := make(chan CommitEntry)
+	config := &Config{ApplyBackpressurePolicy: ApplyBuffer, ApplyBufferSize: 2}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), commitChan, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// One entry waits on commitChan, the other two sit in the buffer.
+	appendThreeCommitted(cm)
+	if m := cm.Metrics(); m.ApplyBufferLen != 2 || m.ApplyLag != 3 {
+		t.Errorf("got ApplyBufferLen=%d ApplyLag=%d, want 2 and 3", m.ApplyBufferLen, m.ApplyLag)
+	}
+	for want := 1; want <= 3; want++ {
+		if c := <-commitChan; c.Command != want {
+			t.Errorf("got command %v, want %d", c.Command, want)
+		}
+	}
+	sleepMs(20)
+	if m := cm.Metrics(); m.ApplyBufferLen != 0 || m.ApplyLag != 0 {
+		t.Errorf("got ApplyBufferLen=%d ApplyLag=%d after reading, want 0 and 0", m.ApplyBufferLen, m.ApplyLag)
+	}
+}
+
+func TestApplyBufferMetrics(t *testing.T) {
+	commitChan := make(chan CommitEntry)
+	config := &Config{ApplyBackpressurePolicy: ApplyBuffer, ApplyBufferSize: 1}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), commitChan, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// At most one entry waits on commitChan and one fills the buffer, so the
+	// third finds it full; the second may too if it beats the forwarder.
+	appendThreeCommitted(cm)
+	if m := cm.Metrics(); m.ApplyBufferFull < 1 || m.ApplyBufferMaxLen != 1 {
+		t.Errorf("got ApplyBufferFull=%d ApplyBufferMaxLen=%d, want at least 1 and 1", m.ApplyBufferFull, m.ApplyBufferMaxLen)
+	}
+	for i := 0; i < 3; i++ {
+		<-commitChan
+	}
+	sleepMs(20)
+	if m := cm.Metrics(); m.ApplyBufferLen != 0 || m.ApplyBufferMaxLen != 1 {
+		t.Errorf("got ApplyBufferLen=%d ApplyBufferMaxLen=%d after reading, want 0 and 1", m.ApplyBufferLen, m.ApplyBufferMaxLen)
+	}
+}
+
+func TestApplyDropPolicy(t *testing.T) {
+	config := &Config{ApplyBackpressurePolicy: ApplyDrop}
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// Nobody reads commitChan, so everything is dropped instead of piling up.
+	appendThreeCommitted(cm)
+	if m := cm.Metrics(); m.DroppedCommits != 3 || m.ApplyLag != 0 {
+		t.Errorf("got DroppedCommits=%d ApplyLag=%d, want 3 and 0", m.DroppedCommits, m.ApplyLag)
+	}
+}
+
+func TestWaitForApplied(t *testing.T) {
+	commitChan := make(chan CommitEntry)
+	cm, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), commitChan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 1,
+		Entries: []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}},
+	}, &reply)
+
+	// Committed isn't enough, the entries have to reach commitChan.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cm.WaitForApplied(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("WaitForApplied got err %v before reading commitChan, want DeadlineExceeded", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cm.WaitForApplied(context.Background(), 1) }()
+	<-commitChan
+	<-commitChan
+	if err := <-done; err != nil {
+		t.Errorf("WaitForApplied got err %v, want nil", err)
+	}
+
+	go func() { done <- cm.WaitForApplied(context.Background(), 5) }()
+	sleepMs(20)
+	cm.Stop()
+	if err := <-done; err != ErrStopped {
+		t.Errorf("WaitForApplied got err %v after Stop, want ErrStopped", err)
+	}
+}
+
+func TestQuorumSizeValidation(t *testing.T) {
+	for _, tt := range []struct {
+		replication, election int
+		ok                    bool
+	}{
+		{0, 0, true},
+		{3, 2, true},
+		{1, 3, true},
+		{1, 2, false}, // replication and election quorums may not intersect
+		{3, 1, false}, // two candidates could win the same term
+		{4, 2, false},
+	} {
+		config := &Config{ReplicationQuorumSize: tt.replication, ElectionQuorumSize: tt.election}
+		_, err := NewConsensusModule(0, []int{1, 2}, nil, NewMapStorage(), make(chan interface{}), make(chan CommitEntry), config)
+		if (err == nil) != tt.ok {
+			t.Errorf("replication=%d, election=%d: got err %v, want ok=%v", tt.replication, tt.election, err, tt.ok)
+		}
+	}
+}
+
+func TestAppendEntriesCommitIndexEmptyLog(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 0}, &reply)
+	if !reply.Success {
+		t.Errorf("heartbeat on empty log rejected")
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.commitIndex != -1 {
+		t.Errorf("commitIndex got %d, want -1", cm.commitIndex)
+	}
+}
+
+func TestAppendEntriesCommitIndexPartialAppend(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	commitIndex := func() int {
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		return cm.commitIndex
+	}
+
+	// The leader has committed further than what it sends in this call.
+	var reply AppendEntriesReply
+	entries := []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}}
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, Entries: entries, LeaderCommit: 5}, &reply)
+	if got := commitIndex(); got != 1 {
+		t.Errorf("commitIndex got %d, want 1", got)
+	}
+
+	// A heartbeat that only vouches for index 0 must not move commitIndex back.
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: 0, PrevLogTerm: 1, LeaderCommit: 0}, &reply)
+	if got := commitIndex(); got != 1 {
+		t.Errorf("commitIndex got %d after stale heartbeat, want 1", got)
+	}
+
+	// A stale follower entry beyond what the leader confirmed is not committed.
+	cm.mu.Lock()
+	cm.log = append(cm.log, LogEntry{Command: 3, Term: 1})
+	cm.mu.Unlock()
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 1, LeaderCommit: 5}, &reply)
+	if got := commitIndex(); got != 1 {
+		t.Errorf("commitIndex got %d with unconfirmed entry, want 1", got)
+	}
+}
+
+func TestSendAppendEntriesOutOfRangeNextIndex(t *testing.T) {
+	calls := make(chan string, 16)
+	cm, err := NewConsensusModule(0, []int{1}, recordCalls(calls), NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// Log indices 0..4 are compacted into a snapshot; 5..7 are in the log.
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.log = []LogEntry{{Term: 1}, {Term: 1}, {Term: 1}}
+	cm.logBase, cm.logBaseTerm = 4, 1
+	cm.snapshot, cm.snapshotIndex, cm.snapshotTerm = []byte("s"), 4, 1
+	cm.mu.Unlock()
+
+	for _, tt := range []struct {
+		nextIndex int
+		want      string
+	}{
+		{2, "ConsensusModule.InstallSnapshot"},
+		{-3, "ConsensusModule.InstallSnapshot"},
+		{6, "ConsensusModule.AppendEntries(prev=5)"},
+		{100, "ConsensusModule.AppendEntries(prev=7)"},
+	} {
+		cm.mu.Lock()
+		cm.nextIndex[1] = tt.nextIndex
+		cm.peerRetryAt[1] = time.Time{}
+		cm.mu.Unlock()
+		cm.sendAppendEntries()
+		select {
+		case got := <-calls:
+			if got != tt.want {
+				t.Errorf("nextIndex=%d: got call %s, want %s", tt.nextIndex, got, tt.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("nextIndex=%d: no call", tt.nextIndex)
+		}
+		sleepMs(10)
+	}
+}
+
+func TestHeartbeatCarriesNoEntries(t *testing.T) {
+	sent := make(chan AppendEntriesArgs, 16)
+	cm, err := NewConsensusModule(0, []int{1}, recordAppendEntries(sent), NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.log = []LogEntry{{Term: 1}, {Term: 1}}
+	cm.commitIndex = 1
+	cm.nextIndex[1] = 2
+	cm.mu.Unlock()
+
+	cm.sendAppendEntries()
+	got := <-sent
+	if got.Entries != nil || got.PrevLogIndex != 1 || got.PrevLogTerm != 1 || got.LeaderCommit != 1 {
+		t.Errorf("got heartbeat %+v, want nil entries after index 1 with leaderCommit 1", got)
+	}
+
+	cm.mu.Lock()
+	cm.nextIndex[1] = 1
+	cm.mu.Unlock()
+	sleepMs(10)
+	cm.sendAppendEntries()
+	if got := <-sent; len(got.Entries) != 1 {
+		t.Errorf("got %d entries for a lagging peer, want 1", len(got.Entries))
+	}
+}
+
+func TestAppendEntriesLogEndHint(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+	cm.mu.Lock()
+	cm.log = []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}}
+	cm.mu.Unlock()
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: 9, PrevLogTerm: 1, LeaderCommit: -1}, &reply)
+	if reply.Success || reply.LogEnd != 2 {
+		t.Errorf("got %+v for a gap after the log, want failure with LogEnd 2", reply)
+	}
+	reply = AppendEntriesReply{}
+	cm.AppendEntries(AppendEntriesArgs{Term: 2, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 2, LeaderCommit: -1}, &reply)
+	if reply.Success || reply.LogEnd != -1 {
+		t.Errorf("got %+v for a term mismatch, want failure with LogEnd -1", reply)
+	}
+
+	// The leader jumps straight to the follower's log end.
+	leader, err := NewConsensusModule(0, []int{1}, replyAppendEntries(AppendEntriesReply{Term: 1, LogEnd: 3}), NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Stop()
+	leader.mu.Lock()
+	leader.currentTerm = 1
+	leader.state = Leader
+	for i := 0; i < 10; i++ {
+		leader.log = append(leader.log, LogEntry{Command: i, Term: 1})
+	}
+	leader.nextIndex[1] = 10
+	leader.matchIndex[1] = -1
+	leader.mu.Unlock()
+	leader.sendAppendEntries()
+	sleepMs(20)
+	leader.mu.Lock()
+	defer leader.mu.Unlock()
+	if ni := leader.nextIndex[1]; ni != 3 {
+		t.Errorf("got nextIndex %d after a LogEnd 3 hint, want 3", ni)
+	}
+}
+
+func TestSendAppendEntriesNegativeNextIndexWithoutSnapshot(t *testing.T) {
+	calls := make(chan string, 16)
+	cm, err := NewConsensusModule(0, []int{1}, recordCalls(calls), NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.log = []LogEntry{{Term: 1}}
+	cm.nextIndex[1] = -2
+	cm.mu.Unlock()
+
+	cm.sendAppendEntries()
+	if got, want := <-calls, "ConsensusModule.AppendEntries(prev=-1)"; got != want {
+		t.Errorf("got call %s, want %s", got, want)
+	}
+}
+
+func TestStaleAppendEntriesReplyAfterReelection(t *testing.T) {
+	release := make(chan struct{})
+	cm, err := NewConsensusModule(0, []int{1}, holdTermOneReplies(release), NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// A term 1 leader sends its whole log to peer 1; the reply is held back.
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.log = []LogEntry{{Term: 1}, {Term: 1}, {Term: 1}}
+	cm.startLeader()
+	cm.nextIndex[1] = 0
+	cm.mu.Unlock()
+	cm.sendAppendEntries()
+	sleepMs(20)
+
+	// It steps down and is elected again in term 2 before the reply arrives.
+	cm.mu.Lock()
+	cm.becomeFollower(2)
+	cm.startLeader()
+	cm.mu.Unlock()
+	close(release)
+	sleepMs(50)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if got := cm.matchIndex[1]; got != -1 {
+		t.Errorf("matchIndex[1] = %d after stale reply, want -1", got)
+	}
+}
+
+func TestStaleVoteAfterNewElection(t *testing.T) {
+	release := make(chan struct{})
+	cm, err := NewConsensusModule(0, []int{1, 2}, holdTermOneReplies(release), NewMapStorage(), make(chan interface{}), make(chan CommitEntry, 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// The term 1 votes are held back while the node falls back to follower
+	// and starts a new election in term 2, whose requests all fail.
+	cm.mu.Lock()
+	cm.startElection(false)
+	cm.becomeFollower(1)
+	cm.startElection(false)
+	cm.mu.Unlock()
+	close(release)
+	sleepMs(50)
+
+	if _, term, isLeader := cm.Report(); isLeader {
+		t.Errorf("became leader in term %d with votes from an earlier election", term)
+	}
+}
+
+func TestRestoreRejectsUnknownVotedFor(t *testing.T) {
+	cm, _ := newTestCM(t)
+	cm.mu.Lock()
+	cm.votedFor = 7
+	cm.persistToStorage()
+	storage := cm.storage
+	cm.mu.Unlock()
+	cm.Stop()
+
+	if _, err := NewConsensusModule(0, []int{1, 2}, nil, storage, make(chan interface{}), make(chan CommitEntry), nil); err == nil {
+		t.Errorf("want error restoring votedFor=7 with peers [1 2]")
+	}
+}
+
+func TestDuplicateLeaderDetected(t *testing.T) {
+	cm, _ := newTestCM(t)
+	defer cm.Stop()
+
+	cm.mu.Lock()
+	cm.currentTerm = 1
+	cm.state = Leader
+	cm.mu.Unlock()
+
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}, &reply)
+	if got := cm.Metrics().DuplicateLeaderDetected; got != 1 {
+		t.Errorf("DuplicateLeaderDetected got %d, want 1", got)
+	}
+	if _, _, isLeader := cm.Report(); isLeader {
+		t.Errorf("want leader to step down after seeing another leader in its term")
+	}
+}
+
+// recordingTracer records every span it starts.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name   string
+	parent SpanContext
+	sc     SpanContext
+}
+
+func (r *recordingTracer) StartSpan(name string, parent SpanContext) Span {
+	s := &recordedSpan{name: name, parent: parent}
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+	}
+	rand.Read(s.sc.SpanID[:])
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+	return s
+}
+
+func (s *recordedSpan) Context() SpanContext                       { return s.sc }
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {}
+func (s *recordedSpan) End()                                       {}
+
+func TestTracingLinksSendAndHandle(t *testing.T) {
+	tracer := &recordingTracer{}
+	h := NewHarnessWithConfig(t, 3, &Config{Tracer: tracer})
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(250)
+	h.CheckCommitted(5)
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	sent := make(map[SpanContext]string)
+	for _, s := range tracer.spans {
+		sent[s.sc] = s.name
+	}
+	linked := map[string]bool{}
+	for _, s := range tracer.spans {
+		if parentName, ok := sent[s.parent]; ok {
+			linked[parentName+" -> "+s.name] = true
+		}
+	}
+	for _, want := range []string{
+		"raft.election -> raft.RequestVote.send",
+		"raft.RequestVote.send -> raft.RequestVote.handle",
+		"raft.replicate -> raft.AppendEntries.send",
+		"raft.AppendEntries.send -> raft.AppendEntries.handle",
+	} {
+		if !linked[want] {
+			t.Errorf("no span link %q", want)
+		}
+	}
+}
+
+// BenchmarkLogGrowth appends a million entries to a log slice the way the
+// leader does, compacting every 100k entries, with and without
+// Config.InitialLogCapacity. appendCommand itself is not used because debug
+// logging prints the whole log on every append.
+func BenchmarkLogGrowth(b *testing.B) {
+	for _, capacity := range []int{0, 1 << 17} {
+		b.Run(fmt.Sprintf("capacity=%d", capacity), func(b *testing.B) {
+			cm := &ConsensusModule{config: &Config{InitialLogCapacity: capacity}}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				log := cm.newLog(nil)
+				for j := 0; j < 1000000; j++ {
+					log = append(log, LogEntry{Command: "cmd", Term: 1})
+					if len(log) == 100000 {
+						log = cm.newLog(log[len(log)-10:])
+					}
+				}
+			}
+		})
+	}
+}
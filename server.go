@@ -1,7 +1,9 @@
 package raft
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -11,6 +13,44 @@ import (
 	"time"
 )
 
+// RPC 传输层，ConsensusModule 通过它调用 peer 的 RPC 方法
+// Server 是默认的实现
+type Transport interface {
+	Call(id int, serviceMethod string, args interface{}, reply interface{}) error
+
+	// 与 peer 的连接状况
+	PeerConnStatus(id int) PeerConn
+}
+
+// peer 连接状态
+type ConnState int
+
+const (
+	ConnDisconnected ConnState = iota // 未连接，不会主动拨号
+	ConnConnected                     // 已连接
+	ConnFailed                        // 连接出错，下一次调用时重新拨号
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnDisconnected:
+		return "Disconnected"
+	case ConnConnected:
+		return "Connected"
+	case ConnFailed:
+		return "Failed"
+	default:
+		panic("unreachable")
+	}
+}
+
+// peer 连接的健康状况
+type PeerConn struct {
+	State     ConnState // 连接状态
+	Failures  int       // 连续失败的调用次数
+	LastError error     // 最后一次失败的原因
+}
+
 // RPC 服务器
 type Server struct {
 	mu sync.Mutex
@@ -22,22 +62,32 @@ type Server struct {
 	storage  Storage
 	rpcProxy *RPCProxy
 
+	groups map[int]*ConsensusModule // 按 GroupID 索引的所有共识模块，包括 cm，见 AddGroup
+
 	rpcServer *rpc.Server
 	listener  net.Listener
 
 	commitChan  chan<- CommitEntry
 	peerClients map[int]*rpc.Client
+	peerAddrs   map[int]net.Addr // 已连接 peer 的地址，连接失败后据此重新拨号
+	peerConns   map[int]*PeerConn
+
+	config *Config
 
 	ready <-chan interface{}
 	quit  chan interface{}
 	wg    sync.WaitGroup
 }
 
-func NewServer(serverId int, peerIds []int, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry) *Server {
+func NewServer(serverId int, peerIds []int, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry, config *Config) *Server {
 	s := new(Server)
+	s.config = config
 	s.serverId = serverId
 	s.peerIds = peerIds
 	s.peerClients = make(map[int]*rpc.Client)
+	s.peerAddrs = make(map[int]net.Addr)
+	s.peerConns = make(map[int]*PeerConn)
+	s.groups = make(map[int]*ConsensusModule)
 	s.storage = storage
 	s.ready = ready
 	s.commitChan = commitChan
@@ -45,16 +95,26 @@ func NewServer(serverId int, peerIds []int, storage Storage, ready <-chan interf
 	return s
 }
 
-func (s *Server) Serve() {
+// 启动服务，持久化数据损坏时返回错误
+func (s *Server) Serve() error {
 	s.mu.Lock()
-	s.cm = NewConsensusModule(s.serverId, s.peerIds, s, s.storage, s.ready, s.commitChan)
+	var err error
+	s.cm, err = NewConsensusModule(s.serverId, s.peerIds, s.transportFor(s.config), s.storage, s.ready, s.commitChan, s.config)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.groups[s.cm.config.GroupID] = s.cm
 
 	s.rpcServer = rpc.NewServer()
-	s.rpcProxy = &RPCProxy{cm: s.cm}
+	s.rpcProxy = &RPCProxy{s: s}
 	s.rpcServer.RegisterName("ConsensusModule", s.rpcProxy)
 
-	var err error
-	s.listener, err = net.Listen("tcp", ":0")
+	if tlsConfig := s.tlsConfig(); tlsConfig != nil {
+		s.listener, err = tls.Listen("tcp", ":0", tlsConfig)
+	} else {
+		s.listener, err = net.Listen("tcp", ":0")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -82,6 +142,7 @@ func (s *Server) Serve() {
 			}()
 		}
 	}()
+	return nil
 }
 
 func (s *Server) DisconnectAll() {
@@ -92,16 +153,90 @@ func (s *Server) DisconnectAll() {
 			s.peerClients[id].Close()
 			s.peerClients[id] = nil
 		}
+		delete(s.peerAddrs, id)
+		delete(s.peerConns, id)
 	}
 }
 
 func (s *Server) Shutdown() {
-	s.cm.Stop()
+	s.mu.Lock()
+	groups := make([]*ConsensusModule, 0, len(s.groups))
+	for _, cm := range s.groups {
+		groups = append(groups, cm)
+	}
+	s.mu.Unlock()
+	for _, cm := range groups {
+		cm.Stop()
+	}
 	close(s.quit)
 	s.listener.Close()
 	s.wg.Wait()
 }
 
+// 共识模块状态反馈，见 ConsensusModule.Report
+func (s *Server) Report() (id int, term int, isLeader bool) {
+	return s.cm.Report()
+}
+
+// 向共识模块提交 command，见 ConsensusModule.Submit
+func (s *Server) Submit(command interface{}) bool {
+	return s.cm.Submit(command)
+}
+
+// 服务停止且不会再向 commitChan 发送提交时关闭，只能在 Serve 成功之后调用
+func (s *Server) Stopped() <-chan struct{} {
+	return s.cm.commitLoopDone
+}
+
+// 在同一个 Server 上运行另一个 Raft 组（multi-raft），与 Serve 创建的共识模块共用监听端口与 peer 连接
+// 新的共识模块使用 config 的副本，其中的 GroupID 设为 groupId，RPC 按 GroupID 交给对应的共识模块；
+// peerIds 中的节点也需要在各自的 Server 上添加同一个组，连接则由 ConnectToPeer 统一管理。
+// 只能在 Serve 成功之后调用，groupId 已经存在或持久化数据损坏时返回错误
+func (s *Server) AddGroup(groupId int, peerIds []int, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry, config *Config) (*ConsensusModule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[groupId]; ok {
+		return nil, fmt.Errorf("raft: group %d already exists", groupId)
+	}
+	var cc Config
+	if config != nil {
+		cc = *config
+	}
+	cc.GroupID = groupId
+	cm, err := NewConsensusModule(s.serverId, peerIds, s.transportFor(&cc), storage, ready, commitChan, &cc)
+	if err != nil {
+		return nil, err
+	}
+	s.groups[groupId] = cm
+	return cm, nil
+}
+
+// 获取 Raft 组的共识模块，没有这个组时返回 nil
+func (s *Server) Group(groupId int) *ConsensusModule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.groups[groupId]
+}
+
+// 查找 RPC 的目标共识模块
+func (s *Server) group(groupId int) (*ConsensusModule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cm, ok := s.groups[groupId]
+	if !ok {
+		return nil, fmt.Errorf("raft: unknown group %d", groupId)
+	}
+	return cm, nil
+}
+
+// 共识模块使用的传输层，按 config.WrapTransport 包装
+func (s *Server) transportFor(config *Config) Transport {
+	if config != nil && config.WrapTransport != nil {
+		return config.WrapTransport(s.serverId, s)
+	}
+	return s
+}
+
 func (s *Server) GetListenAddr() net.Addr {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -111,12 +246,15 @@ func (s *Server) GetListenAddr() net.Addr {
 func (s *Server) ConnectToPeer(peerId int, addr net.Addr) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.peerAddrs[peerId] = addr
 	if s.peerClients[peerId] == nil {
-		client, err := rpc.Dial(addr.Network(), addr.String())
+		client, err := s.dial(addr)
 		if err != nil {
+			s.recordFailureLocked(peerId, err)
 			return err
 		}
 		s.peerClients[peerId] = client
+		s.peerConns[peerId] = &PeerConn{State: ConnConnected}
 	}
 	return nil
 }
@@ -124,6 +262,8 @@ func (s *Server) ConnectToPeer(peerId int, addr net.Addr) error {
 func (s *Server) DisconnectPeer(peerId int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	delete(s.peerAddrs, peerId)
+	delete(s.peerConns, peerId)
 	if s.peerClients[peerId] != nil {
 		err := s.peerClients[peerId].Close()
 		s.peerClients[peerId] = nil
@@ -135,13 +275,93 @@ func (s *Server) DisconnectPeer(peerId int) error {
 func (s *Server) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
 	s.mu.Lock()
 	peer := s.peerClients[id]
+	addr := s.peerAddrs[id]
 	s.mu.Unlock()
 
+	// 连接曾经失败过，重新拨号
+	if peer == nil && addr != nil {
+		client, err := s.dial(addr)
+		s.mu.Lock()
+		if err != nil {
+			if s.peerAddrs[id] == addr {
+				s.recordFailureLocked(id, err)
+			}
+			s.mu.Unlock()
+			return err
+		}
+		if s.peerClients[id] == nil && s.peerAddrs[id] == addr {
+			s.peerClients[id] = client
+			s.peerConns[id] = &PeerConn{State: ConnConnected}
+		} else {
+			client.Close()
+		}
+		peer = s.peerClients[id]
+		s.mu.Unlock()
+	}
+
 	if peer == nil {
 		return fmt.Errorf("call client %d after it's closed", id)
+	}
+	err := peer.Call(serviceMethod, args, reply)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peerClients[id] != peer {
+		return err
+	}
+	if err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF {
+		// 连接已断开，丢弃它，下一次调用时重新拨号
+		peer.Close()
+		s.peerClients[id] = nil
+		s.recordFailureLocked(id, err)
+	} else if err != nil {
+		s.peerConns[id].Failures++
+		s.peerConns[id].LastError = err
 	} else {
-		return peer.Call(serviceMethod, args, reply)
+		s.peerConns[id] = &PeerConn{State: ConnConnected}
 	}
+	return err
+}
+
+// 记录一次连接失败，需在持有锁的情况下调用
+func (s *Server) recordFailureLocked(id int, err error) {
+	pc := s.peerConns[id]
+	if pc == nil {
+		pc = &PeerConn{}
+		s.peerConns[id] = pc
+	}
+	pc.State = ConnFailed
+	pc.Failures++
+	pc.LastError = err
+}
+
+// 获取与 peer 的连接状况
+func (s *Server) PeerConnStatus(id int) PeerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pc := s.peerConns[id]; pc != nil {
+		return *pc
+	}
+	return PeerConn{State: ConnDisconnected}
+}
+
+// 拨号 peer，配置了 TLS 时使用 TLS 连接
+func (s *Server) dial(addr net.Addr) (*rpc.Client, error) {
+	tlsConfig := s.tlsConfig()
+	if tlsConfig == nil {
+		return rpc.Dial(addr.Network(), addr.String())
+	}
+	conn, err := tls.Dial(addr.Network(), addr.String(), tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+	if s.config == nil {
+		return nil
+	}
+	return s.config.TLSConfig
 }
 
 // RPCProxy is a trivial pass-thru proxy type for ConsensusModule's RPC methods.
@@ -150,38 +370,91 @@ func (s *Server) Call(id int, serviceMethod string, args interface{}, reply inte
 // - Avoiding running into https://github.com/golang/go/issues/19957
 // - Simulating possible unreliable connections by delaying some messages
 //   significantly and dropping others when RAFT_UNRELIABLE_RPC is set.
+// - Routing each RPC to the ConsensusModule of its GroupID, see Server.AddGroup.
 type RPCProxy struct {
-	cm *ConsensusModule
+	s *Server
 }
 
-func (rpp *RPCProxy) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+// unreliable delays every RPC slightly; when RAFT_UNRELIABLE_RPC is set it
+// instead drops some RPCs (returning an error) and delays others significantly.
+func (rpp *RPCProxy) unreliable(cm *ConsensusModule, method string) error {
 	if len(os.Getenv("RAFT_UNRELIABLE_RPC")) > 0 {
 		dice := rand.Intn(10)
 		if dice == 9 {
-			rpp.cm.dlog("drop RequestVote")
+			cm.logf(LogRPC, LevelDebug, "drop %s", method)
 			return fmt.Errorf("RPC failed")
 		} else if dice == 8 {
-			rpp.cm.dlog("delay RequestVote")
+			cm.logf(LogRPC, LevelDebug, "delay %s", method)
 			time.Sleep(75 * time.Millisecond)
 		}
 	} else {
 		time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
 	}
-	return rpp.cm.RequestVote(args, reply)
+	return nil
+}
+
+func (rpp *RPCProxy) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	cm, err := rpp.s.group(args.GroupID)
+	if err != nil {
+		return err
+	}
+	if err := rpp.unreliable(cm, "RequestVote"); err != nil {
+		return err
+	}
+	return cm.RequestVote(args, reply)
 }
 
 func (rpp *RPCProxy) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
-	if len(os.Getenv("RAFT_UNRELIABLE_RPC")) > 0 {
-		dice := rand.Intn(10)
-		if dice == 9 {
-			rpp.cm.dlog("drop AppendEntries")
-			return fmt.Errorf("RPC failed")
-		} else if dice == 8 {
-			rpp.cm.dlog("delay AppendEntries")
-			time.Sleep(75 * time.Millisecond)
-		}
-	} else {
-		time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+	cm, err := rpp.s.group(args.GroupID)
+	if err != nil {
+		return err
+	}
+	if err := rpp.unreliable(cm, "AppendEntries"); err != nil {
+		return err
+	}
+	return cm.AppendEntries(args, reply)
+}
+
+func (rpp *RPCProxy) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	cm, err := rpp.s.group(args.GroupID)
+	if err != nil {
+		return err
+	}
+	if err := rpp.unreliable(cm, "InstallSnapshot"); err != nil {
+		return err
+	}
+	return cm.InstallSnapshot(args, reply)
+}
+
+func (rpp *RPCProxy) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	cm, err := rpp.s.group(args.GroupID)
+	if err != nil {
+		return err
+	}
+	if err := rpp.unreliable(cm, "TimeoutNow"); err != nil {
+		return err
+	}
+	return cm.TimeoutNow(args, reply)
+}
+
+func (rpp *RPCProxy) ForwardSubmit(args ForwardSubmitArgs, reply *ForwardSubmitReply) error {
+	cm, err := rpp.s.group(args.GroupID)
+	if err != nil {
+		return err
+	}
+	if err := rpp.unreliable(cm, "ForwardSubmit"); err != nil {
+		return err
+	}
+	return cm.ForwardSubmit(args, reply)
+}
+
+func (rpp *RPCProxy) Ping(args PingArgs, reply *PingReply) error {
+	cm, err := rpp.s.group(args.GroupID)
+	if err != nil {
+		return err
+	}
+	if err := rpp.unreliable(cm, "Ping"); err != nil {
+		return err
 	}
-	return rpp.cm.AppendEntries(args, reply)
+	return cm.Ping(args, reply)
 }
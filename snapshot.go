@@ -0,0 +1,309 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errNoSnapshotProvider = errors.New("raft: no SnapshotProvider configured")
+
+// 持久化的快照
+type persistedSnapshot struct {
+	Index int    // 快照包含的最后一个日志序号
+	Term  int    // 快照包含的最后一个日志任期
+	Data  []byte // 状态机快照
+}
+
+// 正在接收的快照，所有分块都到齐之后才会安装
+type incomingSnapshot struct {
+	term              int          // 发送者的任期
+	lastIncludedIndex int          // 快照包含的最后一个日志序号
+	lastIncludedTerm  int          // 快照包含的最后一个日志任期
+	data              bytes.Buffer // 已收到的数据
+}
+
+// 安装快照请求，快照被切分为多个分块依次发送
+type InstallSnapshotArgs struct {
+	Term     int // leader 任期
+	LeaderId int // leader id
+
+	LastIncludedIndex int    // 快照包含的最后一个日志序号
+	LastIncludedTerm  int    // 快照包含的最后一个日志任期
+	Offset            int    // 分块在快照中的偏移
+	Data              []byte // 分块数据
+	Done              bool   // 是否是最后一个分块
+
+	GroupID int // 所属的 Raft 组，见 Config.GroupID
+}
+
+type InstallSnapshotReply struct {
+	Term    int  // 回复者任期
+	Success bool // 分块是否被接受，偏移不连续的分块会被拒绝
+}
+
+// leader 分块发送快照，同一个 peer 同时只会有一个快照在发送
+func (cm *ConsensusModule) sendSnapshot(peerId int) {
+	cm.mu.Lock()
+	if cm.state != Leader || cm.snapshotSending[peerId] || cm.paused[peerId] {
+		cm.mu.Unlock()
+		return
+	}
+	cm.snapshotSending[peerId] = true
+	savedCurrentTerm := cm.currentTerm
+	savedEpoch := cm.epoch
+	snapshot := cm.snapshot
+	lastIncludedIndex := cm.snapshotIndex
+	lastIncludedTerm := cm.snapshotTerm
+	chunkSize := cm.config.SnapshotChunkSize
+	cm.mu.Unlock()
+
+	go func() {
+		defer func() {
+			cm.mu.Lock()
+			delete(cm.snapshotSending, peerId)
+			cm.mu.Unlock()
+		}()
+
+		for offset := 0; ; offset += chunkSize {
+			end := intMin(offset+chunkSize, len(snapshot))
+			args := InstallSnapshotArgs{
+				Term:              savedCurrentTerm,
+				LeaderId:          cm.id,
+				LastIncludedIndex: lastIncludedIndex,
+				LastIncludedTerm:  lastIncludedTerm,
+				Offset:            offset,
+				Data:              snapshot[offset:end],
+				Done:              end == len(snapshot),
+				GroupID:           cm.config.GroupID,
+			}
+			cm.logf(LogReplication, LevelDebug, "sending InstallSnapshot to %d: index=%d, offset=%d, len=%d, done=%v", peerId, lastIncludedIndex, offset, end-offset, args.Done)
+
+			var reply InstallSnapshotReply
+			if err := cm.server.Call(peerId, "ConsensusModule.InstallSnapshot", args, &reply); err != nil {
+				cm.mu.Lock()
+				cm.backoffPeer(peerId)
+				cm.mu.Unlock()
+				return
+			}
+
+			cm.mu.Lock()
+			cm.peerFailures[peerId] = 0
+			cm.peerRetryAt[peerId] = time.Time{}
+			cm.peerLastContact[peerId] = cm.config.Clock.Now()
+			if cm.termGapExceeded(reply.Term, peerId, "InstallSnapshot reply") {
+				cm.mu.Unlock()
+				return
+			}
+			if reply.Term > savedCurrentTerm {
+				cm.logf(LogReplication, LevelDebug, "term out of date in InstallSnapshot reply")
+				cm.becomeFollower(reply.Term)
+				cm.mu.Unlock()
+				return
+			}
+			if cm.state != Leader || cm.epoch != savedEpoch || !reply.Success {
+				cm.mu.Unlock()
+				return
+			}
+			if args.Done {
+				cm.nextIndex[peerId] = lastIncludedIndex + 1
+				cm.matchIndex[peerId] = lastIncludedIndex
+				cm.logf(LogReplication, LevelDebug, "InstallSnapshot to %d done: nextIndex := %d", peerId, cm.nextIndex[peerId])
+				cm.mu.Unlock()
+				// 接着发送快照之后的日志，新加入的节点（包括学习者）无需等到下一次心跳就能追上
+				cm.triggerAE()
+				return
+			}
+			cm.mu.Unlock()
+		}
+	}()
+}
+
+// 处理安装快照请求
+func (cm *ConsensusModule) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return nil
+	}
+	if cm.degraded {
+		reply.Term = cm.currentTerm
+		return nil
+	}
+	if cm.termGapExceeded(args.Term, args.LeaderId, "InstallSnapshot") {
+		reply.Term = cm.currentTerm
+		return nil
+	}
+	cm.logf(LogReplication, LevelDebug, "InstallSnapshot: index=%d, term=%d, offset=%d, len=%d, done=%v", args.LastIncludedIndex, args.LastIncludedTerm, args.Offset, len(args.Data), args.Done)
+	if args.Term > cm.currentTerm {
+		cm.logf(LogReplication, LevelDebug, "... term out of date in InstallSnapshot")
+		cm.becomeFollower(args.Term)
+	}
+	if cm.degraded {
+		reply.Term = cm.currentTerm
+		return nil
+	}
+	reply.Term = cm.currentTerm
+	reply.Success = false
+	if args.Term < cm.currentTerm {
+		return nil
+	}
+	if cm.state == Leader {
+		cm.duplicateLeaderDetected(args.LeaderId)
+	}
+	if cm.state != Follower {
+		cm.becomeFollower(args.Term)
+	}
+	cm.electionResetEvent = cm.config.Clock.Now()
+	cm.lastLeaderContact = cm.electionResetEvent
+	cm.leaderId = args.LeaderId
+
+	// 偏移为 0 表示一个新快照的开始，丢弃之前未完成的快照
+	if args.Offset == 0 {
+		cm.incoming = &incomingSnapshot{
+			term:              args.Term,
+			lastIncludedIndex: args.LastIncludedIndex,
+			lastIncludedTerm:  args.LastIncludedTerm,
+		}
+	}
+	// 过期或乱序的分块，直接拒绝，leader 会从头重新发送
+	in := cm.incoming
+	if in == nil || in.term != args.Term ||
+		in.lastIncludedIndex != args.LastIncludedIndex || in.lastIncludedTerm != args.LastIncludedTerm ||
+		in.data.Len() != args.Offset {
+		cm.logf(LogReplication, LevelDebug, "... stale or out-of-order snapshot chunk")
+		return nil
+	}
+	in.data.Write(args.Data)
+	reply.Success = true
+	if !args.Done {
+		return nil
+	}
+
+	cm.incoming = nil
+	cm.installSnapshot(in.lastIncludedIndex, in.lastIncludedTerm, in.data.Bytes())
+	reply.Success = !cm.degraded // 没能持久化的快照不能确认
+	return nil
+}
+
+// 安装完整的快照，需在持有锁的情况下调用
+func (cm *ConsensusModule) installSnapshot(lastIncludedIndex, lastIncludedTerm int, data []byte) {
+	// 已经有更新的快照
+	if lastIncludedIndex <= cm.snapshotIndex {
+		return
+	}
+	// 如果日志中已经有快照的最后一条日志，保留其后的日志，否则整个丢弃
+	kept := lastIncludedIndex < cm.logEnd() && cm.termAt(lastIncludedIndex) == lastIncludedTerm
+	cm.resolveProposalsInSnapshot(lastIncludedIndex, kept)
+	if kept {
+		cm.log = cm.newLog(cm.log[cm.logPos(lastIncludedIndex)+1:])
+	} else {
+		cm.log = cm.newLog(nil)
+	}
+	cm.resetLogHashes()
+	cm.logBase = lastIncludedIndex
+	cm.logBaseTerm = lastIncludedTerm
+	cm.snapshot = data
+	cm.snapshotIndex = lastIncludedIndex
+	cm.snapshotTerm = lastIncludedTerm
+	cm.logDirty, cm.snapshotDirty = true, true
+	if cm.commitIndex < lastIncludedIndex {
+		cm.commitIndex = lastIncludedIndex
+		cm.notifyCommitWatchers()
+	}
+	// 快照之前的日志不再逐条应用，由 commitLoop 把快照交给客户端
+	if cm.lastApplied < lastIncludedIndex {
+		cm.lastApplied = lastIncludedIndex
+		cm.snapshotPending = true
+		cm.signalCommit()
+	}
+	cm.persistToStorage()
+	cm.logf(LogPersistence, LevelInfo, "... installed snapshot index=%d, term=%d; log=%v", lastIncludedIndex, lastIncludedTerm, cm.log)
+}
+
+// 已应用的日志超过阈值时自动快照，在 commitLoop 中调用
+func (cm *ConsensusModule) maybeSnapshot() {
+	provider := cm.config.SnapshotProvider
+	if cm.config.SnapshotThreshold <= 0 || provider == nil {
+		return
+	}
+	cm.mu.Lock()
+	applied := cm.lastApplied - cm.snapshotIndex
+	cm.mu.Unlock()
+	if applied <= cm.config.SnapshotThreshold {
+		return
+	}
+
+	// 调用客户端时不持有锁
+	data, index, err := provider()
+	if err != nil {
+		cm.logf(LogPersistence, LevelDebug, "SnapshotProvider failed: %v", err)
+		return
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.compactLog(index, data)
+}
+
+// ForceSnapshot 立即调用 SnapshotProvider 获取快照并压缩日志，不受 SnapshotThreshold 限制，
+// 例如在备份之前手动触发。leader 和 follower 上都可以调用，自上次快照以来没有新应用的日志时什么也不做
+func (cm *ConsensusModule) ForceSnapshot() error {
+	provider := cm.config.SnapshotProvider
+	if provider == nil {
+		return errNoSnapshotProvider
+	}
+	cm.mu.Lock()
+	if cm.state == Dead {
+		cm.mu.Unlock()
+		return ErrStopped
+	}
+	upToDate := cm.lastApplied <= cm.snapshotIndex
+	cm.mu.Unlock()
+	if upToDate {
+		return nil
+	}
+
+	// 调用客户端时不持有锁
+	data, index, err := provider()
+	if err != nil {
+		return fmt.Errorf("raft: SnapshotProvider: %w", err)
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if index > cm.lastApplied {
+		return fmt.Errorf("raft: snapshot index %d is beyond last applied index %d", index, cm.lastApplied)
+	}
+	// 期间已经有更新的快照
+	if index <= cm.snapshotIndex {
+		return nil
+	}
+	cm.compactLog(index, data)
+	if cm.degraded {
+		return ErrDegraded
+	}
+	return nil
+}
+
+// 以 index 处的快照压缩日志，需在持有锁的情况下调用
+func (cm *ConsensusModule) compactLog(index int, data []byte) {
+	if index <= cm.snapshotIndex || index > cm.lastApplied {
+		cm.logf(LogPersistence, LevelDebug, "ignoring snapshot at index %d: snapshotIndex=%d, lastApplied=%d", index, cm.snapshotIndex, cm.lastApplied)
+		return
+	}
+	cm.snapshotTerm = cm.termAt(index)
+	cm.snapshotIndex = index
+	cm.snapshot = data
+	cm.snapshotDirty = true
+
+	// 快照之前保留 SnapshotEntriesRetained 条日志
+	if base := index - cm.config.SnapshotEntriesRetained; base > cm.logBase {
+		cm.logBaseTerm = cm.termAt(base)
+		cm.log = cm.newLog(cm.log[cm.logPos(base)+1:])
+		cm.resetLogHashes()
+		cm.logBase = base
+		cm.logDirty = true
+	}
+	cm.persistToStorage()
+	cm.logf(LogPersistence, LevelInfo, "compacted log at snapshot index=%d, term=%d; logBase=%d", cm.snapshotIndex, cm.snapshotTerm, cm.logBase)
+}
@@ -0,0 +1,96 @@
+package raft
+
+// 预投票，只有多数派表示会投票时才真正发起选举，需在持有锁的情况下调用
+// 预投票期间不增加任期，被隔离的节点重新加入时不会打断当前的 leader
+func (cm *ConsensusModule) startPreVote() {
+	savedCurrentTerm := cm.currentTerm
+	savedEpoch := cm.epoch
+	cm.electionResetEvent = cm.config.Clock.Now()
+	cm.logf(LogElection, LevelDebug, "starts pre-vote for term %d", savedCurrentTerm+1)
+	if cm.electionQuorum() == 1 {
+		cm.startElection(false)
+		return
+	}
+
+	votesReceived := 1
+	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
+	args := RequestVoteArgs{
+		Term:         savedCurrentTerm + 1,
+		CandidateId:  cm.id,
+		LastLogIndex: lastLogIndex,
+		LastLogTerm:  lastLogTerm,
+		PreVote:      true,
+		GroupID:      cm.config.GroupID,
+	}
+	for _, peerId := range cm.voters() {
+		go func(peerId int) {
+			var reply RequestVoteReply
+			sentAt := cm.config.Clock.Now()
+			if err := cm.server.Call(peerId, "ConsensusModule.RequestVote", args, &reply); err != nil {
+				return
+			}
+			cm.mu.Lock()
+			defer cm.mu.Unlock()
+			cm.recordLatency(peerId, "RequestVote", cm.config.Clock.Now().Sub(sentAt))
+			cm.logf(LogElection, LevelDebug, "received pre-vote reply %+v", reply)
+			cm.config.ElectionStrategy.OnVoteReply(peerId, args, reply)
+			// 预投票期间状态已经改变（收到 leader 请求、已经发起了选举等），结果作废
+			if cm.currentTerm != savedCurrentTerm || cm.epoch != savedEpoch || (cm.state != Follower && cm.state != Candidate) {
+				return
+			}
+			if !reply.VotedGranted {
+				if reply.Term > savedCurrentTerm && !cm.termGapExceeded(reply.Term, peerId, "pre-vote reply") {
+					cm.becomeFollower(reply.Term)
+				}
+				return
+			}
+			votesReceived++
+			if votesReceived >= cm.electionQuorum() {
+				cm.logf(LogElection, LevelInfo, "wins pre-vote with %d votes", votesReceived)
+				cm.startElection(false)
+			}
+		}(peerId)
+	}
+	// 预投票失败时，下一次超时再试
+	cm.resetElectionTimer()
+}
+
+// 是否仍在 leader 的租约内：最短选举超时内收到过 leader 的请求；开启 CheckQuorum 时，
+// leader 失去多数派会主动退位，因此 leader 自己也在租约内。需在持有锁的情况下调用
+func (cm *ConsensusModule) inLeaderLease() bool {
+	if cm.state == Leader {
+		return cm.config.StableLeadership
+	}
+	return cm.state == Follower && cm.leaderId >= 0 &&
+		cm.config.Clock.Now().Sub(cm.lastLeaderContact) < electionTimeoutMin
+}
+
+// leader 在最长选举超时内是否收到过多数派的回复，刚成为 leader 时总是返回 true
+// 需在持有锁的情况下调用
+func (cm *ConsensusModule) checkQuorum() bool {
+	window := electionTimeoutMin + electionTimeoutRange
+	now := cm.config.Clock.Now()
+	if now.Sub(cm.leaderSince) < window {
+		return true
+	}
+	acks := 1
+	for _, peerId := range cm.voters() {
+		if now.Sub(cm.peerLastContact[peerId]) < window {
+			acks++
+		}
+	}
+	return acks >= cm.quorum()
+}
+
+// leader 退位（失去多数派或者主动退位），与 becomeFollower 不同，任期与 votedFor 保持不变，
+// 以免在同一任期内再投出一票，需在持有锁的情况下调用
+func (cm *ConsensusModule) stepDown(reason string) {
+	cm.logf(LogElection, LevelInfo, "steps down in term %d: %s", cm.currentTerm, reason)
+	cm.state = Follower
+	cm.epoch++
+	cm.leaderId = -1
+	cm.electionResetEvent = cm.config.Clock.Now()
+	cm.publishReport()
+	cm.admitCond.Broadcast()
+	cm.resetElectionTimer()
+}
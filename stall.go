@@ -0,0 +1,48 @@
+package raft
+
+import (
+	"time"
+)
+
+// commitIndex 停滞事件，见 Config.OnCommitStalled
+type CommitStall struct {
+	Term         int         // leader 任期
+	CommitIndex  int         // 停滞的 commitIndex
+	LastLogIndex int         // leader 最后一个日志序号，之间的日志都在等待提交
+	Since        time.Time   // 从何时起有日志等待提交而 commitIndex 没有推进
+	MatchIndex   map[int]int // 每个 peer 的 matchIndex，据此可以看出哪些 peer 没有跟上
+}
+
+// 检查 leader 的 commitIndex 是否停滞，在 leader 的心跳循环中调用，需在持有锁的情况下调用
+// 没有待提交的日志或者 commitIndex 有推进时重新计时；停滞超过 Config.CommitStallTimeout 时报告一次
+func (cm *ConsensusModule) checkCommitStall() {
+	if cm.config.CommitStallTimeout <= 0 {
+		return
+	}
+	now := cm.config.Clock.Now()
+	lastLogIndex := cm.logEnd() - 1
+	if cm.commitIndex >= lastLogIndex || cm.commitIndex != cm.stallCommitIndex {
+		cm.stallCommitIndex = cm.commitIndex
+		cm.stallSince = now
+		cm.stallReported = false
+		return
+	}
+	if cm.stallReported || now.Sub(cm.stallSince) < cm.config.CommitStallTimeout {
+		return
+	}
+	cm.stallReported = true
+	s := CommitStall{
+		Term:         cm.currentTerm,
+		CommitIndex:  cm.commitIndex,
+		LastLogIndex: lastLogIndex,
+		Since:        cm.stallSince,
+		MatchIndex:   make(map[int]int),
+	}
+	for _, peerId := range cm.peerIds {
+		s.MatchIndex[peerId] = cm.matchIndex[peerId]
+	}
+	cm.logf(LogReplication, LevelWarn, "commitIndex %d has not advanced for %v with log up to %d; matchIndex=%v", s.CommitIndex, now.Sub(s.Since), lastLogIndex, s.MatchIndex)
+	if cb := cm.config.OnCommitStalled; cb != nil {
+		go cb(s) // 持有锁，在另外的 goroutine 中调用
+	}
+}
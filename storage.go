@@ -5,12 +5,15 @@ import "sync"
 type Storage interface {
 	Set(key string, value []byte)
 
+	// 原子地写入一批数据，要么全部可见，要么全部不可见
+	SetBatch(kv map[string][]byte) error
+
 	Get(key string) ([]byte, bool)
 
 	HasData() bool
 }
 
-// Storage 基于内存，供测试使用
+// Storage 基于内存，供测试和上手使用，进程退出后数据即丢失
 type MapStorage struct {
 	mu sync.Mutex // 比较粗暴，直接一把大锁
 	m  map[string][]byte
@@ -41,3 +44,39 @@ func (ms *MapStorage) HasData() bool {
 	defer ms.mu.Unlock()
 	return len(ms.m) > 0
 }
+
+func (ms *MapStorage) SetBatch(kv map[string][]byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for k, v := range kv {
+		ms.m[k] = v
+	}
+	return nil
+}
+
+// 复制一份独立的 MapStorage，两者之后的写入互不影响，便于测试保存某一时刻的持久化状态
+func (ms *MapStorage) Clone() *MapStorage {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m := make(map[string][]byte, len(ms.m))
+	for k, v := range ms.m {
+		m[k] = append([]byte(nil), v...)
+	}
+	return &MapStorage{
+		m: m,
+	}
+}
+
+// 不做任何持久化的 Storage，用于缓存、测试等不需要持久性的临时集群
+// 使用它时共识模块会直接跳过持久化，省去每次编码整个日志的开销。
+// 注意：没有持久化，Raft 的安全性保证不再成立。节点重启后会忘记任期、投票与日志，
+// 可能在同一任期内再次投票，已提交的日志也可能丢失或被覆盖
+type NoopStorage struct{}
+
+func (NoopStorage) Get(key string) ([]byte, bool) { return nil, false }
+
+func (NoopStorage) Set(key string, value []byte) {}
+
+func (NoopStorage) HasData() bool { return false }
+
+func (NoopStorage) SetBatch(kv map[string][]byte) error { return nil }
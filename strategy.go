@@ -0,0 +1,61 @@
+package raft
+
+import "time"
+
+// 可替换的选举策略，用于试验不同的选举行为而不必修改核心代码，默认为 StandardElection
+// 策略只能在标准 Raft 的安全检查之上附加限制：任期、每个任期一票、日志至少一样新等检查总是先进行，
+// 策略无法让节点投出标准 Raft 不允许的票。所有方法都在持有共识模块的锁时调用，
+// 不能调用 ConsensusModule 的方法，也不应阻塞
+type ElectionStrategy interface {
+	// 选举超时后是否发起选举（开启 StableLeadership 时是预投票），返回 false 时重新计时
+	// 见证者、学习者、降级与等待引导的节点不会调用
+	ShouldStartElection(s ElectionState) bool
+
+	// 标准 Raft 的检查都通过、即将投票（包括预投票）时调用，返回 VoteDeny 则拒绝
+	OnVoteRequest(args RequestVoteArgs, s ElectionState) VoteDecision
+
+	// 收到投票（包括预投票）回复时调用，只用于观察
+	OnVoteReply(peerId int, args RequestVoteArgs, reply RequestVoteReply)
+}
+
+// 策略对投票请求的决定
+type VoteDecision int
+
+const (
+	VoteAllow VoteDecision = iota // 按标准 Raft 投票
+	VoteDeny                      // 拒绝投票
+)
+
+// 交给选举策略的节点状态
+type ElectionState struct {
+	Id           int           // 节点 id
+	State        CMState       // 当前角色
+	Term         int           // 当前任期
+	LeaderId     int           // 已知的 leader，-1 表示未知
+	LastLogIndex int           // 最后一个日志序号
+	LastLogTerm  int           // 最后一个日志任期
+	SinceReset   time.Duration // 距上次重置选举计时（收到 leader 请求、投票等）的时长
+}
+
+// 标准 Raft 的选举策略：超时即发起选举，不附加任何投票限制
+type StandardElection struct{}
+
+func (StandardElection) ShouldStartElection(ElectionState) bool { return true }
+
+func (StandardElection) OnVoteRequest(RequestVoteArgs, ElectionState) VoteDecision { return VoteAllow }
+
+func (StandardElection) OnVoteReply(int, RequestVoteArgs, RequestVoteReply) {}
+
+// 当前的选举状态，需在持有锁的情况下调用
+func (cm *ConsensusModule) electionState() ElectionState {
+	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
+	return ElectionState{
+		Id:           cm.id,
+		State:        cm.state,
+		Term:         cm.currentTerm,
+		LeaderId:     cm.leaderId,
+		LastLogIndex: lastLogIndex,
+		LastLogTerm:  lastLogTerm,
+		SinceReset:   cm.config.Clock.Now().Sub(cm.electionResetEvent),
+	}
+}
@@ -0,0 +1,23 @@
+package raft
+
+import (
+	"time"
+)
+
+// 任期跳跃过大的告警间隔，避免失控的节点刷屏
+const termGapWarnInterval = time.Second
+
+// term 比当前任期大 Config.MaxTermGap 以上时返回 true，调用方应忽略这次请求或回复，见 Config.MaxTermGap
+// 需在持有锁的情况下调用
+func (cm *ConsensusModule) termGapExceeded(term int, peerId int, what string) bool {
+	if cm.config.MaxTermGap <= 0 || term-cm.currentTerm <= cm.config.MaxTermGap {
+		return false
+	}
+	cm.rejectedTerms++
+	cm.logf(LogRPC, LevelDebug, "... ignoring %s from %d with term %d, more than %d after currentTerm=%d", what, peerId, term, cm.config.MaxTermGap, cm.currentTerm)
+	if now := cm.config.Clock.Now(); now.Sub(cm.lastTermGapWarning) >= termGapWarnInterval {
+		cm.lastTermGapWarning = now
+		cm.logf(LogRPC, LevelWarn, "ignoring %s from %d with term %d, current term is %d (rejected %d so far)", what, peerId, term, cm.currentTerm, cm.rejectedTerms)
+	}
+	return true
+}
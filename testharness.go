@@ -24,7 +24,7 @@ type Harness struct {
 	mu sync.Mutex
 
 	// cluster is a list of all the raft servers participating in a cluster.
-	cluster []*Server
+	cluster []*harnessNode
 	storage []*MapStorage
 
 	// commitChans has a channel per server in cluster with the commi channel for
@@ -46,77 +46,169 @@ type Harness struct {
 	// connected implies alive.
 	alive []bool
 
+	// configFor returns the config for the server with the given id; it's
+	// used for every server created by the harness, including restarted ones.
+	configFor func(id int) *Config
+
+	// net is the in-memory network the servers talk over, or nil if they talk
+	// over TCP. See NewMemHarness.
+	net *MemNetwork
+
 	n int
 	t *testing.T
 }
 
+// harnessNode is one server in the harness. Over TCP it's a full Server; on
+// an in-memory network only the consensus module exists and Server is nil.
+type harnessNode struct {
+	*Server
+	cm *ConsensusModule
+}
+
 // NewHarness creates a new test Harness, initialized with n servers connected
 // to each other.
 func NewHarness(t *testing.T, n int) *Harness {
-	ns := make([]*Server, n)
-	connected := make([]bool, n)
-	alive := make([]bool, n)
-	commitChans := make([]chan CommitEntry, n)
-	commits := make([][]CommitEntry, n)
-	ready := make(chan interface{})
-	storage := make([]*MapStorage, n)
+	return NewHarnessWithConfig(t, n, nil)
+}
 
-	// Create all Servers in this cluster, assign ids and peer ids.
-	for i := 0; i < n; i++ {
-		peerIds := make([]int, 0)
-		for p := 0; p < n; p++ {
-			if p != i {
-				peerIds = append(peerIds, p)
-			}
-		}
+// NewHarnessWithConfig is like NewHarness, but creates all servers with the
+// given config.
+func NewHarnessWithConfig(t *testing.T, n int, config *Config) *Harness {
+	return NewHarnessWithConfigs(t, n, func(int) *Config { return config })
+}
 
-		storage[i] = NewMapStorage()
-		commitChans[i] = make(chan CommitEntry)
-		ns[i] = NewServer(i, peerIds, storage[i], ready, commitChans[i])
-		ns[i].Serve()
-		alive[i] = true
-	}
+// NewHarnessWithConfigs is like NewHarness, but creates each server with the
+// config returned by configFor.
+func NewHarnessWithConfigs(t *testing.T, n int, configFor func(id int) *Config) *Harness {
+	return newHarness(t, n, configFor, nil)
+}
 
-	// Connect all peers to each other.
-	for i := 0; i < n; i++ {
-		for j := 0; j < n; j++ {
-			if i != j {
-				ns[i].ConnectToPeer(j, ns[j].GetListenAddr())
-			}
-		}
-		connected[i] = true
-	}
-	close(ready)
+// NewMemHarness is like NewHarnessWithConfig, but the servers talk over an
+// in-memory network instead of TCP, so no ports are opened. Features that
+// need a real Server, such as TLS or extra Raft groups, aren't available.
+func NewMemHarness(t *testing.T, n int, config *Config) *Harness {
+	return newHarness(t, n, func(int) *Config { return config }, NewMemNetwork())
+}
 
+func newHarness(t *testing.T, n int, configFor func(id int) *Config, net *MemNetwork) *Harness {
 	h := &Harness{
-		cluster:     ns,
-		storage:     storage,
-		commitChans: commitChans,
-		commits:     commits,
-		connected:   connected,
-		alive:       alive,
+		cluster:     make([]*harnessNode, n),
+		storage:     make([]*MapStorage, n),
+		commitChans: make([]chan CommitEntry, n),
+		commits:     make([][]CommitEntry, n),
+		connected:   make([]bool, n),
+		alive:       make([]bool, n),
+		configFor:   configFor,
+		net:         net,
 		n:           n,
 		t:           t,
 	}
+	ready := make(chan interface{})
+
+	// Create all servers in this cluster, then connect them to each other.
+	for i := 0; i < n; i++ {
+		h.storage[i] = NewMapStorage()
+		h.commitChans[i] = make(chan CommitEntry)
+		h.startPeer(i, ready)
+	}
+	for i := 0; i < n; i++ {
+		h.connect(i)
+	}
+	close(ready)
+
 	for i := 0; i < n; i++ {
 		go h.collectCommits(i)
 	}
 	return h
 }
 
+// startPeer creates server id from its storage and config and starts it,
+// without connecting it to any peer yet.
+func (h *Harness) startPeer(id int, ready <-chan interface{}) {
+	peerIds := make([]int, 0)
+	for p := 0; p < h.n; p++ {
+		if p != id {
+			peerIds = append(peerIds, p)
+		}
+	}
+
+	if h.net != nil {
+		cm, err := NewConsensusModule(id, peerIds, h.net.Transport(id), h.storage[id], ready, h.commitChans[id], h.configFor(id))
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		h.net.Add(id, cm)
+		h.cluster[id] = &harnessNode{cm: cm}
+	} else {
+		s := NewServer(id, peerIds, h.storage[id], ready, h.commitChans[id], h.configFor(id))
+		if err := s.Serve(); err != nil {
+			h.t.Fatal(err)
+		}
+		h.cluster[id] = &harnessNode{Server: s, cm: s.cm}
+	}
+	h.alive[id] = true
+}
+
+// stopPeer stops server id; it must already be disconnected.
+func (h *Harness) stopPeer(id int) {
+	h.alive[id] = false
+	if h.net != nil {
+		h.cluster[id].cm.Stop()
+	} else {
+		h.cluster[id].Shutdown()
+	}
+}
+
+// connect connects server id to all other connected servers.
+func (h *Harness) connect(id int) {
+	if h.net != nil {
+		h.net.Connect(id)
+	} else {
+		for j := 0; j < h.n; j++ {
+			if j != id && h.alive[j] && h.connected[j] {
+				if err := h.cluster[id].ConnectToPeer(j, h.cluster[j].GetListenAddr()); err != nil {
+					h.t.Fatal(err)
+				}
+				if err := h.cluster[j].ConnectToPeer(id, h.cluster[id].GetListenAddr()); err != nil {
+					h.t.Fatal(err)
+				}
+			}
+		}
+	}
+	h.connected[id] = true
+}
+
+// disconnect cuts server id off from all other servers.
+func (h *Harness) disconnect(id int) {
+	if h.net != nil {
+		h.net.Disconnect(id)
+	} else {
+		h.cluster[id].DisconnectAll()
+		for j := 0; j < h.n; j++ {
+			if j != id {
+				h.cluster[j].DisconnectPeer(id)
+			}
+		}
+	}
+	h.connected[id] = false
+}
+
 // Shutdown shuts down all the servers in the harness and waits for them to
 // stop running.
 func (h *Harness) Shutdown() {
 	for i := 0; i < h.n; i++ {
-		h.cluster[i].DisconnectAll()
-		h.connected[i] = false
+		h.disconnect(i)
 	}
 	for i := 0; i < h.n; i++ {
 		if h.alive[i] {
-			h.alive[i] = false
-			h.cluster[i].Shutdown()
+			h.stopPeer(i)
 		}
 	}
+	// A commitLoop may still be delivering entries it already took; wait for
+	// it to exit before closing its commit channel.
+	for i := 0; i < h.n; i++ {
+		<-h.cluster[i].cm.commitLoopDone
+	}
 	for i := 0; i < h.n; i++ {
 		close(h.commitChans[i])
 	}
@@ -125,29 +217,14 @@ func (h *Harness) Shutdown() {
 // DisconnectPeer disconnects a server from all other servers in the cluster.
 func (h *Harness) DisconnectPeer(id int) {
 	tlog("Disconnect %d", id)
-	h.cluster[id].DisconnectAll()
-	for j := 0; j < h.n; j++ {
-		if j != id {
-			h.cluster[j].DisconnectPeer(id)
-		}
-	}
-	h.connected[id] = false
+	h.disconnect(id)
 }
 
-// ReconnectPeer connects a server to all other servers in the cluster.
+// ReconnectPeer connects a server to all other connected servers in the
+// cluster. Servers that are still disconnected stay that way.
 func (h *Harness) ReconnectPeer(id int) {
 	tlog("Reconnect %d", id)
-	for j := 0; j < h.n; j++ {
-		if j != id && h.alive[j] {
-			if err := h.cluster[id].ConnectToPeer(j, h.cluster[j].GetListenAddr()); err != nil {
-				h.t.Fatal(err)
-			}
-			if err := h.cluster[j].ConnectToPeer(id, h.cluster[id].GetListenAddr()); err != nil {
-				h.t.Fatal(err)
-			}
-		}
-	}
-	h.connected[id] = true
+	h.connect(id)
 }
 
 // CrashPeer "crashes" a server by disconnecting it from all peers and then
@@ -156,8 +233,7 @@ func (h *Harness) ReconnectPeer(id int) {
 func (h *Harness) CrashPeer(id int) {
 	tlog("Crash %d", id)
 	h.DisconnectPeer(id)
-	h.alive[id] = false
-	h.cluster[id].Shutdown()
+	h.stopPeer(id)
 
 	// Clear out the commits slice for the crashed server; Raft assumes the client
 	// has no persistent state. Once this server comes back online it will replay
@@ -175,22 +251,20 @@ func (h *Harness) RestartPeer(id int) {
 	}
 	tlog("Restart %d", id)
 
-	peerIds := make([]int, 0)
-	for p := 0; p < h.n; p++ {
-		if p != id {
-			peerIds = append(peerIds, p)
-		}
-	}
-
 	ready := make(chan interface{})
-	h.cluster[id] = NewServer(id, peerIds, h.storage[id], ready, h.commitChans[id])
-	h.cluster[id].Serve()
+	h.startPeer(id, ready)
 	h.ReconnectPeer(id)
 	close(ready)
-	h.alive[id] = true
 	sleepMs(20)
 }
 
+// RestartPeerEmpty is like RestartPeer, but gives the server empty storage,
+// as if a brand-new node joined the cluster under the same id.
+func (h *Harness) RestartPeerEmpty(id int) {
+	h.storage[id] = NewMapStorage()
+	h.RestartPeer(id)
+}
+
 // CheckSingleLeader checks that only a single server thinks it's the leader.
 // Returns the leader's id and term. It retries several times if no leader is
 // identified yet.
@@ -236,14 +310,14 @@ func (h *Harness) CheckNoLeader() {
 // CheckCommitted verifies that all connected servers have cmd committed with
 // the same index. It also verifies that all commands *before* cmd in
 // the commit sequence match. For this to work properly, all commands submitted
-// to Raft should be unique positive ints.
+// to Raft should be unique and comparable with ==, such as distinct ints.
 // Returns the number of servers that have this command committed, and its
 // log index.
 // TODO: this check may be too strict. Consider tha a server can commit
 // something and crash before notifying the channel. It's a valid commit but
 // this checker will fail because it may not match other servers. This scenario
 // is described in the paper...
-func (h *Harness) CheckCommitted(cmd int) (nc int, index int) {
+func (h *Harness) CheckCommitted(cmd interface{}) (nc int, index int) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -265,16 +339,17 @@ func (h *Harness) CheckCommitted(cmd int) (nc int, index int) {
 	// Check consistency of commits from the start and to the command we're asked
 	// about. This loop will return once a command=cmd is found.
 	for c := 0; c < commitsLen; c++ {
-		cmdAtC := -1
+		var cmdAtC interface{}
+		first := true
 		for i := 0; i < h.n; i++ {
 			if h.connected[i] {
-				cmdOfN := h.commits[i][c].Command.(int)
-				if cmdAtC >= 0 {
+				cmdOfN := h.commits[i][c].Command
+				if !first {
 					if cmdOfN != cmdAtC {
-						h.t.Errorf("got %d, want %d at h.commits[%d][%d]", cmdOfN, cmdAtC, i, c)
+						h.t.Errorf("got %v, want %v at h.commits[%d][%d]", cmdOfN, cmdAtC, i, c)
 					}
 				} else {
-					cmdAtC = cmdOfN
+					cmdAtC, first = cmdOfN, false
 				}
 			}
 		}
@@ -298,13 +373,13 @@ func (h *Harness) CheckCommitted(cmd int) (nc int, index int) {
 
 	// If there's no early return, we haven't found the command we were looking
 	// for.
-	h.t.Errorf("cmd=%d not found in commits", cmd)
+	h.t.Errorf("cmd=%v not found in commits", cmd)
 	return -1, -1
 }
 
 // CheckCommittedN verifies that cmd was committed by exactly n connected
 // servers.
-func (h *Harness) CheckCommittedN(cmd int, n int) {
+func (h *Harness) CheckCommittedN(cmd interface{}, n int) {
 	nc, _ := h.CheckCommitted(cmd)
 	if nc != n {
 		h.t.Errorf("CheckCommittedN got nc=%d, want %d", nc, n)
@@ -313,16 +388,15 @@ func (h *Harness) CheckCommittedN(cmd int, n int) {
 
 // CheckNotCommitted verifies that no command equal to cmd has been committed
 // by any of the active servers yet.
-func (h *Harness) CheckNotCommitted(cmd int) {
+func (h *Harness) CheckNotCommitted(cmd interface{}) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	for i := 0; i < h.n; i++ {
 		if h.connected[i] {
 			for c := 0; c < len(h.commits[i]); c++ {
-				gotCmd := h.commits[i][c].Command.(int)
-				if gotCmd == cmd {
-					h.t.Errorf("found %d at commits[%d][%d], expected none", cmd, i, c)
+				if h.commits[i][c].Command == cmd {
+					h.t.Errorf("found %v at commits[%d][%d], expected none", cmd, i, c)
 				}
 			}
 		}
@@ -334,6 +408,74 @@ func (h *Harness) SubmitToServer(serverId int, cmd interface{}) bool {
 	return h.cluster[serverId].cm.Submit(cmd)
 }
 
+// SubmitToLeader submits cmd to the current leader and returns the leader's
+// id. It fails the test if the leader rejects the command.
+func (h *Harness) SubmitToLeader(cmd interface{}) int {
+	leaderId, _ := h.CheckSingleLeader()
+	if !h.SubmitToServer(leaderId, cmd) {
+		h.t.Fatalf("leader %d rejected %v", leaderId, cmd)
+	}
+	return leaderId
+}
+
+// WaitCommitted waits until every connected server has committed cmd, then
+// verifies that they all committed it at the same index after the same
+// commands, like CheckCommitted. It returns that index.
+func (h *Harness) WaitCommitted(cmd interface{}) int {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if index, ok := h.committedIndex(cmd); ok {
+			return index
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("cmd=%v not committed by all connected servers", cmd)
+		}
+		sleepMs(20)
+	}
+}
+
+// committedIndex returns the index of cmd if every connected server has
+// committed it, with identical commits before it.
+func (h *Harness) committedIndex(cmd interface{}) (int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pos, first := -1, -1
+	for i := 0; i < h.n; i++ {
+		if !h.connected[i] {
+			continue
+		}
+		c := 0
+		for c < len(h.commits[i]) && h.commits[i][c].Command != cmd {
+			c++
+		}
+		if c == len(h.commits[i]) {
+			return -1, false
+		}
+		if first < 0 {
+			pos, first = c, i
+		} else if c != pos {
+			h.t.Fatalf("cmd=%v committed at position %d by server %d, want %d", cmd, c, i, pos)
+		}
+	}
+	if first < 0 {
+		h.t.Fatalf("no connected servers")
+	}
+
+	for c := 0; c <= pos; c++ {
+		want := h.commits[first][c]
+		for i := first + 1; i < h.n; i++ {
+			if !h.connected[i] {
+				continue
+			}
+			if got := h.commits[i][c]; got.Command != want.Command || got.Index != want.Index {
+				h.t.Fatalf("commits[%d][%d] = %+v, want %+v", i, c, got, want)
+			}
+		}
+	}
+	return h.commits[first][pos].Index, true
+}
+
 func tlog(format string, a ...interface{}) {
 	format = "[TEST] " + format
 	log.Printf(format, a...)
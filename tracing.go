@@ -0,0 +1,41 @@
+package raft
+
+// 跨节点追踪
+// RequestVote 与 AppendEntries 请求中携带发送方 span 的 SpanContext，接收方以它为父 span
+// 开始处理请求的 span，这样 leader 的一次复制与 follower 对它的处理就能关联在同一条链路中。
+// 字段布局与 OpenTelemetry 一致，实现 Tracer 时可以直接转换为 trace.SpanContext
+
+// span 的标识，零值表示没有父 span
+type SpanContext struct {
+	TraceID [16]byte // 链路 id
+	SpanID  [8]byte  // span id
+}
+
+// 是否是有效的 SpanContext
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// 追踪器
+type Tracer interface {
+	// 开始一个 span，parent 无效时开始一条新的链路
+	StartSpan(name string, parent SpanContext) Span
+}
+
+// 追踪中的一个操作
+type Span interface {
+	Context() SpanContext
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// 默认的追踪器，什么也不做
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(name string, parent SpanContext) Span { return noopSpan{parent} }
+
+type noopSpan struct{ sc SpanContext }
+
+func (s noopSpan) Context() SpanContext                     { return s.sc }
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End()                                       {}
@@ -0,0 +1,180 @@
+package raft
+
+import (
+	"context"
+	"time"
+)
+
+// 立即选举请求，leader 转移领导权时发给目标 peer
+type TimeoutNowArgs struct {
+	Term     int // leader 任期
+	LeaderId int // leader id
+	GroupID  int // 所属的 Raft 组，见 Config.GroupID
+}
+
+type TimeoutNowReply struct {
+	Term int // 回复者任期
+}
+
+// 处理立即选举请求，不等待选举超时，马上发起选举
+func (cm *ConsensusModule) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state == Dead {
+		return nil
+	}
+	if cm.termGapExceeded(args.Term, args.LeaderId, "TimeoutNow") {
+		reply.Term = cm.currentTerm
+		return nil
+	}
+	cm.logf(LogElection, LevelDebug, "TimeoutNow: %+v", args)
+	if args.Term > cm.currentTerm {
+		cm.becomeFollower(args.Term)
+	}
+	reply.Term = cm.currentTerm
+	if args.Term == cm.currentTerm && cm.state == Follower && !cm.config.Witness && !cm.isLearner(cm.id) && !cm.degraded {
+		cm.startElection(true)
+	}
+	return nil
+}
+
+// 立即发起选举，供运维手动更换 leader 或测试使用
+// 与 StopGracefully 中的领导权转移不同，不会等待本节点追上 leader 的日志，日志落后时选举会失败。
+// 选举请求与领导权转移一样不受 leader 租约的限制，因此会打断当前的 leader。
+// 已经是 Leader 时什么也不做；节点已停止返回 ErrStopped，见证者与学习者返回 ErrCannotLead，
+// 持久化失败而降级的节点返回 ErrDegraded
+func (cm *ConsensusModule) ForceElection() error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	switch {
+	case cm.state == Dead:
+		return ErrStopped
+	case cm.config.Witness || cm.isLearner(cm.id):
+		return ErrCannotLead
+	case cm.degraded:
+		return ErrDegraded
+	case cm.state == Leader:
+		return nil
+	}
+	cm.logf(LogElection, LevelDebug, "forcing an election")
+	cm.startElection(true)
+	return nil
+}
+
+// 主动退位为 Follower，任期不变，也不指定继任者
+// 心跳随之停止，follower 们选举超时后重新选举，本节点照常参与，也可能再次当选。
+// 可用于测试或滚动升级；不是 Leader 时返回 ErrNotLeader，节点已停止返回 ErrStopped
+func (cm *ConsensusModule) StepDown() error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	switch cm.state {
+	case Dead:
+		return ErrStopped
+	case Leader:
+		cm.stepDown("requested")
+		return nil
+	default:
+		return ErrNotLeader
+	}
+}
+
+// 优雅地停止服务
+// 如果当前节点是 Leader，先停止接受新的提案，等日志最新的 peer 追上后让它立即发起选举，
+// 自己退位后再停止，以免计划内的重启引起一次选举超时的不可用。
+// 如果在 ctx 过期之前没能完成转移，直接停止并返回 ctx.Err()
+func (cm *ConsensusModule) StopGracefully(ctx context.Context) error {
+	cm.mu.Lock()
+	voters := cm.voters()
+	if cm.state != Leader || len(voters) == 0 {
+		cm.mu.Unlock()
+		cm.Stop()
+		return nil
+	}
+	cm.transferring = true
+	savedCurrentTerm := cm.currentTerm
+	target := cm.transferTarget(voters)
+	cm.logf(LogElection, LevelInfo, "transferring leadership to %d", target)
+	cm.mu.Unlock()
+
+	ticker := cm.config.Clock.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeoutNowSent := make(chan bool, 1)
+	sending := false
+	for {
+		cm.mu.Lock()
+		if cm.state != Leader || cm.currentTerm != savedCurrentTerm {
+			cm.mu.Unlock()
+			break
+		}
+		lastLogIndex, _ := cm.lastLogIndexAndTerm()
+		caughtUp := cm.matchIndex[target] == lastLogIndex
+		cm.mu.Unlock()
+
+		if !caughtUp {
+			cm.triggerAE()
+		} else if !sending {
+			sending = true
+			go func() {
+				args := TimeoutNowArgs{Term: savedCurrentTerm, LeaderId: cm.id, GroupID: cm.config.GroupID}
+				var reply TimeoutNowReply
+				err := cm.server.Call(target, "ConsensusModule.TimeoutNow", args, &reply)
+				timeoutNowSent <- err == nil
+			}()
+		}
+
+		select {
+		case <-ticker.C():
+		case ok := <-timeoutNowSent:
+			sending = ok // 发送失败则重试
+		case <-ctx.Done():
+			cm.logf(LogElection, LevelDebug, "leadership transfer to %d not done: %v", target, ctx.Err())
+			cm.Stop()
+			return ctx.Err()
+		}
+	}
+	cm.Stop()
+	return nil
+}
+
+// 排空节点，为计划内的停机做准备
+// 之后 Submit 等提交方法都拒绝新的提案（如同不是 Leader，也不再转发），但照常复制与提交已经追加的日志。
+// 已提交的日志都交给客户端、并且作为 Leader 时自己的日志也都已提交之后，关闭返回的 channel；
+// 节点停止时也会关闭。Leader 联系不上多数派时可能一直无法完成，需要调用方自己设置超时。
+// 排空不会转移领导权，之后可以调用 StopGracefully 或 Stop
+func (cm *ConsensusModule) Drain() <-chan struct{} {
+	cm.mu.Lock()
+	cm.draining = true
+	cm.logf(LogElection, LevelInfo, "draining")
+	cm.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := cm.config.Clock.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			cm.mu.Lock()
+			drained := cm.state == Dead || cm.drained()
+			cm.mu.Unlock()
+			if drained {
+				cm.logf(LogElection, LevelInfo, "drained")
+				close(done)
+				return
+			}
+			<-ticker.C()
+		}
+	}()
+	return done
+}
+
+// 已追加的日志是否都已提交并交给客户端，需在持有锁的情况下调用
+func (cm *ConsensusModule) drained() bool {
+	if cm.deliveredIndex < cm.commitIndex {
+		return false
+	}
+	return cm.state != Leader || cm.commitIndex >= cm.logEnd()-1
+}
+
+// 是否拒绝新的提案，需在持有锁的情况下调用
+func (cm *ConsensusModule) refusingProposals() bool {
+	return cm.transferring || cm.draining
+}
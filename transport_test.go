@@ -0,0 +1,83 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errFakeUnreachable = errors.New("unreachable")
+
+// fakeTransport is a Transport for tests that drive a single ConsensusModule
+// without peers. Every Call goes to call; with a nil call, calls fail as if
+// the peer were unreachable.
+type fakeTransport struct {
+	call func(id int, serviceMethod string, args interface{}, reply interface{}) error
+}
+
+func (f *fakeTransport) Call(id int, serviceMethod string, args interface{}, reply interface{}) error {
+	if f.call == nil {
+		return errFakeUnreachable
+	}
+	return f.call(id, serviceMethod, args, reply)
+}
+
+func (f *fakeTransport) PeerConnStatus(id int) PeerConn { return PeerConn{} }
+
+// recordCalls returns a fakeTransport that sends the name of every method
+// called on it to calls and fails the call. AppendEntries calls are suffixed
+// with their PrevLogIndex.
+func recordCalls(calls chan<- string) *fakeTransport {
+	return &fakeTransport{call: func(id int, serviceMethod string, args interface{}, reply interface{}) error {
+		if ae, ok := args.(AppendEntriesArgs); ok {
+			serviceMethod += fmt.Sprintf("(prev=%d)", ae.PrevLogIndex)
+		}
+		calls <- serviceMethod
+		return errFakeUnreachable
+	}}
+}
+
+// recordAppendEntries returns a fakeTransport that sends every AppendEntries
+// it is asked to send to sent and fails every call.
+func recordAppendEntries(sent chan<- AppendEntriesArgs) *fakeTransport {
+	return &fakeTransport{call: func(id int, serviceMethod string, args interface{}, reply interface{}) error {
+		if ae, ok := args.(AppendEntriesArgs); ok {
+			sent <- ae
+		}
+		return errFakeUnreachable
+	}}
+}
+
+// replyAppendEntries returns a fakeTransport that answers every AppendEntries
+// with aeReply and fails other calls.
+func replyAppendEntries(aeReply AppendEntriesReply) *fakeTransport {
+	return &fakeTransport{call: func(id int, serviceMethod string, args interface{}, reply interface{}) error {
+		if r, ok := reply.(*AppendEntriesReply); ok {
+			*r = aeReply
+			return nil
+		}
+		return errFakeUnreachable
+	}}
+}
+
+// holdTermOneReplies returns a fakeTransport that blocks requests made in term
+// 1 until release is closed and then answers them with a successful reply in
+// term 1. Requests made in later terms fail.
+func holdTermOneReplies(release <-chan struct{}) *fakeTransport {
+	return &fakeTransport{call: func(id int, serviceMethod string, args interface{}, reply interface{}) error {
+		switch r := reply.(type) {
+		case *AppendEntriesReply:
+			if args.(AppendEntriesArgs).Term == 1 {
+				<-release
+				r.Term, r.Success = 1, true
+				return nil
+			}
+		case *RequestVoteReply:
+			if args.(RequestVoteArgs).Term == 1 {
+				<-release
+				r.Term, r.VotedGranted = 1, true
+				return nil
+			}
+		}
+		return errFakeUnreachable
+	}}
+}
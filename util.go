@@ -6,3 +6,10 @@ func intMin(a, b int) int {
 	}
 	return b
 }
+
+func intMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,154 @@
+package raft
+
+import "context"
+
+// 监听 commitIndex 的变化
+// 每当 commitIndex 推进时，返回的 channel 会收到新的 commitIndex，但不包含日志本身。
+// channel 只保留最新的值：读取不及时时，中间的值会被跳过。节点停止时 channel 被关闭
+func (cm *ConsensusModule) WatchCommitIndex() <-chan int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	w := make(chan int, 1)
+	if cm.state == Dead {
+		close(w)
+		return w
+	}
+	cm.commitWatchers = append(cm.commitWatchers, w)
+	return w
+}
+
+// commitIndex 达到 index 时调用 cb 一次，之后自动注销，已经达到时立即调用
+// 比 ProposeAndWait 轻量，适用于已经从 SubmitIfIndex 等拿到了序号的调用方；但只关心序号，
+// leader 更替后该序号上可能是另一条日志，需要时用 IsCommitted 核对任期。
+// cb 在另外的 goroutine 中调用；节点停止之前没有达到时不会调用
+func (cm *ConsensusModule) OnCommit(index int, cb func()) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.commitIndex >= index {
+		go cb()
+		return
+	}
+	if cm.state == Dead {
+		return
+	}
+	cm.commitHooks[index] = append(cm.commitHooks[index], cb)
+}
+
+// 最近提交的客户端命令，还没有提交过时第二个返回值为 false
+// 只关心最新状态的客户端（例如用 Raft 实现的领导权锁）可以直接读取，而不必自己跟踪整个提交流。
+// 在 commitLoop 取出已提交的日志时更新，空操作与配置日志项不计入；恢复或安装快照不会更新它
+func (cm *ConsensusModule) LastCommitted() (CommitEntry, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.lastCommitted == nil {
+		return CommitEntry{}, false
+	}
+	return *cm.lastCommitted, true
+}
+
+// 从 firstIndex 开始的一段已提交日志中，记下最后一条客户端命令，需在持有锁的情况下调用
+func (cm *ConsensusModule) cacheLastCommitted(entries []LogEntry, firstIndex int) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Type == EntryNormal {
+			cm.lastCommitted = &CommitEntry{Command: entries[i].Command, Index: firstIndex + i, Term: entries[i].Term}
+			return
+		}
+	}
+}
+
+// 向所有监听者发送当前的 commitIndex，发送永远不会阻塞，需在持有锁的情况下调用
+// 同时调用 commitIndex 已经达到的 OnCommit 回调
+func (cm *ConsensusModule) notifyCommitWatchers() {
+	for index, hooks := range cm.commitHooks {
+		if index > cm.commitIndex {
+			continue
+		}
+		for _, cb := range hooks {
+			go cb()
+		}
+		delete(cm.commitHooks, index)
+	}
+	for _, w := range cm.commitWatchers {
+		// 丢弃还没被读取的旧值，换成最新的
+		select {
+		case <-w:
+		default:
+		}
+		w <- cm.commitIndex
+	}
+}
+
+// 关闭所有监听者，需在持有锁的情况下调用
+func (cm *ConsensusModule) closeCommitWatchers() {
+	for _, w := range cm.commitWatchers {
+		close(w)
+	}
+	cm.commitWatchers = nil
+	cm.commitHooks = nil
+}
+
+// 等待序号为 index 及之前的日志都已交给客户端（写入 commitChan），或者快照已经覆盖了 index
+// 可用于读自己的写：提交成功后等待本节点应用到该序号再读状态机。
+// ctx 过期时返回 ctx.Err()，节点停止时返回 ErrStopped
+func (cm *ConsensusModule) WaitForApplied(ctx context.Context, index int) error {
+	cm.mu.Lock()
+	if cm.deliveredIndex >= index {
+		cm.mu.Unlock()
+		return nil
+	}
+	if cm.state == Dead {
+		cm.mu.Unlock()
+		return ErrStopped
+	}
+	w := make(chan struct{})
+	cm.applyWaiters[index] = append(cm.applyWaiters[index], w)
+	cm.mu.Unlock()
+
+	select {
+	case <-w:
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		if cm.deliveredIndex >= index {
+			return nil
+		}
+		return ErrStopped
+	case <-ctx.Done():
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		waiters := cm.applyWaiters[index]
+		for i, other := range waiters {
+			if other == w {
+				cm.applyWaiters[index] = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(cm.applyWaiters[index]) == 0 {
+			delete(cm.applyWaiters, index)
+		}
+		return ctx.Err()
+	}
+}
+
+// 推进 deliveredIndex 并唤醒等待的调用，需在持有锁的情况下调用
+func (cm *ConsensusModule) setDeliveredIndex(index int) {
+	cm.deliveredIndex = intMax(cm.deliveredIndex, index)
+	for i, waiters := range cm.applyWaiters {
+		if i > cm.deliveredIndex {
+			continue
+		}
+		for _, w := range waiters {
+			close(w)
+		}
+		delete(cm.applyWaiters, i)
+	}
+}
+
+// 唤醒所有等待的调用，需在持有锁的情况下调用
+func (cm *ConsensusModule) closeApplyWaiters() {
+	for i, waiters := range cm.applyWaiters {
+		for _, w := range waiters {
+			close(w)
+		}
+		delete(cm.applyWaiters, i)
+	}
+}